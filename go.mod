@@ -5,8 +5,14 @@ go 1.24.0
 require (
 	github.com/google/uuid v1.6.0
 	github.com/hooto/htoml4g v0.9.5
+	golang.org/x/crypto v0.43.0
 	google.golang.org/grpc v1.76.0
 	google.golang.org/protobuf v1.36.10
 )
 
-require golang.org/x/sys v0.37.0 // indirect
+require (
+	golang.org/x/net v0.45.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/text v0.30.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250804133106-a7a43d27e69b // indirect
+)
@@ -44,8 +44,6 @@ type AppValidator struct {
 	sign    string
 	keyMgr  *AccessKeyManager
 	Key     *AccessKey
-	roles   []*accessKeyManagerRole
-	scopes  map[string]string
 }
 
 func NewAppCredential(k *AccessKey) *AppCredential {
@@ -163,6 +161,27 @@ func (it *AppValidator) SignValid(data []byte) error {
 	return errors.New("sign denied")
 }
 
+// Principal returns the principal of the access key, nil if the key is not
+// found.
+func (it *AppValidator) Principal() *Principal {
+	if it.Key == nil {
+		return nil
+	}
+	// the key acts on behalf of its owner
+	id := it.Key.User
+	if id == "" {
+		id = it.Key.Id
+	}
+	return &Principal{
+		Id:        id,
+		Type:      "App",
+		RoleNames: it.Key.Roles,
+		Scopes:    it.Key.Scopes,
+	}
+}
+
+// Allow checks each permission (string) and *ScopeFilter of args by the
+// RoleTable of the AccessKeyManager, see RoleTable.Authorize.
 func (it *AppValidator) Allow(args ...interface{}) error {
 
 	if len(args) == 0 {
@@ -174,7 +193,7 @@ func (it *AppValidator) Allow(args ...interface{}) error {
 	}
 
 	var (
-		permissions = map[string]bool{}
+		permissions = []string{}
 		scopes      = []*ScopeFilter{}
 	)
 
@@ -183,7 +202,10 @@ func (it *AppValidator) Allow(args ...interface{}) error {
 		switch arg.(type) {
 
 		case string:
-			permissions[arg.(string)] = false
+			if arg.(string) == "" {
+				return errors.New("permission not set")
+			}
+			permissions = append(permissions, arg.(string))
 
 		case *ScopeFilter:
 			scopes = append(scopes, arg.(*ScopeFilter))
@@ -193,48 +215,22 @@ func (it *AppValidator) Allow(args ...interface{}) error {
 		}
 	}
 
-	if len(scopes) > 0 {
-
-		if len(it.Key.Scopes) < 1 {
-			return errors.New("access_key/scopes not found")
-		}
-
-		if it.scopes == nil || len(it.scopes) == 0 {
-			it.scopes = map[string]string{}
-			for _, v := range it.Key.Scopes {
-				it.scopes[v.Name] = "," + v.Value + ","
-			}
-		}
-
-		for _, scope := range scopes {
-			if p, ok := it.scopes[scope.Name]; !ok || len(p) == 0 {
-				return errors.New("access_key/scopes/name=" + scope.Name + " not match")
-			} else if p != ",*," && !strings.Contains(p, ","+scope.Value+",") {
-				return errors.New("access_key/scopes/value=" + scope.Value + " not match")
-			}
+	var (
+		table = it.keyMgr.RoleTable()
+		req   = &Request{
+			Principal: it.Principal(),
+			Scopes:    scopes,
 		}
-	}
+	)
 
 	if len(permissions) == 0 {
-		return nil
-	}
-
-	if len(it.roles) == 0 {
-		it.roles = it.keyMgr.keyRoles(it.Key)
-		if len(it.roles) == 0 {
-			return errors.New("access_key/roles not found")
-		}
+		return table.Authorize(req).Err()
 	}
 
-	for permission, _ := range permissions {
-		hit := false
-		for _, role := range it.roles {
-			if _, hit = role.permissions[permission]; hit {
-				break
-			}
-		}
-		if !hit {
-			return errors.New("permission=" + permission + " not allow")
+	for _, permission := range permissions {
+		req.Action = permission
+		if err := table.Authorize(req).Err(); err != nil {
+			return err
 		}
 	}
 
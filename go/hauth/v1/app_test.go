@@ -60,6 +60,11 @@ func Test_AppMain(t *testing.T) {
 		t.Fatal("Failed on AppValid")
 	}
 
+	// the principal of a key is its owner
+	if p := rs.Principal(); p == nil || p.Id != tAppAccessKey.User || p.Type != "App" {
+		t.Fatal("Failed on Principal")
+	}
+
 	rs, err = NewAppValidator(token, tAppKeyMgrErr)
 	if err := rs.SignValid(tAppData); err == nil {
 		t.Fatal("Failed on AppValid")
@@ -0,0 +1,182 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// Principal is the subject of an authorization Request, as given by an
+// AppValidator, a UserValidator or a session of the v2 API.
+type Principal struct {
+	Id   string
+	Type string // User or App
+
+	// Roles are role ids, RoleNames role names, both resolved by RoleTable.
+	Roles     []uint32
+	RoleNames []string
+
+	Groups []string
+	Scopes []*ScopeFilter
+}
+
+type Request struct {
+	Principal *Principal
+
+	// Action is the permission to check, only the scopes are checked if
+	// empty.
+	Action string
+
+	Resource string
+
+	// Scopes must all be allowed by the scopes of the principal.
+	Scopes []*ScopeFilter
+}
+
+// Decision is the result of Authorizer.Authorize. Role, Permission and
+// Scope are set to the role entry and to the principal scope deciding the
+// request, Reasons is the trail of the checks done.
+type Decision struct {
+	Allowed bool
+
+	Role       string
+	Permission string
+	Scope      *ScopeFilter
+
+	Reasons []string
+}
+
+// Authorizer decides the authorization requests.
+type Authorizer interface {
+	Authorize(req *Request) *Decision
+}
+
+func (it *Decision) allow(reason string) *Decision {
+	it.Allowed = true
+	it.Reasons = append(it.Reasons, reason)
+	return it
+}
+
+func (it *Decision) deny(reason string) *Decision {
+	it.Allowed = false
+	it.Reasons = append(it.Reasons, reason)
+	return it
+}
+
+// Err returns nil if the request is allowed, or else the last reason.
+func (it *Decision) Err() error {
+	if it.Allowed {
+		return nil
+	}
+	if len(it.Reasons) == 0 {
+		return errors.New("denied")
+	}
+	return errors.New(it.Reasons[len(it.Reasons)-1])
+}
+
+// String formats the reason trail.
+func (it *Decision) String() string {
+	return strings.Join(it.Reasons, "; ")
+}
+
+// ScopeMatch returns the scope of scopes allowing scope, the values of a
+// scope are comma-separated, "*" allows all values.
+func ScopeMatch(scopes []*ScopeFilter, scope *ScopeFilter) *ScopeFilter {
+	for _, v := range scopes {
+		if v.Name != scope.Name {
+			continue
+		}
+		if v.Value == "*" || strings.Contains(","+v.Value+",", ","+scope.Value+",") {
+			return v
+		}
+	}
+	return nil
+}
+
+// Authorize checks the scopes of the request, and if the roles of the
+// principal grant the action. The resource is not checked.
+func (it *RoleTable) Authorize(req *Request) *Decision {
+
+	d := &Decision{}
+
+	p := req.Principal
+	if p == nil {
+		return d.deny("principal not found")
+	}
+
+	if len(req.Scopes) > 0 {
+		if len(p.Scopes) == 0 {
+			return d.deny("scopes not found")
+		}
+		for _, scope := range req.Scopes {
+			v := ScopeMatch(p.Scopes, scope)
+			if v == nil {
+				return d.deny("scopes/" + scope.Name + "=" + scope.Value + " not match")
+			}
+			d.Scope = v
+			d.allow("scope " + v.Name + "=" + v.Value + " allows " + scope.Value)
+		}
+	}
+
+	if req.Action == "" {
+		return d.allow("no action")
+	}
+
+	items := it.principalItems(p)
+	for _, item := range items {
+		if roleDisabled(item.role) {
+			d.Reasons = append(d.Reasons, "role "+item.role.Name+" disabled")
+		}
+	}
+	if len(items) == 0 {
+		return d.deny("roles not found")
+	}
+
+	m := rolesMatch(items, req.Action)
+	if m == nil {
+		return d.deny("permission=" + req.Action + " not allow")
+	}
+
+	d.Role, d.Permission = m.role, m.entry
+
+	reason := "role " + m.role
+	if m.origin != m.role {
+		reason += " (from " + m.origin + ")"
+	}
+	if m.deny {
+		return d.deny(reason + " denies permission=" + req.Action + " by " + m.entry)
+	}
+
+	return d.allow(reason + " grants permission=" + req.Action + " by " + m.entry)
+}
+
+func (it *RoleTable) principalItems(p *Principal) []*roleTableItem {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	items := []*roleTableItem{}
+	for _, id := range p.Roles {
+		if item, ok := it.ids[id]; ok && !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+	for _, name := range p.RoleNames {
+		if item, ok := it.names[name]; ok && !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_RoleTable_Authorize(t *testing.T) {
+
+	table := NewRoleTable()
+	table.RoleSet(&Role{Id: 100, Name: "viewer", Permissions: []string{"doc.*.get"}})
+	table.RoleSet(&Role{Id: 200, Name: "editor", Parents: []uint32{100},
+		Permissions: []string{"doc.**", "!doc.secret.**"}})
+
+	p := &Principal{
+		Id:     "u1",
+		Roles:  []uint32{200},
+		Scopes: []*ScopeFilter{NewScopeFilter("zone", "z1,z2")},
+	}
+
+	d := table.Authorize(&Request{
+		Principal: p,
+		Action:    "doc.file.get",
+		Scopes:    []*ScopeFilter{NewScopeFilter("zone", "z2")},
+	})
+	if !d.Allowed || d.Role != "editor" || d.Permission != "doc.**" ||
+		d.Scope == nil || d.Scope.Name != "zone" || len(d.Reasons) != 2 {
+		t.Fatal("Failed on Authorize " + d.String())
+	}
+
+	// the permission inherited from the parent role
+	p.Roles = []uint32{300}
+	p.RoleNames = []string{"editor", "viewer"}
+	table.RoleSet(&Role{Id: 300, Name: "reader", Parents: []uint32{100}})
+	if d = table.Authorize(&Request{Principal: p, Action: "doc.file.get"}); !d.Allowed ||
+		d.Role != "reader" || !strings.Contains(d.String(), "(from viewer)") {
+		t.Fatal("Failed on Authorize inherited " + d.String())
+	}
+
+	if d = table.Authorize(&Request{Principal: p, Action: "doc.secret.key.get"}); d.Allowed ||
+		d.Role != "editor" || d.Permission != "!doc.secret.**" || d.Err() == nil {
+		t.Fatal("Failed on Authorize deny " + d.String())
+	}
+
+	if d = table.Authorize(&Request{Principal: p, Action: "compute.get"}); d.Allowed ||
+		d.Err().Error() != "permission=compute.get not allow" {
+		t.Fatal("Failed on Authorize not allow")
+	}
+
+	if d = table.Authorize(&Request{
+		Principal: p,
+		Scopes:    []*ScopeFilter{NewScopeFilter("zone", "z3")},
+	}); d.Allowed {
+		t.Fatal("Failed on Authorize scope")
+	}
+
+	if d = table.Authorize(&Request{Action: "doc.file.get"}); d.Allowed {
+		t.Fatal("Failed on Authorize principal")
+	}
+}
@@ -47,18 +47,25 @@ var (
 type AccessKeyManager struct {
 	mu    sync.RWMutex
 	items map[string]*AccessKey
-	roles map[string]*accessKeyManagerRole
+	roles *RoleTable
 }
 
-type accessKeyManagerRole struct {
-	permissions map[string]bool
-}
-
-func NewAccessKeyManager() *AccessKeyManager {
-	return &AccessKeyManager{
+// NewAccessKeyManager creates an AccessKeyManager, optional args is the
+// *RoleTable shared with other managers or with the v2 identity tokens.
+func NewAccessKeyManager(args ...any) *AccessKeyManager {
+	it := &AccessKeyManager{
 		items: map[string]*AccessKey{},
-		roles: map[string]*accessKeyManagerRole{},
 	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *RoleTable:
+			it.roles = arg.(*RoleTable)
+		}
+	}
+	if it.roles == nil {
+		it.roles = NewRoleTable()
+	}
+	return it
 }
 
 func (it *AccessKeyManager) KeySet(k *AccessKey) error {
@@ -115,44 +122,61 @@ func (it *AccessKeyManager) Count() int {
 	return len(it.items)
 }
 
+// RoleSet adds or replaces the role of the same name, the id of the
+// replaced role is kept if r.Id is 0. An invalid role (see RoleSetErr) is
+// ignored.
 func (it *AccessKeyManager) RoleSet(r *Role) *AccessKeyManager {
+	it.RoleSetErr(r)
+	return it
+}
 
-	it.mu.Lock()
-	defer it.mu.Unlock()
+// RoleSetErr is RoleSet returning the error of an invalid role, e.g. without
+// name or creating a cycle of parents.
+func (it *AccessKeyManager) RoleSetErr(r *Role) error {
 
-	role, ok := it.roles[r.Name]
-	if !ok {
-		role = &accessKeyManagerRole{
-			permissions: map[string]bool{},
-		}
-		it.roles[r.Name] = role
+	if r == nil || r.Name == "" {
+		return errors.New("role name not set")
 	}
 
-	for _, p := range r.Permissions {
-		role.permissions[p] = true
+	table := it.RoleTable()
+
+	if prev := table.RoleGetByName(r.Name); prev != nil && r.Id == 0 {
+		r = proto.Clone(r).(*Role)
+		r.Id = prev.Id
 	}
 
-	return it
+	return table.RoleSet(r)
 }
 
-func (it *AccessKeyManager) keyRoles(key *AccessKey) []*accessKeyManagerRole {
-
-	it.mu.RLock()
-	defer it.mu.RUnlock()
+// RoleGet returns a copy of the role of name.
+func (it *AccessKeyManager) RoleGet(name string) *Role {
+	return it.RoleTable().RoleGetByName(name)
+}
 
-	if len(key.Roles) == 0 {
-		return nil
-	}
+// RoleDel removes the role of name.
+func (it *AccessKeyManager) RoleDel(name string) error {
+	return it.RoleTable().RoleDel(name)
+}
 
-	roles := []*accessKeyManagerRole{}
+// RoleList returns the copies of the roles ordered by id and name.
+func (it *AccessKeyManager) RoleList() []*Role {
+	return it.RoleTable().RoleList()
+}
 
-	for _, r := range key.Roles {
-		if role, ok := it.roles[r]; ok {
-			roles = append(roles, role)
-		}
+// RoleTable returns the RoleTable which resolves the roles of the keys.
+func (it *AccessKeyManager) RoleTable() *RoleTable {
+	it.mu.RLock()
+	roles := it.roles
+	it.mu.RUnlock()
+	if roles != nil {
+		return roles
 	}
-
-	return roles
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.roles == nil {
+		it.roles = NewRoleTable()
+	}
+	return it.roles
 }
 
 func base64nopad(s string) string {
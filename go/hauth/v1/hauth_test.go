@@ -73,7 +73,7 @@ func Test_AccessKey_JsonEncode(t *testing.T) {
 		} else {
 
 			if !bytes.Contains(bs, []byte(ak.Id)) ||
-				bytes.Contains(bs, []byte("id")) {
+				!bytes.Contains(bs, []byte(`"id":`)) {
 				t.Fatalf("Encode v0 -> v1 %v", string(bs))
 			} else {
 				t.Logf("Encode v0 -> v1 OK")
@@ -86,7 +86,7 @@ func Test_AccessKey_TomlDecode(t *testing.T) {
 
 	for i, js := range tKeysV0Toml {
 		var ak AccessKey
-		if err := htoml.Decode(&ak, []byte(js)); err != nil {
+		if err := htoml.Decode([]byte(js), &ak); err != nil {
 			t.Fatalf("Decode %v", err)
 		} else {
 			if ak.Id != tKeysV0[i].Id ||
@@ -96,7 +96,7 @@ func Test_AccessKey_TomlDecode(t *testing.T) {
 				t.Fatalf("Decode v0 -> v1")
 			} else {
 
-				if bs, err := htoml.Encode(ak, nil); err != nil {
+				if bs, err := htoml.Encode(&ak, nil); err != nil {
 					t.Fatalf("Encode %v", err)
 				} else {
 
@@ -0,0 +1,211 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"strings"
+)
+
+// permissionTrie matches the segmented permission names, segments are
+// delimited by dots or slashes (storage.bucket.get, storage/bucket/get).
+// A "*" segment matches one segment and a "**" segment matches zero or more
+// segments.
+type permissionTrie struct {
+	children map[string]*permissionTrie
+	any      *permissionTrie // "*"
+	deep     *permissionTrie // "**"
+	pattern  string          // the added pattern ending at this node
+}
+
+func newPermissionTrie() *permissionTrie {
+	return &permissionTrie{}
+}
+
+func permissionSegments(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '.' || r == '/'
+	})
+}
+
+func pathSegments(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/'
+	})
+}
+
+func (it *permissionTrie) add(name string) {
+	it.addSegments(name, permissionSegments(name))
+}
+
+func (it *permissionTrie) addSegments(name string, segs []string) {
+	n := it
+	for _, seg := range segs {
+		switch seg {
+		case "*":
+			if n.any == nil {
+				n.any = newPermissionTrie()
+			}
+			n = n.any
+		case "**":
+			if n.deep == nil {
+				n.deep = newPermissionTrie()
+			}
+			n = n.deep
+		default:
+			if n.children == nil {
+				n.children = map[string]*permissionTrie{}
+			}
+			c, ok := n.children[seg]
+			if !ok {
+				c = newPermissionTrie()
+				n.children[seg] = c
+			}
+			n = c
+		}
+	}
+	n.pattern = name
+}
+
+func (it *permissionTrie) match(name string) bool {
+	return it.matchSegments(permissionSegments(name)) != ""
+}
+
+// matchSegments returns the pattern matching the segments, or "".
+func (it *permissionTrie) matchSegments(segs []string) string {
+	if it.deep != nil {
+		for i := 0; i <= len(segs); i++ {
+			if p := it.deep.matchSegments(segs[i:]); p != "" {
+				return p
+			}
+		}
+	}
+	if len(segs) == 0 {
+		return it.pattern
+	}
+	if c, ok := it.children[segs[0]]; ok {
+		if p := c.matchSegments(segs[1:]); p != "" {
+			return p
+		}
+	}
+	if it.any != nil {
+		return it.any.matchSegments(segs[1:])
+	}
+	return ""
+}
+
+// PermissionSet is a compiled set of permission patterns, which may contain
+// "*" and "**" wildcard segments.
+type PermissionSet struct {
+	trie     *permissionTrie
+	segments func(name string) []string
+}
+
+func NewPermissionSet(patterns ...string) *PermissionSet {
+	return newPermissionSet(permissionSegments, patterns)
+}
+
+// NewPathSet is a PermissionSet of resource paths, which segments are only
+// delimited by slashes (bucket/report.pdf).
+func NewPathSet(patterns ...string) *PermissionSet {
+	return newPermissionSet(pathSegments, patterns)
+}
+
+func newPermissionSet(segments func(string) []string, patterns []string) *PermissionSet {
+	it := &PermissionSet{
+		trie:     newPermissionTrie(),
+		segments: segments,
+	}
+	for _, v := range patterns {
+		it.trie.addSegments(v, segments(v))
+	}
+	return it
+}
+
+// Match checks if name matches one of the patterns.
+func (it *PermissionSet) Match(name string) bool {
+	return it.trie.matchSegments(it.segments(name)) != ""
+}
+
+// rolePermissions are the compiled permissions of a role, the entries
+// prefixed by "!" are denied.
+type rolePermissions struct {
+	allow   *permissionTrie
+	deny    *permissionTrie
+	origins map[string]string // entry: name of the role defining it
+}
+
+func newRolePermissions() *rolePermissions {
+	return &rolePermissions{
+		allow:   newPermissionTrie(),
+		deny:    newPermissionTrie(),
+		origins: map[string]string{},
+	}
+}
+
+func (it *rolePermissions) add(name, origin string) {
+	if strings.HasPrefix(name, "!") {
+		it.deny.add(name[1:])
+	} else {
+		it.allow.add(name)
+	}
+	if _, ok := it.origins[name]; !ok {
+		it.origins[name] = origin
+	}
+}
+
+// rolePermissionMatch is the role entry deciding a permission.
+type rolePermissionMatch struct {
+	role   string // the role of the principal
+	origin string // the role defining the entry, role or one of its ancestors
+	entry  string
+	deny   bool
+}
+
+// rolesMatch returns the first entry of the roles denying permission, or
+// else the first one allowing it, nil if none matches.
+func rolesMatch(items []*roleTableItem, permission string) *rolePermissionMatch {
+	segs := permissionSegments(permission)
+	if len(segs) == 0 {
+		return nil
+	}
+	var hit *rolePermissionMatch
+	for _, item := range items {
+		if p := item.permissions.deny.matchSegments(segs); p != "" {
+			return &rolePermissionMatch{
+				role:   item.role.Name,
+				origin: item.permissions.origins["!"+p],
+				entry:  "!" + p,
+				deny:   true,
+			}
+		}
+		if hit == nil {
+			if p := item.permissions.allow.matchSegments(segs); p != "" {
+				hit = &rolePermissionMatch{
+					role:   item.role.Name,
+					origin: item.permissions.origins[p],
+					entry:  p,
+				}
+			}
+		}
+	}
+	return hit
+}
+
+// rolesAllow checks if permission is allowed by one of the roles and denied
+// by none of them.
+func rolesAllow(items []*roleTableItem, permission string) bool {
+	m := rolesMatch(items, permission)
+	return m != nil && !m.deny
+}
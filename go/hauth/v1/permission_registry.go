@@ -0,0 +1,126 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// PermissionRegistry holds the permissions declared by the services. A
+// RoleTable created with the registry validates the role permissions in
+// Strict mode, and lists the roles granting each registered permission.
+type PermissionRegistry struct {
+	// Strict rejects the roles granting or denying permissions which do
+	// not match a registered permission.
+	Strict bool
+
+	mu    sync.RWMutex
+	items map[string]*Permission
+}
+
+// PermissionGrant lists the roles granting a permission, directly or
+// inherited from their parents.
+type PermissionGrant struct {
+	Permission *Permission
+	Roles      []string
+}
+
+func NewPermissionRegistry(strict bool) *PermissionRegistry {
+	return &PermissionRegistry{
+		Strict: strict,
+		items:  map[string]*Permission{},
+	}
+}
+
+// PermissionSet adds or replaces the permissions, the names can not contain
+// wildcard segments.
+func (it *PermissionRegistry) PermissionSet(perms ...*Permission) error {
+
+	for _, p := range perms {
+		if p == nil || len(permissionSegments(p.Name)) == 0 {
+			return errors.New("permission name not set")
+		}
+		if strings.HasPrefix(p.Name, "!") || slices.ContainsFunc(permissionSegments(p.Name), func(s string) bool {
+			return strings.Contains(s, "*")
+		}) {
+			return errors.New("invalid permission name " + p.Name)
+		}
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	for _, p := range perms {
+		it.items[p.Name] = proto.Clone(p).(*Permission)
+	}
+
+	return nil
+}
+
+// PermissionGet returns a copy of the permission of name.
+func (it *PermissionRegistry) PermissionGet(name string) *Permission {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if p, ok := it.items[name]; ok {
+		return proto.Clone(p).(*Permission)
+	}
+	return nil
+}
+
+func (it *PermissionRegistry) PermissionDel(name string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	delete(it.items, name)
+}
+
+// PermissionList returns the copies of the permissions ordered by name.
+func (it *PermissionRegistry) PermissionList() []*Permission {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	ls := make([]*Permission, 0, len(it.items))
+	for _, p := range it.items {
+		ls = append(ls, proto.Clone(p).(*Permission))
+	}
+	slices.SortFunc(ls, func(a, b *Permission) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ls
+}
+
+// Valid checks if the role permission entry, which may be prefixed by "!"
+// and contain wildcard segments, matches a registered permission.
+func (it *PermissionRegistry) Valid(entry string) error {
+
+	set := NewPermissionSet(strings.TrimPrefix(entry, "!"))
+
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	if _, ok := it.items[strings.TrimPrefix(entry, "!")]; ok {
+		return nil
+	}
+	for name := range it.items {
+		if set.Match(name) {
+			return nil
+		}
+	}
+
+	return errors.New("permission " + entry + " not registered")
+}
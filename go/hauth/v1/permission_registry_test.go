@@ -0,0 +1,72 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_PermissionRegistry(t *testing.T) {
+
+	reg := NewPermissionRegistry(true)
+	if err := reg.PermissionSet(
+		&Permission{Name: "doc.file.get", Title: "Read files"},
+		&Permission{Name: "doc.file.put", Title: "Write files"},
+		&Permission{Name: "doc.secret.get"},
+	); err != nil {
+		t.Fatal("Failed on PermissionSet " + err.Error())
+	}
+	if err := reg.PermissionSet(&Permission{Name: "doc.*"}); err == nil {
+		t.Fatal("Failed on PermissionSet wildcard")
+	}
+	if p := reg.PermissionGet("doc.file.get"); p == nil || p.Title != "Read files" {
+		t.Fatal("Failed on PermissionGet")
+	}
+
+	table := NewRoleTable(reg)
+	if table.Registry() != reg {
+		t.Fatal("Failed on NewRoleTable Registry")
+	}
+
+	if err := table.RoleSet(&Role{Id: 1, Name: "viewer", Permissions: []string{"doc.*.get", "!doc.secret.**"}}); err != nil {
+		t.Fatal("Failed on RoleSet " + err.Error())
+	}
+	if err := table.RoleSet(&Role{Id: 2, Name: "editor", Parents: []uint32{1}, Permissions: []string{"doc.file.put"}}); err != nil {
+		t.Fatal("Failed on RoleSet " + err.Error())
+	}
+	if err := table.RoleSet(&Role{Id: 3, Name: "typo", Permissions: []string{"doc.flie.get"}}); err == nil {
+		t.Fatal("Failed on RoleSet strict")
+	}
+
+	ls := table.PermissionList()
+	if len(ls) != 3 {
+		t.Fatal("Failed on PermissionList")
+	}
+	for i, roles := range [][]string{
+		{"editor", "viewer"}, // doc.file.get
+		{"editor"},           // doc.file.put
+		{},                   // doc.secret.get, denied
+	} {
+		if !slices.Equal(ls[i].Roles, roles) {
+			t.Fatalf("Failed on PermissionList %s : %v", ls[i].Permission.Name, ls[i].Roles)
+		}
+	}
+
+	reg.Strict = false
+	if err := table.RoleSet(&Role{Id: 3, Name: "typo", Permissions: []string{"doc.flie.get"}}); err != nil {
+		t.Fatal("Failed on RoleSet not strict")
+	}
+}
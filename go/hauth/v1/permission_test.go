@@ -0,0 +1,82 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"testing"
+)
+
+func Test_PermissionTrie(t *testing.T) {
+
+	trie := newPermissionTrie()
+	for _, v := range []string{
+		"storage.bucket.get",
+		"compute/*/list",
+		"logging.**",
+		"iam.**.view",
+	} {
+		trie.add(v)
+	}
+
+	for name, hit := range map[string]bool{
+		"storage.bucket.get":      true,
+		"storage/bucket/get":      true,
+		"storage.bucket.put":      false,
+		"storage.bucket":          false,
+		"compute.instance.list":   true,
+		"compute.instance.x.list": false,
+		"logging":                 true,
+		"logging.entry.write":     true,
+		"iam.view":                true,
+		"iam.role.key.view":       true,
+		"iam.role.key.edit":       false,
+		"":                        false,
+	} {
+		if trie.match(name) != hit {
+			t.Fatalf("Failed on permissionTrie match %s", name)
+		}
+	}
+}
+
+func Test_RoleTable_Deny(t *testing.T) {
+
+	table := NewRoleTable()
+	table.RoleSet(&Role{Id: 100, Name: "storage-admin", Permissions: []string{"storage.**"}})
+	table.RoleSet(&Role{Id: 200, Name: "storage-operator", Parents: []uint32{100},
+		Permissions: []string{"!storage.bucket.delete"}})
+	table.RoleSet(&Role{Id: 300, Name: "auditor", Permissions: []string{"*.*.get"}})
+
+	if !table.Allow([]uint32{200}, "storage.bucket.create") ||
+		table.Allow([]uint32{200}, "storage.bucket.delete") ||
+		table.Allow([]uint32{100, 200}, "storage.bucket.delete") {
+		t.Fatal("Failed on RoleTable deny")
+	}
+	if !table.Allow([]uint32{300}, "compute.instance.get") ||
+		table.Allow([]uint32{300}, "compute.instance.delete") {
+		t.Fatal("Failed on RoleTable wildcard")
+	}
+}
+
+func Benchmark_RoleTable_Allow(b *testing.B) {
+	table := NewRoleTable()
+	table.RoleSet(&Role{Id: 100, Name: "admin", Permissions: []string{
+		"storage.bucket.get", "storage.bucket.list", "compute.*.get", "logging.**",
+	}})
+	roles := []uint32{100}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Allow(roles, "compute.instance.get")
+	}
+}
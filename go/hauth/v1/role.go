@@ -0,0 +1,331 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	RoleStatusNone     uint64 = 0
+	RoleStatusActive   uint64 = 1 << 1
+	RoleStatusDisabled uint64 = 1 << 2
+)
+
+// RoleTable is the role model shared by AccessKey.Roles (role names) and
+// UserPayload.Roles (role ids). A role inherits the permissions of its
+// parent roles, the inheritance graph must be acyclic.
+type RoleTable struct {
+	mu       sync.RWMutex
+	ids      map[uint32]*roleTableItem
+	names    map[string]*roleTableItem
+	registry *PermissionRegistry
+}
+
+type roleTableItem struct {
+	role        *Role
+	permissions *rolePermissions // including the inherited permissions
+}
+
+// NewRoleTable creates a RoleTable, optional args is the
+// *PermissionRegistry of the permissions.
+func NewRoleTable(args ...any) *RoleTable {
+	it := &RoleTable{
+		ids:   map[uint32]*roleTableItem{},
+		names: map[string]*roleTableItem{},
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *PermissionRegistry:
+			it.registry = arg.(*PermissionRegistry)
+		}
+	}
+	return it
+}
+
+// Registry returns the PermissionRegistry of the table, nil if not set.
+func (it *RoleTable) Registry() *PermissionRegistry {
+	return it.registry
+}
+
+// RoleSet adds or replaces the role of the same id (or of the same name if
+// Id is 0, such a role can not be a parent). Parents which are not set yet
+// are ignored until they are.
+func (it *RoleTable) RoleSet(r *Role) error {
+
+	if r == nil || r.Name == "" {
+		return errors.New("role name not set")
+	}
+
+	if it.registry != nil && it.registry.Strict {
+		for _, p := range r.Permissions {
+			if err := it.registry.Valid(p); err != nil {
+				return fmt.Errorf("role %s : %s", r.Name, err.Error())
+			}
+		}
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	prev := it.names[r.Name]
+	if prev != nil && prev.role.Id != r.Id && prev.role.Id != 0 {
+		return fmt.Errorf("role name %s already used by id %d", r.Name, prev.role.Id)
+	}
+
+	if r.Id != 0 {
+		for _, p := range r.Parents {
+			if it.parentOf(r.Id, p) {
+				return fmt.Errorf("role %s inherits itself via parent %d", r.Name, p)
+			}
+		}
+		if prev = it.ids[r.Id]; prev != nil && prev.role.Name != r.Name {
+			delete(it.names, prev.role.Name)
+		}
+	}
+
+	item := &roleTableItem{
+		role: proto.Clone(r).(*Role),
+	}
+	it.names[r.Name] = item
+	if r.Id != 0 {
+		it.ids[r.Id] = item
+	}
+
+	it.resolve()
+	return nil
+}
+
+// RoleGet returns a copy of the role of id.
+func (it *RoleTable) RoleGet(id uint32) *Role {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if item, ok := it.ids[id]; ok {
+		return proto.Clone(item.role).(*Role)
+	}
+	return nil
+}
+
+// RoleGetByName returns a copy of the role of name.
+func (it *RoleTable) RoleGetByName(name string) *Role {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if item, ok := it.names[name]; ok {
+		return proto.Clone(item.role).(*Role)
+	}
+	return nil
+}
+
+// RoleDel removes the role of name, a parent role can not be removed
+// before its children.
+func (it *RoleTable) RoleDel(name string) error {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	prev, ok := it.names[name]
+	if !ok {
+		return nil
+	}
+
+	if prev.role.Id != 0 {
+		for _, item := range it.names {
+			if slices.Contains(item.role.Parents, prev.role.Id) {
+				return fmt.Errorf("role %s is parent of %s", name, item.role.Name)
+			}
+		}
+		delete(it.ids, prev.role.Id)
+	}
+	delete(it.names, name)
+
+	it.resolve()
+	return nil
+}
+
+// RoleList returns the copies of the roles ordered by id and name.
+func (it *RoleTable) RoleList() []*Role {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	ls := make([]*Role, 0, len(it.names))
+	for _, item := range it.names {
+		ls = append(ls, proto.Clone(item.role).(*Role))
+	}
+	slices.SortFunc(ls, func(a, b *Role) int {
+		if a.Id != b.Id {
+			return cmp.Compare(a.Id, b.Id)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ls
+}
+
+// Allow checks if one of the roles (ids) grants permission and none of
+// them denies it. Permissions may contain "*" and "**" wildcard segments,
+// and are denied by the entries prefixed with "!".
+func (it *RoleTable) Allow(roles []uint32, permission string) bool {
+	it.mu.RLock()
+	items := make([]*roleTableItem, 0, len(roles))
+	for _, id := range roles {
+		if item, ok := it.ids[id]; ok {
+			items = append(items, item)
+		}
+	}
+	it.mu.RUnlock()
+	return rolesAllow(items, permission)
+}
+
+// AllowNames is Allow of the roles given by name.
+func (it *RoleTable) AllowNames(roles []string, permission string) bool {
+	return rolesAllow(it.items(roles), permission)
+}
+
+// PermissionList returns the registered permissions, or the permissions
+// named by the roles if the registry is not set, with the roles granting
+// them ordered by name.
+func (it *RoleTable) PermissionList() []*PermissionGrant {
+
+	var perms []*Permission
+	if it.registry != nil {
+		perms = it.registry.PermissionList()
+	}
+
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	if it.registry == nil {
+		seen := map[string]bool{}
+		for _, item := range it.names {
+			for _, p := range item.role.Permissions {
+				if !seen[p] && !strings.HasPrefix(p, "!") && !strings.Contains(p, "*") {
+					seen[p] = true
+					perms = append(perms, &Permission{Name: p})
+				}
+			}
+		}
+		slices.SortFunc(perms, func(a, b *Permission) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	}
+
+	ls := make([]*PermissionGrant, 0, len(perms))
+	for _, p := range perms {
+		grant := &PermissionGrant{
+			Permission: p,
+			Roles:      []string{},
+		}
+		for name, item := range it.names {
+			if rolesAllow([]*roleTableItem{item}, p.Name) {
+				grant.Roles = append(grant.Roles, name)
+			}
+		}
+		slices.Sort(grant.Roles)
+		ls = append(ls, grant)
+	}
+
+	return ls
+}
+
+func (it *RoleTable) items(names []string) []*roleTableItem {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	items := []*roleTableItem{}
+	for _, name := range names {
+		if item, ok := it.names[name]; ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parentOf returns true if id is role or one of its ancestors.
+func (it *RoleTable) parentOf(id, role uint32) bool {
+	var (
+		queue = []uint32{role}
+		seen  = map[uint32]bool{}
+	)
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if v == id {
+			return true
+		}
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		if item, ok := it.ids[v]; ok {
+			queue = append(queue, item.role.Parents...)
+		}
+	}
+	return false
+}
+
+// roleDisabled returns true if the role grants no permissions, neither to
+// the principals nor to its child roles. The deny entries of a disabled
+// role (and of its ancestors) still apply, so that disabling a role never
+// widens the access.
+func roleDisabled(r *Role) bool {
+	return r.Status&RoleStatusDisabled != 0
+}
+
+// resolve rebuilds the permissions of all roles, the items are replaced so
+// that the permissions held by the callers of items are never modified.
+func (it *RoleTable) resolve() {
+
+	var (
+		ids   = map[uint32]*roleTableItem{}
+		names = map[string]*roleTableItem{}
+	)
+
+	for name, prev := range it.names {
+		item := &roleTableItem{
+			role:        prev.role,
+			permissions: newRolePermissions(),
+		}
+		seen := map[uint32]bool{} // true if walked with the allowed entries
+		var walk func(r *Role, denyOnly bool)
+		walk = func(r *Role, denyOnly bool) {
+			denyOnly = denyOnly || roleDisabled(r)
+			for _, p := range r.Permissions {
+				if !denyOnly || strings.HasPrefix(p, "!") {
+					item.permissions.add(p, r.Name)
+				}
+			}
+			for _, id := range r.Parents {
+				if parent, ok := it.ids[id]; ok {
+					if done, ok := seen[id]; ok && (done || denyOnly) {
+						continue
+					}
+					seen[id] = !denyOnly
+					walk(parent.role, denyOnly)
+				}
+			}
+		}
+		walk(prev.role, false)
+		names[name] = item
+		if item.role.Id != 0 {
+			ids[item.role.Id] = item
+		}
+	}
+
+	it.ids, it.names = ids, names
+}
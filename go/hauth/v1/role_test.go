@@ -0,0 +1,174 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"testing"
+)
+
+func Test_RoleTable(t *testing.T) {
+
+	table := NewRoleTable()
+
+	for _, r := range []*Role{
+		{Id: 100, Name: "viewer", Permissions: []string{"read"}},
+		{Id: 200, Name: "editor", Permissions: []string{"write"}, Parents: []uint32{100}},
+		{Id: 1, Name: "sa", Parents: []uint32{200, 300}},
+	} {
+		if err := table.RoleSet(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !table.Allow([]uint32{1}, "read") || !table.AllowNames([]string{"sa"}, "write") ||
+		table.Allow([]uint32{100}, "write") {
+		t.Fatal("Failed on RoleTable inheritance")
+	}
+
+	if err := table.RoleSet(&Role{Id: 100, Name: "viewer", Parents: []uint32{1}}); err == nil {
+		t.Fatal("Failed on RoleTable cycle")
+	}
+	if err := table.RoleSet(&Role{Id: 300, Name: "viewer"}); err == nil {
+		t.Fatal("Failed on RoleTable name")
+	}
+
+	// a parent set later is inherited
+	table.RoleSet(&Role{Id: 300, Name: "ops", Permissions: []string{"deploy"}})
+	if !table.Allow([]uint32{1}, "deploy") {
+		t.Fatal("Failed on RoleTable late parent")
+	}
+}
+
+func Test_RoleTable_AccessKeyManager(t *testing.T) {
+
+	keyMgr := NewAccessKeyManager()
+	keyMgr.KeySet(&AccessKey{
+		Id:     "be2c1fcf532baaa9",
+		Secret: "c9a1a8ca13740018f1dd840a073ffc2e",
+		Roles:  []string{"editor"},
+	})
+	keyMgr.RoleSet(&Role{Id: 100, Name: "viewer", Permissions: []string{"read"}}).
+		RoleSet(&Role{Id: 200, Name: "editor", Parents: []uint32{100}})
+
+	token := NewAppCredential(keyMgr.KeyGet("be2c1fcf532baaa9")).SignToken(tAppData)
+	rs, err := AppValid(token, tAppData, keyMgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Allow("read"); err != nil {
+		t.Fatal("Failed on AppValidator.Allow " + err.Error())
+	}
+	if err = rs.Allow("write"); err == nil {
+		t.Fatal("Failed on AppValidator.Allow")
+	}
+
+	user := NewUserPayload("guest", "Guest", []uint32{200}, nil, 3600)
+	uv, err := UserValid(user.SignToken(keyMgr), keyMgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uv.Allow("read") != nil || uv.Allow("write") == nil {
+		t.Fatal("Failed on UserValidator.Allow")
+	}
+}
+
+func Test_AccessKeyManager_RoleLifecycle(t *testing.T) {
+
+	keyMgr := NewAccessKeyManager()
+	keyMgr.KeySet(&AccessKey{
+		Id:     "be2c1fcf532baaa9",
+		Secret: "c9a1a8ca13740018f1dd840a073ffc2e",
+		Roles:  []string{"editor"},
+	})
+
+	if err := keyMgr.RoleSetErr(&Role{Id: 100, Name: "viewer", Title: "Viewer",
+		Description: "Read only", Permissions: []string{"read", "list"}}); err != nil {
+		t.Fatal("Failed on RoleSetErr " + err.Error())
+	}
+	if err := keyMgr.RoleSetErr(&Role{Id: 200, Name: "editor", Parents: []uint32{100},
+		Permissions: []string{"write"}}); err != nil {
+		t.Fatal("Failed on RoleSetErr " + err.Error())
+	}
+
+	if err := keyMgr.RoleSetErr(&Role{Id: 100, Name: "viewer", Parents: []uint32{200}}); err == nil {
+		t.Fatal("Failed on RoleSetErr cycle")
+	}
+
+	// replace, the id is kept
+	if err := keyMgr.RoleSetErr(&Role{Name: "viewer", Title: "Reader", Permissions: []string{"read"}}); err != nil {
+		t.Fatal("Failed on RoleSetErr replace " + err.Error())
+	}
+	if r := keyMgr.RoleGet("viewer"); r == nil || r.Id != 100 || r.Title != "Reader" ||
+		r.Description != "" || len(r.Permissions) != 1 {
+		t.Fatal("Failed on RoleGet")
+	}
+
+	rs, err := AppValid(NewAppCredential(keyMgr.KeyGet("be2c1fcf532baaa9")).SignToken(tAppData), tAppData, keyMgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Allow("read") != nil || rs.Allow("list") == nil {
+		t.Fatal("Failed on AppValidator.Allow after replace")
+	}
+
+	// disabled roles grant nothing, also to their children
+	keyMgr.RoleSet(&Role{Id: 100, Name: "viewer", Permissions: []string{"read"}, Status: RoleStatusDisabled})
+	if rs.Allow("read") == nil || rs.Allow("write") != nil {
+		t.Fatal("Failed on AppValidator.Allow disabled parent")
+	}
+	keyMgr.RoleSet(&Role{Id: 200, Name: "editor", Permissions: []string{"write"}, Status: RoleStatusDisabled})
+	d := keyMgr.RoleTable().Authorize(&Request{Principal: rs.Principal(), Action: "write"})
+	if d.Allowed || d.Reasons[0] != "role editor disabled" {
+		t.Fatal("Failed on Authorize disabled " + d.String())
+	}
+
+	if ls := keyMgr.RoleList(); len(ls) != 2 || ls[0].Name != "viewer" || ls[1].Name != "editor" {
+		t.Fatal("Failed on RoleList")
+	}
+
+	// parents are removed after their children
+	keyMgr.RoleSet(&Role{Id: 200, Name: "editor", Parents: []uint32{100}})
+	if err := keyMgr.RoleDel("viewer"); err == nil {
+		t.Fatal("Failed on RoleDel parent")
+	}
+	if keyMgr.RoleDel("editor") != nil || keyMgr.RoleDel("viewer") != nil ||
+		len(keyMgr.RoleList()) != 0 {
+		t.Fatal("Failed on RoleDel")
+	}
+	if rs.Allow("write") == nil {
+		t.Fatal("Failed on AppValidator.Allow after RoleDel")
+	}
+}
+
+func Test_RoleTable_DisabledDeny(t *testing.T) {
+
+	table := NewRoleTable()
+	table.RoleSet(&Role{Id: 1, Name: "editor", Permissions: []string{"storage.**"}})
+	table.RoleSet(&Role{Id: 2, Name: "nodelete", Permissions: []string{"storage.get", "!storage.delete"}})
+	table.RoleSet(&Role{Id: 3, Name: "restricted", Parents: []uint32{2}})
+
+	for _, status := range []uint64{RoleStatusNone, RoleStatusDisabled} {
+		table.RoleSet(&Role{Id: 2, Name: "nodelete", Permissions: []string{"storage.get", "!storage.delete"}, Status: status})
+		if table.Allow([]uint32{1, 2}, "storage.delete") ||
+			table.Allow([]uint32{1, 3}, "storage.delete") {
+			t.Fatalf("Failed on Allow deny of role status %d", status)
+		}
+	}
+
+	// the allowed entries of the disabled role are dropped
+	if table.Allow([]uint32{2}, "storage.get") || table.Allow([]uint32{3}, "storage.get") {
+		t.Fatal("Failed on Allow disabled role")
+	}
+}
@@ -152,6 +152,31 @@ func (it *UserValidator) SignValid() error {
 	return errors.New("sign denied")
 }
 
+// Principal returns the principal of the user.
+func (it *UserValidator) Principal() *Principal {
+	return &Principal{
+		Id:     it.Id,
+		Type:   "User",
+		Roles:  it.Roles,
+		Groups: it.Groups,
+	}
+}
+
+// Allow checks if the roles of the user grant permission, the roles are
+// resolved by the RoleTable of the AccessKeyManager.
+func (it *UserValidator) Allow(permission string) error {
+	if it.keyMgr == nil {
+		return errors.New("no KeyManager found")
+	}
+	if permission == "" {
+		return errors.New("permission not set")
+	}
+	return it.keyMgr.RoleTable().Authorize(&Request{
+		Principal: it.Principal(),
+		Action:    permission,
+	}).Err()
+}
+
 func userSign(version, payload, secretKey string) string {
 	hs := sha256.Sum256([]byte(payload + secretKey))
 	return base64Url.EncodeToString(hs[:])
@@ -59,7 +59,7 @@ func Test_UserMain(t *testing.T) {
 	token := pl.SignToken(tKeyMgr)
 	t.Logf("SignToken keys %d, token %s", len(tKeyMgr.items), token)
 
-	rs, err := NewUserValidator(token)
+	rs, err := NewUserValidator(token, tKeyMgr)
 	if rs == nil || err != nil {
 		t.Fatal("Failed on UserValid")
 	}
@@ -67,17 +67,21 @@ func Test_UserMain(t *testing.T) {
 		t.Fatal("Failed on Token Decode")
 	}
 
-	if err := rs.SignValid(tKeyErrs); err == nil {
+	if err := rs.SignValid(); err != nil {
 		t.Fatal("Failed on UserValid")
 	}
 
-	if err := rs.SignValid(tKeyNull); err == nil {
+	if rs, _ := NewUserValidator(token, tKeyErrs); rs.SignValid() == nil {
+		t.Fatal("Failed on UserValid")
+	}
+
+	if rs, _ := NewUserValidator(token, tKeyNull); rs.SignValid() == nil {
 		t.Fatal("Failed on UserValid")
 	}
 
 	time.Sleep(2e9) // expired
 
-	if err := rs.SignValid(tKeyMgr); err == nil {
+	if err := rs.SignValid(); err == nil {
 		t.Fatal("Failed on UserValid")
 	}
 }
@@ -90,7 +94,7 @@ func Benchmark_UserPayload_SignToken(b *testing.B) {
 
 func Benchmark_UserValidator_SignValid(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		rs, _ := NewUserValidator(tToken)
-		rs.SignValid(tKeyMgr)
+		rs, _ := NewUserValidator(tToken, tKeyMgr)
+		rs.SignValid()
 	}
 }
@@ -44,6 +44,9 @@ type AccessTokenClaims struct {
 	Exp int64  `json:"exp"`
 	Sub string `json:"sub,omitempty"`
 
+	// Type of the identity (IdentityToken.Type), empty for User.
+	Type string `json:"type,omitempty"`
+
 	State string `json:"state,omitempty"`
 }
 
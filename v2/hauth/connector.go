@@ -16,6 +16,7 @@ package hauth
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,12 +24,40 @@ import (
 	hauth1 "github.com/hooto/hauth/go/hauth/v1"
 )
 
+const (
+	authTokenTtl          int64 = 60 // seconds
+	authTokenRenew        int64 = 15 // seconds
+	authRefreshRenewMin   int64 = 30 // seconds
+	authRefreshRetryDelay int64 = 10 // seconds
+)
+
+// AuthRefreshErrorHandler is called with the errors of the background
+// refresh of the access token, it can be given in the args of
+// NewAuthConnectorWithAccessKey.
+type AuthRefreshErrorHandler func(err error)
+
+// AuthOtpProvider returns the one-time password sent with each login of a
+// user who enrolled a second factor, it can be given in the args of
+// NewAuthConnectorWithAccessKey.
+type AuthOtpProvider func() (string, error)
+
+// NewAuthConnectorWithAccessKey creates a goroutine-safe AuthConnector.
+// Optional args are a Signer, an IdentityAuthService, an AuthTokenCache, an
+// AuthRefreshErrorHandler and an AuthOtpProvider. With an IdentityAuthService (see
+// NewIdentityAuthServiceHttpClient and NewIdentityAuthServiceGrpcClient)
+// User type keys log in on the first call of AccessToken, and the access
+// token is refreshed in the background before it expires, a valid token
+// found in the AuthTokenCache is reused instead of a new login. Close must
+// be called to stop the background refresh.
 func NewAuthConnectorWithAccessKey(
 	ak *hauth1.AccessKey,
 	args ...any,
 ) AuthConnector {
 	ac := &authConnector{
-		ak: ak,
+		ak:     ak,
+		jti:    uuid.NewString(),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
 	}
 	for _, arg := range args {
 		if arg == nil {
@@ -37,27 +66,53 @@ func NewAuthConnectorWithAccessKey(
 		switch arg.(type) {
 		case Signer:
 			ac.signer = arg.(Signer)
+		case IdentityAuthService:
+			ac.service = arg.(IdentityAuthService)
+		case AuthTokenCache:
+			ac.cache = arg.(AuthTokenCache)
+		case AuthRefreshErrorHandler:
+			ac.onError = arg.(AuthRefreshErrorHandler)
+		case func(error):
+			ac.onError = arg.(func(error))
+		case AuthOtpProvider:
+			ac.otp = arg.(AuthOtpProvider)
 		}
 	}
 	if ac.signer == nil {
 		ac.signer = DefaultSigner
 	}
+	if ac.ak.Type != "App" && ac.service != nil {
+		go ac.refresher()
+	}
 	return ac
 }
 
 type authConnector struct {
+	mu      sync.Mutex
+	loginMu sync.Mutex
+
 	ak *hauth1.AccessKey
 
 	jti string
 
-	signer Signer
+	signer  Signer
+	service IdentityAuthService
+	cache   AuthTokenCache
+	onError func(error)
+	otp     AuthOtpProvider
 
-	Header             TokenHeader
-	Claims             AuthClaims
-	loginSigningString string
-	loginSignString    string
+	token    string // cached token of App type keys
+	tokenExp int64
 
-	accessToken *AccessToken
+	accessToken   *AccessToken
+	refreshToken  string
+	identityToken *IdentityToken
+	retryAt       int64
+	rejected      string // access token rejected by the server
+
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func (it *authConnector) AccessKey() *hauth1.AccessKey {
@@ -65,14 +120,85 @@ func (it *authConnector) AccessKey() *hauth1.AccessKey {
 }
 
 func (it *authConnector) LoginToken() string {
-	return it.genToken()
+	return it.genToken(time.Now().Unix())
 }
 
 func (it *authConnector) AccessToken() string {
-	if it.ak.Type != "App" && it.accessToken != nil {
+
+	if it.ak.Type == "App" {
+		return it.appToken()
+	}
+
+	it.mu.Lock()
+	if it.accessToken != nil &&
+		(it.service == nil || !it.accessToken.IsExpired()) {
+		defer it.mu.Unlock()
+		return it.accessToken.raw
+	}
+	if it.service == nil {
+		defer it.mu.Unlock()
+		return it.genToken(time.Now().Unix())
+	}
+	if it.retryAt > time.Now().Unix() {
+		// the last login failed, do not hammer the service
+		defer it.mu.Unlock()
+		return ""
+	}
+	it.mu.Unlock()
+
+	if err := it.login(); err != nil {
+		it.mu.Lock()
+		it.retryAt = time.Now().Unix() + authRefreshRetryDelay
+		it.mu.Unlock()
+		if it.onError != nil {
+			it.onError(err)
+		}
+		return ""
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.accessToken != nil {
 		return it.accessToken.raw
 	}
-	return it.genToken()
+	return ""
+}
+
+// appToken returns the token of App type keys, it is reused until shortly
+// before it expires.
+func (it *authConnector) appToken() string {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	tn := time.Now().Unix()
+	if it.token == "" || it.tokenExp-authTokenRenew <= tn {
+		it.token = it.genToken(tn)
+		it.tokenExp = tn + authTokenTtl
+	}
+
+	return it.token
+}
+
+// IdentityToken returns the IdentityToken of the last login or refresh, or
+// nil if the connector has not logged in.
+func (it *authConnector) IdentityToken() *IdentityToken {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.identityToken
+}
+
+// ResetAccessToken drops the access token, e.g. after the server rejected
+// it, so that the next call of AccessToken logs in again.
+func (it *authConnector) ResetAccessToken() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.accessToken != nil {
+		it.rejected = it.accessToken.raw
+	}
+	it.accessToken = nil
+	it.refreshToken = ""
+	it.identityToken = nil
 }
 
 func (it *authConnector) RefreshAccessToken(accessToken string) error {
@@ -86,41 +212,285 @@ func (it *authConnector) RefreshAccessToken(accessToken string) error {
 		return errors.New("access-token expired")
 	}
 
+	it.mu.Lock()
 	it.accessToken = token
+	it.retryAt = 0
+	it.mu.Unlock()
+
+	it.notify()
 
 	return nil
 }
 
-func (it *authConnector) genToken() string {
+// Close stops the background refresh.
+func (it *authConnector) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.closed)
+	})
+	return nil
+}
 
-	if it.jti == "" {
-		it.jti = uuid.NewString()
+func (it *authConnector) notify() {
+	select {
+	case it.wake <- struct{}{}:
+	default:
 	}
+}
 
-	tn := time.Now().Unix()
+// refresher renews the access token of User type keys before it expires,
+// with the refresh token if the service issued one or else by a new login.
+func (it *authConnector) refresher() {
+
+	for {
+
+		delay := it.refreshDelay()
+
+		tr := time.NewTimer(delay)
+		select {
+		case <-it.closed:
+			tr.Stop()
+			return
+
+		case <-it.wake:
+			tr.Stop()
+			continue
+
+		case <-tr.C:
+		}
+
+		if err := it.refresh(); err != nil {
+			it.mu.Lock()
+			it.retryAt = time.Now().Unix() + authRefreshRetryDelay
+			it.mu.Unlock()
+			if it.onError != nil {
+				it.onError(err)
+			}
+		}
+	}
+}
+
+func (it *authConnector) refreshDelay() time.Duration {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.accessToken == nil {
+		return time.Hour
+	}
+
+	var (
+		tn    = time.Now().Unix()
+		claim = it.accessToken.Claims
+		at    = claim.Exp - max((claim.Exp-claim.Iat)/10, authRefreshRenewMin)
+	)
+
+	if it.retryAt > at {
+		at = it.retryAt
+	}
+
+	if at <= tn {
+		return 0
+	}
+	return time.Duration(at-tn) * time.Second
+}
+
+func (it *authConnector) login() error {
+
+	it.loginMu.Lock()
+	defer it.loginMu.Unlock()
+
+	it.mu.Lock()
+	ok := it.accessToken != nil && !it.accessToken.IsExpired()
+	it.mu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	if it.cache != nil {
+		// another process may have logged in while waiting for the lock
+		unlock, err := it.cache.Lock()
+		if err == nil {
+			defer unlock()
+		}
+		if it.loadCache() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	rs, err := it.authLogin()
+	if err == nil && rs.Error != "" {
+		err = errors.New(rs.Error)
+	}
+	if err != nil {
+		return err
+	}
+
+	return it.setLoginResponse(rs)
+}
+
+func (it *authConnector) refresh() error {
+
+	it.loginMu.Lock()
+	defer it.loginMu.Unlock()
+
+	it.mu.Lock()
+	refreshToken := it.refreshToken
+	it.mu.Unlock()
+
+	if it.cache != nil {
+		// another process sharing the cache may have rotated the refresh
+		// token already, rotating it again would revoke the session
+		unlock, err := it.cache.Lock()
+		if err == nil {
+			defer unlock()
+		}
+		if item, err := it.cache.Load(); err == nil && item != nil &&
+			item.RefreshToken != refreshToken && it.loadCache() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		rs  *AuthLoginResponse
+		err error
+	)
+
+	rsrv, ok := it.service.(IdentityAuthRefreshService)
+	if !ok {
+		refreshToken = ""
+	}
+
+	if refreshToken != "" {
+		rs, err = rsrv.AuthRefresh(&AuthRefreshRequest{
+			RefreshToken: refreshToken,
+		})
+		if err == nil && rs.Error != "" {
+			err = errors.New(rs.Error)
+		}
+	}
+
+	if refreshToken == "" || err != nil {
+		rs, err = it.authLogin()
+		if err == nil && rs.Error != "" {
+			err = errors.New(rs.Error)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return it.setLoginResponse(rs)
+}
+
+func (it *authConnector) authLogin() (*AuthLoginResponse, error) {
+	req := &AuthLoginRequest{
+		LoginToken: it.LoginToken(),
+	}
+	if it.otp != nil {
+		otp, err := it.otp()
+		if err != nil {
+			return nil, err
+		}
+		req.Otp = otp
+	}
+	return it.service.AuthLogin(req)
+}
+
+func (it *authConnector) setLoginResponse(rs *AuthLoginResponse) error {
+
+	token, err := NewAccessToken(rs.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	identityToken := rs.IdentityToken
+
+	it.mu.Lock()
+	it.accessToken = token
+	it.refreshToken = rs.RefreshToken
+	it.identityToken = &identityToken
+	it.retryAt = 0
+	it.mu.Unlock()
+
+	it.notify()
+
+	// the tokens are usable even if they are not cached
+	if it.cache != nil {
+		if err = it.cache.Store(&AuthTokenCacheItem{
+			KeyId:         it.ak.Id,
+			AccessToken:   rs.AccessToken,
+			RefreshToken:  rs.RefreshToken,
+			Exp:           token.Claims.Exp,
+			IdentityToken: &identityToken,
+		}); err != nil && it.onError != nil {
+			it.onError(err)
+		}
+	}
+
+	return nil
+}
+
+// loadCache reuses the cached tokens if they belong to the same key and
+// are not about to expire.
+func (it *authConnector) loadCache() bool {
+
+	item, err := it.cache.Load()
+	if err != nil || item == nil ||
+		item.KeyId != it.ak.Id ||
+		item.Exp-authTokenRenew <= time.Now().Unix() {
+		return false
+	}
+
+	token, err := NewAccessToken(item.AccessToken)
+	if err != nil {
+		return false
+	}
 
-	it.Header = TokenHeader{
+	it.mu.Lock()
+	if item.AccessToken == it.rejected {
+		it.mu.Unlock()
+		return false
+	}
+	it.accessToken = token
+	it.refreshToken = item.RefreshToken
+	it.identityToken = item.IdentityToken
+	it.retryAt = 0
+	it.mu.Unlock()
+
+	it.notify()
+
+	return true
+}
+
+func (it *authConnector) genToken(tn int64) string {
+
+	header := TokenHeader{
 		Alg: it.signer.Name(),
 		Kid: it.ak.Id,
 	}
 
-	it.Claims = AuthClaims{
+	claims := AuthClaims{
 		Iat: tn,
-		Exp: tn + 60,
+		Exp: tn + authTokenTtl,
 	}
 
 	if it.ak.Type == "App" {
-		it.Claims.Jti = it.jti
+		claims.Jti = it.jti
 	} else {
-		it.Claims.State = uuid.NewString()
+		claims.State = uuid.NewString()
 	}
 
-	it.loginSigningString = bytesEncode(jsonEncode(it.Header)) + "." +
-		bytesEncode(jsonEncode(it.Claims))
-
-	bs, _ := it.signer.Sign(it.loginSigningString, []byte(it.ak.Secret))
+	signingString := bytesEncode(jsonEncode(header)) + "." +
+		bytesEncode(jsonEncode(claims))
 
-	it.loginSignString = bytesEncode(bs)
+	bs, _ := it.signer.Sign(signingString, []byte(it.ak.Secret))
 
-	return it.loginSigningString + "." + it.loginSignString
+	return signingString + "." + bytesEncode(bs)
 }
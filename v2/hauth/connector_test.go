@@ -0,0 +1,361 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+type tIdentityAuthService struct {
+	keyMgr   *hauth1.AccessKeyManager
+	sessMgr  hauth2.SessionTokenManager
+	otpMgr   *hauth2.OTPManager
+	ttl      int64
+	logins   atomic.Int32
+	refreshs atomic.Int32
+}
+
+func newIdentityAuthService(ttl int64) *tIdentityAuthService {
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+	return &tIdentityAuthService{
+		keyMgr:  keyMgr,
+		sessMgr: hauth2.NewSessionTokenManager(keyMgr),
+		ttl:     ttl,
+	}
+}
+
+func (it *tIdentityAuthService) AuthLogin(req *hauth2.AuthLoginRequest) (*hauth2.AuthLoginResponse, error) {
+
+	token, err := hauth2.NewAccessToken(req.LoginToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ak, err := token.Verify(it.keyMgr)
+	if err != nil {
+		return nil, err
+	}
+
+	if it.otpMgr != nil && it.otpMgr.Required(ak.User) {
+		if err := it.otpMgr.Verify(ak.User, req.Otp); err != nil {
+			return nil, err
+		}
+	}
+
+	it.logins.Add(1)
+
+	tn := time.Now().Unix()
+	sess := hauth2.IdentityToken{
+		Jti: uuid.NewString(),
+		Sub: ak.User,
+		Iat: tn,
+		Exp: tn + it.ttl,
+	}
+
+	accessToken, err := it.sessMgr.ReSign("", sess)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := it.sessMgr.IssueRefreshToken(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hauth2.AuthLoginResponse{
+		AccessToken:   accessToken,
+		RefreshToken:  refreshToken,
+		IdentityToken: sess,
+	}, nil
+}
+
+func (it *tIdentityAuthService) AuthRefresh(req *hauth2.AuthRefreshRequest) (*hauth2.AuthLoginResponse, error) {
+	it.refreshs.Add(1)
+	return it.sessMgr.RotateRefreshToken(req.RefreshToken)
+}
+
+type tFailedAuthService struct {
+	calls atomic.Int32
+}
+
+func (it *tFailedAuthService) AuthLogin(req *hauth2.AuthLoginRequest) (*hauth2.AuthLoginResponse, error) {
+	it.calls.Add(1)
+	return nil, errors.New("service unavailable")
+}
+
+func (it *tFailedAuthService) AuthRefresh(req *hauth2.AuthRefreshRequest) (*hauth2.AuthLoginResponse, error) {
+	it.calls.Add(1)
+	return nil, errors.New("service unavailable")
+}
+
+func Test_AuthConnector_LoginRetry(t *testing.T) {
+
+	srv := &tFailedAuthService{}
+
+	var errs atomic.Int32
+	ac := hauth2.NewAuthConnectorWithAccessKey(hauth2.NewUserAccessKey(), srv,
+		hauth2.AuthRefreshErrorHandler(func(err error) {
+			errs.Add(1)
+		}))
+	defer ac.Close()
+
+	// a failed login is not retried before the retry delay
+	for i := 0; i < 3; i++ {
+		if ac.AccessToken() != "" {
+			t.Fatal("Failed on AccessToken")
+		}
+	}
+	if srv.calls.Load() != 1 || errs.Load() != 1 {
+		t.Fatalf("Failed on AccessToken retry, calls %d", srv.calls.Load())
+	}
+}
+
+func Test_AuthConnector_AppConcurrent(t *testing.T) {
+
+	ac := hauth2.NewAuthConnectorWithAccessKey(hauth2.NewAppAccessKey())
+	defer ac.Close()
+
+	token := ac.AccessToken()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if ac.AccessToken() != token {
+					t.Error("Failed on AccessToken cache")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_AuthConnector_BackgroundRefresh(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(31)
+		ak  = hauth2.NewUserAccessKey()
+	)
+	defer srv.sessMgr.Close()
+
+	ak.User = "guest"
+	srv.keyMgr.KeySet(ak)
+
+	var refreshErrs atomic.Int32
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak, srv,
+		hauth2.AuthRefreshErrorHandler(func(err error) {
+			refreshErrs.Add(1)
+		}))
+	defer ac.Close()
+
+	rs, err := srv.AuthLogin(&hauth2.AuthLoginRequest{
+		LoginToken: ac.LoginToken(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ac.RefreshAccessToken(rs.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// refreshed 30 seconds before it expires
+	time.Sleep(15e8)
+
+	if ac.AccessToken() == rs.AccessToken {
+		t.Fatal("Failed on background refresh")
+	}
+	if refreshErrs.Load() > 0 || srv.logins.Load() != 2 {
+		t.Fatal("Failed on background refresh")
+	}
+}
+
+// tLoginAuthService is an IdentityAuthService without AuthRefresh.
+type tLoginAuthService struct {
+	srv *tIdentityAuthService
+}
+
+func (it *tLoginAuthService) AuthLogin(req *hauth2.AuthLoginRequest) (*hauth2.AuthLoginResponse, error) {
+	return it.srv.AuthLogin(req)
+}
+
+func Test_AuthConnector_LoginOnlyService(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(31)
+		ak  = hauth2.NewUserAccessKey()
+	)
+	defer srv.sessMgr.Close()
+
+	ak.User = "guest"
+	srv.keyMgr.KeySet(ak)
+
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak, &tLoginAuthService{srv})
+	defer ac.Close()
+
+	token := ac.AccessToken()
+	if token == "" {
+		t.Fatal("Failed on AccessToken")
+	}
+
+	// renewed by a new login
+	time.Sleep(15e8)
+
+	if ac.AccessToken() == token || srv.logins.Load() != 2 || srv.refreshs.Load() != 0 {
+		t.Fatal("Failed on background login")
+	}
+}
+
+func Test_AuthConnector_HttpLogin(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(3600)
+		ak  = hauth2.NewUserAccessKey()
+	)
+	defer srv.sessMgr.Close()
+
+	ak.User = "guest"
+	srv.keyMgr.KeySet(ak)
+
+	authSrv := httptest.NewServer(hauth2.NewIdentityAuthServiceHttpHandler(srv))
+	defer authSrv.Close()
+
+	appSrv := httptest.NewServer(hauth2.NewHttpSessionHandler(srv.keyMgr, srv.sessMgr,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer appSrv.Close()
+
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak,
+		hauth2.NewIdentityAuthServiceHttpClient(authSrv.URL))
+	defer ac.Close()
+
+	hc := &http.Client{
+		Transport: hauth2.NewHttpAuthTransport(ac, nil),
+	}
+
+	resp, err := hc.Get(appSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || srv.logins.Load() != 1 {
+		t.Fatalf("Failed on lazy login, status %d", resp.StatusCode)
+	}
+
+	sess := ac.IdentityToken()
+	if sess == nil || sess.Sub != "guest" {
+		t.Fatal("Failed on IdentityToken")
+	}
+
+	// the session is ended by the server
+	srv.sessMgr.Revoke(sess.Jti)
+
+	if resp, err = hc.Get(appSrv.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || srv.logins.Load() != 2 {
+		t.Fatalf("Failed on re-login, status %d", resp.StatusCode)
+	}
+}
+
+type tNilAuthService struct{}
+
+func (it *tNilAuthService) AuthLogin(req *hauth2.AuthLoginRequest) (*hauth2.AuthLoginResponse, error) {
+	return nil, nil
+}
+
+func Test_IdentityAuthServiceHttpHandler(t *testing.T) {
+
+	srv := httptest.NewServer(hauth2.NewIdentityAuthServiceHttpHandler(&tNilAuthService{}))
+	defer srv.Close()
+
+	for body, status := range map[string]int{
+		"{":  http.StatusBadRequest,
+		"{}": http.StatusInternalServerError,
+	} {
+		resp, err := http.Post(srv.URL+"/auth-login", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("Failed on auth-login %s, status %d", body, resp.StatusCode)
+		}
+	}
+}
+
+func Test_AuthConnector_GrpcLogin(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(3600)
+		ak  = hauth2.NewUserAccessKey()
+		lis = bufconn.Listen(1 << 20)
+	)
+	defer srv.sessMgr.Close()
+
+	srv.keyMgr.KeySet(ak)
+
+	gs := grpc.NewServer()
+	hauth2.RegisterIdentityAuthServiceServer(gs, srv)
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak,
+		hauth2.NewIdentityAuthServiceGrpcClient(conn))
+	defer ac.Close()
+
+	accessToken := ac.AccessToken()
+	if accessToken == "" || ac.IdentityToken() == nil {
+		t.Fatal("Failed on gRPC login")
+	}
+
+	token, err := hauth2.NewAccessToken(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = token.Verify(srv.keyMgr); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -16,6 +16,9 @@ package hauth
 
 import (
 	"context"
+	"errors"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
 )
 
 const AuthContextKey = "hauth_ctx"
@@ -34,3 +37,54 @@ func AuthContextSession(ctx context.Context) *IdentityToken {
 
 	return token
 }
+
+// authSession verifies the access token and returns the live session it is
+// bound to. The token must be signed by the sign key of sessMgr and match the
+// subject and type of the session. The lookup records the activity of the
+// session, if it has been extended beyond the expiration of the access token
+// a renewed access token is returned as well.
+func authSession(
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+	token *AccessToken,
+) (*IdentityToken, string, error) {
+
+	signer, ok := sessMgr.(SessionTokenSigner)
+	if !ok || token.Header.Kid != signer.SignKeyId() {
+		return nil, "", errors.New("access-token not signed by the session key")
+	}
+
+	if _, err := token.Verify(keyMgr); err != nil {
+		return nil, "", err
+	}
+
+	sess := sessMgr.Token(token.Claims.Jti)
+	if sess == nil || sess.IsExpired() {
+		return nil, "", errors.New("session not found")
+	}
+
+	if token.Claims.Sub != sess.Sub ||
+		!identityTypeEqual(token.Claims.Type, sess.Type) {
+		return nil, "", errors.New("access-token does not match the session")
+	}
+
+	if sess.Exp > token.Claims.Exp {
+		renewed, err := sessMgr.ReSign(token.String(), *sess)
+		if err == nil && renewed != token.String() {
+			return sess, renewed, nil
+		}
+	}
+
+	return sess, "", nil
+}
+
+// identityTypeEqual compares the identity types, empty means User.
+func identityTypeEqual(a, b string) bool {
+	if a == "" {
+		a = "User"
+	}
+	if b == "" {
+		b = "User"
+	}
+	return a == b
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hooto/htoml4g/htoml"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+const (
+	credentialsFileEnv = "HAUTH_CREDENTIALS_FILE"
+	credentialsDirEnv  = "HAUTH_SECRETS_DIR"
+	credentialsProfile = "HAUTH_PROFILE"
+
+	credentialsSecretsDir = "/run/secrets/hauth"
+)
+
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// CredentialProfile is a named client credential, the credentials file
+// (default ~/.hauth/credentials) holds a list of them in TOML:
+//
+//	[[profiles]]
+//	name = "default"
+//	endpoint = "https://hauth.example.com/hauth/v2"
+//	access_key_id = "..."
+//	access_key_secret = "..."
+type CredentialProfile struct {
+	Name            string `json:"name" toml:"name"`
+	Endpoint        string `json:"endpoint,omitempty" toml:"endpoint,omitempty"`
+	AccessKeyId     string `json:"access_key_id" toml:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret" toml:"access_key_secret"`
+	AccessKeyType   string `json:"access_key_type,omitempty" toml:"access_key_type,omitempty"`
+	SignerAlg       string `json:"signer_alg,omitempty" toml:"signer_alg,omitempty"`
+}
+
+type CredentialsFile struct {
+	Profiles []*CredentialProfile `json:"profiles" toml:"profiles"`
+}
+
+type CredentialProvider interface {
+	// Credential returns ErrCredentialNotFound if the provider has no
+	// credential.
+	Credential() (*CredentialProfile, error)
+}
+
+func (it *CredentialProfile) AccessKey() *hauth1.AccessKey {
+	ak := &hauth1.AccessKey{
+		Id:     it.AccessKeyId,
+		Secret: it.AccessKeySecret,
+		Type:   it.AccessKeyType,
+	}
+	if ak.Type == "" {
+		ak.Type = "App"
+	}
+	return ak
+}
+
+// AuthConnector creates an AuthConnector of the credential, User type keys
+// log in through the HTTP endpoint if set. args are passed to
+// NewAuthConnectorWithAccessKey.
+func (it *CredentialProfile) AuthConnector(args ...any) (AuthConnector, error) {
+
+	ak := it.AccessKey()
+
+	if it.SignerAlg != "" {
+		signer := Signers.Signer(it.SignerAlg)
+		if signer.Name() != it.SignerAlg {
+			return nil, errors.New("signer " + it.SignerAlg + " not found")
+		}
+		args = append(args, signer)
+	}
+
+	if it.Endpoint != "" && ak.Type != "App" {
+		args = append(args, NewIdentityAuthServiceHttpClient(it.Endpoint))
+	}
+
+	return NewAuthConnectorWithAccessKey(ak, args...), nil
+}
+
+func (it *CredentialProfile) valid() error {
+	if it.AccessKeyId == "" || it.AccessKeySecret == "" {
+		return errors.New("credential " + it.Name + " : access_key_id or access_key_secret not set")
+	}
+	return nil
+}
+
+type staticCredentialProvider struct {
+	profile *CredentialProfile
+}
+
+func NewStaticCredentialProvider(profile *CredentialProfile) CredentialProvider {
+	return &staticCredentialProvider{
+		profile: profile,
+	}
+}
+
+func (it *staticCredentialProvider) Credential() (*CredentialProfile, error) {
+	if it.profile == nil {
+		return nil, ErrCredentialNotFound
+	}
+	return it.profile, it.profile.valid()
+}
+
+type envCredentialProvider struct{}
+
+// NewEnvCredentialProvider reads the credential from the environment
+// variables HAUTH_ACCESS_KEY_ID, HAUTH_ACCESS_KEY_SECRET and the optional
+// HAUTH_ACCESS_KEY_TYPE, HAUTH_ENDPOINT and HAUTH_SIGNER_ALG.
+func NewEnvCredentialProvider() CredentialProvider {
+	return &envCredentialProvider{}
+}
+
+func (it *envCredentialProvider) Credential() (*CredentialProfile, error) {
+	p := &CredentialProfile{
+		Name:            "env",
+		Endpoint:        os.Getenv("HAUTH_ENDPOINT"),
+		AccessKeyId:     os.Getenv("HAUTH_ACCESS_KEY_ID"),
+		AccessKeySecret: os.Getenv("HAUTH_ACCESS_KEY_SECRET"),
+		AccessKeyType:   os.Getenv("HAUTH_ACCESS_KEY_TYPE"),
+		SignerAlg:       os.Getenv("HAUTH_SIGNER_ALG"),
+	}
+	if p.AccessKeyId == "" && p.AccessKeySecret == "" {
+		return nil, ErrCredentialNotFound
+	}
+	return p, p.valid()
+}
+
+type fileCredentialProvider struct {
+	path    string
+	profile string
+}
+
+// NewFileCredentialProvider reads the profile from the credentials file.
+// The path defaults to $HAUTH_CREDENTIALS_FILE or ~/.hauth/credentials, the
+// profile to $HAUTH_PROFILE or "default".
+func NewFileCredentialProvider(path, profile string) CredentialProvider {
+	return &fileCredentialProvider{
+		path:    path,
+		profile: profile,
+	}
+}
+
+func (it *fileCredentialProvider) Credential() (*CredentialProfile, error) {
+
+	path := it.path
+	if path == "" {
+		if path = os.Getenv(credentialsFileEnv); path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, ErrCredentialNotFound
+			}
+			path = filepath.Join(home, ".hauth", "credentials")
+		}
+	}
+
+	profile := it.profile
+	if profile == "" {
+		if profile = os.Getenv(credentialsProfile); profile == "" {
+			profile = "default"
+		}
+	}
+
+	var cf CredentialsFile
+	if err := htoml.DecodeFromFile(path, &cf); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCredentialNotFound
+		}
+		return nil, err
+	}
+
+	for _, p := range cf.Profiles {
+		if p.Name == profile {
+			return p, p.valid()
+		}
+	}
+
+	return nil, ErrCredentialNotFound
+}
+
+type secretsDirCredentialProvider struct {
+	dir string
+}
+
+// NewSecretsDirCredentialProvider reads the credential from a mounted
+// secrets directory (default $HAUTH_SECRETS_DIR or /run/secrets/hauth),
+// with one file per field: access_key_id, access_key_secret, and the
+// optional access_key_type, endpoint and signer_alg.
+func NewSecretsDirCredentialProvider(dir string) CredentialProvider {
+	return &secretsDirCredentialProvider{
+		dir: dir,
+	}
+}
+
+func (it *secretsDirCredentialProvider) Credential() (*CredentialProfile, error) {
+
+	dir := it.dir
+	if dir == "" {
+		if dir = os.Getenv(credentialsDirEnv); dir == "" {
+			dir = credentialsSecretsDir
+		}
+	}
+
+	read := func(name string) string {
+		bs, _ := os.ReadFile(filepath.Join(dir, name))
+		return strings.TrimSpace(string(bs))
+	}
+
+	p := &CredentialProfile{
+		Name:            "secrets",
+		Endpoint:        read("endpoint"),
+		AccessKeyId:     read("access_key_id"),
+		AccessKeySecret: read("access_key_secret"),
+		AccessKeyType:   read("access_key_type"),
+		SignerAlg:       read("signer_alg"),
+	}
+	if p.AccessKeyId == "" && p.AccessKeySecret == "" {
+		return nil, ErrCredentialNotFound
+	}
+	return p, p.valid()
+}
+
+type credentialProviderChain struct {
+	providers []CredentialProvider
+}
+
+// NewCredentialProviderChain returns the credential of the first provider
+// which has one, a provider error other than ErrCredentialNotFound stops
+// the chain.
+func NewCredentialProviderChain(providers ...CredentialProvider) CredentialProvider {
+	return &credentialProviderChain{
+		providers: providers,
+	}
+}
+
+// NewDefaultCredentialProviderChain looks up the explicit credential (if
+// not nil), the environment variables, the credentials file and the
+// mounted secrets directory, in that order.
+func NewDefaultCredentialProviderChain(explicit *CredentialProfile) CredentialProvider {
+	providers := []CredentialProvider{}
+	if explicit != nil {
+		providers = append(providers, NewStaticCredentialProvider(explicit))
+	}
+	return NewCredentialProviderChain(append(providers,
+		NewEnvCredentialProvider(),
+		NewFileCredentialProvider("", ""),
+		NewSecretsDirCredentialProvider(""),
+	)...)
+}
+
+func (it *credentialProviderChain) Credential() (*CredentialProfile, error) {
+	for _, p := range it.providers {
+		cp, err := p.Credential()
+		if err == ErrCredentialNotFound {
+			continue
+		}
+		return cp, err
+	}
+	return nil, ErrCredentialNotFound
+}
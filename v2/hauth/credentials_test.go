@@ -0,0 +1,108 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+var tCredentialsFile = `
+[[profiles]]
+name = "default"
+access_key_id = "be2c1fcf532baaa9"
+access_key_secret = "c9a1a8ca13740018f1dd840a073ffc2e"
+
+[[profiles]]
+name = "dev"
+endpoint = "http://127.0.0.1:9530/hauth/v2"
+access_key_id = "d4d7d973aa8d3c70"
+access_key_secret = "ec1f6f37c8d81b7bdb855b651523367e"
+access_key_type = "User"
+signer_alg = "HS512"
+`
+
+func Test_CredentialProviderChain(t *testing.T) {
+
+	var (
+		dir        = t.TempDir()
+		file       = filepath.Join(dir, "credentials")
+		secretsDir = filepath.Join(dir, "secrets")
+	)
+
+	os.WriteFile(file, []byte(tCredentialsFile), 0600)
+	os.MkdirAll(secretsDir, 0700)
+	os.WriteFile(filepath.Join(secretsDir, "access_key_id"), []byte("secrets-id\n"), 0600)
+	os.WriteFile(filepath.Join(secretsDir, "access_key_secret"), []byte("secrets-secret\n"), 0600)
+
+	t.Setenv("HAUTH_ACCESS_KEY_ID", "")
+	t.Setenv("HAUTH_ACCESS_KEY_SECRET", "")
+	t.Setenv("HAUTH_CREDENTIALS_FILE", file)
+	t.Setenv("HAUTH_SECRETS_DIR", secretsDir)
+	t.Setenv("HAUTH_PROFILE", "dev")
+
+	chain := hauth2.NewDefaultCredentialProviderChain(nil)
+
+	// credentials file
+	cp, err := chain.Credential()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.AccessKeyId != "d4d7d973aa8d3c70" || cp.SignerAlg != "HS512" {
+		t.Fatalf("Failed on credentials file, profile %s", cp.Name)
+	}
+
+	ac, err := cp.AuthConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	if ak := ac.AccessKey(); ak.Type != "User" || ak.Secret != cp.AccessKeySecret {
+		t.Fatal("Failed on CredentialProfile.AuthConnector")
+	}
+
+	// environment variables over the credentials file
+	t.Setenv("HAUTH_ACCESS_KEY_ID", "env-id")
+	t.Setenv("HAUTH_ACCESS_KEY_SECRET", "env-secret")
+	if cp, err = chain.Credential(); err != nil || cp.AccessKeyId != "env-id" {
+		t.Fatal("Failed on environment variables")
+	}
+
+	// explicit value over all
+	cp, err = hauth2.NewDefaultCredentialProviderChain(&hauth2.CredentialProfile{
+		AccessKeyId:     "explicit-id",
+		AccessKeySecret: "explicit-secret",
+	}).Credential()
+	if err != nil || cp.AccessKeyId != "explicit-id" {
+		t.Fatal("Failed on explicit value")
+	}
+
+	// mounted secrets directory at last
+	t.Setenv("HAUTH_ACCESS_KEY_ID", "")
+	t.Setenv("HAUTH_ACCESS_KEY_SECRET", "")
+	t.Setenv("HAUTH_PROFILE", "none")
+	if cp, err = chain.Credential(); err != nil || cp.AccessKeyId != "secrets-id" {
+		t.Fatal("Failed on secrets directory")
+	}
+
+	// incomplete credential
+	t.Setenv("HAUTH_ACCESS_KEY_ID", "env-id")
+	if _, err = chain.Credential(); err == nil {
+		t.Fatal("Failed on incomplete credential")
+	}
+}
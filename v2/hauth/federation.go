@@ -0,0 +1,410 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	federatedLeeway       int64 = 60   // seconds
+	federatedJwksTtl      int64 = 3600 // seconds
+	federatedJwksRetryMin int64 = 60   // seconds
+)
+
+// FederatedIssuer configures an upstream identity provider whose JWTs are
+// accepted by the FederatedVerifier.
+type FederatedIssuer struct {
+	Issuer string `json:"issuer" toml:"issuer"`
+
+	// Alias namespaces the subjects and groups mapped by the default rules
+	// as <alias>:<value>, it defaults to Issuer without the URL scheme.
+	Alias string `json:"alias,omitempty" toml:"alias,omitempty"`
+
+	// Audiences accepted in the aud claim, at least one is required.
+	Audiences []string `json:"audiences" toml:"audiences"`
+
+	// Jwks is the locally configured key set, if not set the keys are
+	// fetched from JwksUri, or from the jwks_uri of the discovery document
+	// of Issuer.
+	Jwks    *JSONWebKeySet `json:"jwks,omitempty" toml:"jwks,omitempty"`
+	JwksUri string         `json:"jwks_uri,omitempty" toml:"jwks_uri,omitempty"`
+
+	// Leeway of the exp, nbf and iat checks in seconds (default 60).
+	Leeway int64 `json:"leeway,omitempty" toml:"leeway,omitempty"`
+
+	// Rules map the claims to the IdentityToken, the default rules map sub
+	// and groups prefixed by Alias, so the external groups never match the
+	// local ones.
+	Rules []*FederatedClaimRule `json:"rules,omitempty" toml:"rules,omitempty"`
+}
+
+// FederatedClaimRule maps the values of an external claim to a field of
+// IdentityToken.
+type FederatedClaimRule struct {
+	// Claim name, nested claims are addressed by dots (realm_access.roles).
+	Claim string `json:"claim" toml:"claim"`
+
+	// Target is one of sub, groups, roles or scopes.
+	Target string `json:"target" toml:"target"`
+
+	// Prefix is prepended to the mapped values, e.g. to namespace the
+	// external subjects.
+	Prefix string `json:"prefix,omitempty" toml:"prefix,omitempty"`
+
+	// Values maps the claim values, values which are not in a non-empty
+	// Values are dropped. Roles are mapped to role ids, scopes to name:value.
+	Values map[string]string `json:"values,omitempty" toml:"values,omitempty"`
+}
+
+func federatedDefaultRules(alias string) []*FederatedClaimRule {
+	return []*FederatedClaimRule{
+		{Claim: "sub", Target: "sub", Prefix: alias + ":"},
+		{Claim: "groups", Target: "groups", Prefix: alias + ":"},
+	}
+}
+
+// FederatedVerifier verifies the JWTs of the upstream identity providers
+// and maps them to IdentityToken.
+type FederatedVerifier struct {
+	client  *http.Client
+	issuers map[string]*federatedIssuer
+}
+
+type federatedIssuer struct {
+	mu      sync.Mutex
+	cfg     FederatedIssuer
+	jwks    *JSONWebKeySet
+	fetched int64
+	tried   int64
+}
+
+// NewFederatedVerifier creates a FederatedVerifier, args are the
+// *FederatedIssuer and an optional *http.Client to fetch the keys.
+func NewFederatedVerifier(args ...any) (*FederatedVerifier, error) {
+	it := &FederatedVerifier{
+		client:  http.DefaultClient,
+		issuers: map[string]*federatedIssuer{},
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *FederatedIssuer:
+			cfg := *arg.(*FederatedIssuer)
+			if cfg.Issuer == "" || len(cfg.Audiences) == 0 {
+				return nil, errors.New("issuer or audiences not set")
+			}
+			for _, rule := range cfg.Rules {
+				switch rule.Target {
+				case "sub", "groups", "roles", "scopes":
+				default:
+					return nil, errors.New("invalid rule target " + rule.Target)
+				}
+			}
+			if cfg.Leeway <= 0 {
+				cfg.Leeway = federatedLeeway
+			}
+			if cfg.Alias == "" {
+				cfg.Alias = cfg.Issuer
+				if i := strings.Index(cfg.Alias, "://"); i >= 0 {
+					cfg.Alias = cfg.Alias[i+3:]
+				}
+				cfg.Alias = strings.TrimRight(cfg.Alias, "/")
+			}
+			for _, fi := range it.issuers {
+				if fi.cfg.Alias == cfg.Alias {
+					return nil, errors.New("duplicate issuer alias " + cfg.Alias)
+				}
+			}
+			if len(cfg.Rules) == 0 {
+				cfg.Rules = federatedDefaultRules(cfg.Alias)
+			}
+			it.issuers[cfg.Issuer] = &federatedIssuer{
+				cfg:  cfg,
+				jwks: cfg.Jwks,
+			}
+
+		case *http.Client:
+			it.client = arg.(*http.Client)
+		}
+	}
+	return it, nil
+}
+
+// Verify checks the signature, issuer, audience and lifetime of token and
+// returns the mapped IdentityToken.
+func (it *FederatedVerifier) Verify(token string) (*IdentityToken, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid token")
+	}
+
+	var (
+		header TokenHeader
+		claims map[string]any
+	)
+	if bs, err := bytesDecode(parts[0]); err != nil || jsonDecode(bs, &header) != nil {
+		return nil, errors.New("invalid token header")
+	}
+	if bs, err := bytesDecode(parts[1]); err != nil || jsonDecode(bs, &claims) != nil {
+		return nil, errors.New("invalid token claims")
+	}
+	sign, err := bytesDecode(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	iss, _ := claims["iss"].(string)
+	fi := it.issuers[iss]
+	if fi == nil {
+		return nil, errors.New("issuer not trusted")
+	}
+
+	// only the asymmetric algorithms, a public key must never be used as
+	// a HMAC secret
+	if !strings.HasPrefix(header.Alg, "RS") && !strings.HasPrefix(header.Alg, "ES") {
+		return nil, errors.New("alg not allowed " + header.Alg)
+	}
+	verifier, ok := Signers.Signer(header.Alg).(SignVerifier)
+	if !ok {
+		return nil, errors.New("alg not supported " + header.Alg)
+	}
+
+	jwk, err := it.key(fi, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Alg != "" && jwk.Alg != header.Alg {
+		return nil, errors.New("alg mismatch")
+	}
+	pub, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.Verify(parts[0]+"."+parts[1], sign, pub); err != nil {
+		return nil, err
+	}
+
+	var (
+		tn       = time.Now().Unix()
+		exp, _   = claimInt64(claims["exp"])
+		iat, _   = claimInt64(claims["iat"])
+		nbf, nbs = claimInt64(claims["nbf"])
+	)
+	if exp+fi.cfg.Leeway <= tn {
+		return nil, errors.New("token expired")
+	}
+	if (nbs && nbf > tn+fi.cfg.Leeway) || iat > tn+fi.cfg.Leeway {
+		return nil, errors.New("token not yet valid")
+	}
+
+	if !slices.ContainsFunc(claimStrings(claims["aud"]), func(v string) bool {
+		return slices.Contains(fi.cfg.Audiences, v)
+	}) {
+		return nil, errors.New("audience not accepted")
+	}
+
+	idt := &IdentityToken{
+		Iat:  iat,
+		Exp:  exp,
+		Type: "User",
+	}
+	if jti, _ := claims["jti"].(string); jti != "" {
+		idt.Jti = jti
+	} else {
+		sum := sha256.Sum256([]byte(token))
+		idt.Jti = bytesEncode(sum[:16])
+	}
+
+	for _, rule := range fi.cfg.Rules {
+		if err := rule.apply(idt, claimValue(claims, rule.Claim)); err != nil {
+			return nil, err
+		}
+	}
+	if idt.Sub == "" {
+		return nil, errors.New("subject not mapped")
+	}
+
+	return idt, nil
+}
+
+// key returns the key of kid, the fetched key set is refreshed when it is
+// stale or the key is not found (e.g. after a key rotation of the issuer).
+func (it *FederatedVerifier) key(fi *federatedIssuer, kid string) (*JSONWebKey, error) {
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	var (
+		key *JSONWebKey
+		tn  = time.Now().Unix()
+	)
+	if fi.jwks != nil {
+		key = fi.jwks.Key(kid)
+	}
+
+	if fi.cfg.Jwks != nil || (key != nil && fi.fetched+federatedJwksTtl > tn) {
+		if key == nil {
+			return nil, errors.New("key not found")
+		}
+		return key, nil
+	}
+
+	if fi.tried+federatedJwksRetryMin <= tn {
+		fi.tried = tn
+		jwks, err := it.fetchJwks(&fi.cfg)
+		if err == nil {
+			fi.jwks, fi.fetched = jwks, tn
+			key = jwks.Key(kid)
+		} else if key == nil {
+			return nil, err
+		}
+	}
+
+	if key == nil {
+		return nil, errors.New("key not found")
+	}
+	return key, nil
+}
+
+func (it *FederatedVerifier) fetchJwks(cfg *FederatedIssuer) (*JSONWebKeySet, error) {
+
+	jwksUri := cfg.JwksUri
+	if jwksUri == "" {
+		var oc OpenIDConfiguration
+		if err := it.httpGetJson(strings.TrimRight(cfg.Issuer, "/")+oidcConfigurationPath, &oc); err != nil {
+			return nil, err
+		}
+		if oc.Issuer != cfg.Issuer {
+			return nil, errors.New("issuer mismatch in openid-configuration")
+		}
+		jwksUri = oc.JwksUri
+	}
+
+	var jwks JSONWebKeySet
+	if err := it.httpGetJson(jwksUri, &jwks); err != nil {
+		return nil, err
+	}
+	return &jwks, nil
+}
+
+func (it *FederatedVerifier) httpGetJson(uri string, o any) error {
+	resp, err := it.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch %s : status %d", uri, resp.StatusCode)
+	}
+	return jsonDecodeReader(resp.Body, o)
+}
+
+func (it *FederatedClaimRule) apply(idt *IdentityToken, claim any) error {
+
+	values := []string{}
+	for _, v := range claimStrings(claim) {
+		if len(it.Values) > 0 {
+			if v = it.Values[v]; v == "" {
+				continue
+			}
+		}
+		values = append(values, it.Prefix+v)
+	}
+
+	switch it.Target {
+
+	case "sub":
+		if len(values) > 0 {
+			idt.Sub = values[0]
+		}
+
+	case "groups":
+		for _, v := range values {
+			if !slices.Contains(idt.Groups, v) {
+				idt.Groups = append(idt.Groups, v)
+			}
+		}
+
+	case "roles":
+		for _, v := range values {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return errors.New("invalid role id " + v)
+			}
+			if !slices.Contains(idt.Roles, uint32(id)) {
+				idt.Roles = append(idt.Roles, uint32(id))
+			}
+		}
+
+	case "scopes":
+		for _, v := range values {
+			idt.Scopes = append(idt.Scopes, ParseScopeFilters(v)...)
+		}
+	}
+
+	return nil
+}
+
+// claimValue returns the claim of name, nested claims are addressed by dots.
+func claimValue(claims map[string]any, name string) any {
+	if v, ok := claims[name]; ok {
+		return v
+	}
+	var v any = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func claimStrings(v any) []string {
+	switch v.(type) {
+	case string:
+		if s := v.(string); s != "" {
+			return []string{s}
+		}
+
+	case float64:
+		return []string{strconv.FormatFloat(v.(float64), 'f', -1, 64)}
+
+	case []any:
+		ls := []string{}
+		for _, v2 := range v.([]any) {
+			ls = append(ls, claimStrings(v2)...)
+		}
+		return ls
+	}
+	return nil
+}
+
+func claimInt64(v any) (int64, bool) {
+	if f, ok := v.(float64); ok {
+		return int64(f), true
+	}
+	return 0, false
+}
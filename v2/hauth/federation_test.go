@@ -0,0 +1,153 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func tJwtSign(alg, kid string, claims map[string]any, key any) string {
+	var (
+		hs, _ = json.Marshal(hauth2.TokenHeader{Alg: alg, Typ: "JWT", Kid: kid})
+		cs, _ = json.Marshal(claims)
+		ss    = base64.RawURLEncoding.EncodeToString(hs) + "." +
+			base64.RawURLEncoding.EncodeToString(cs)
+		bs, _ = hauth2.Signers.Signer(alg).Sign(ss, key)
+	)
+	return ss + "." + base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func Test_FederatedVerifier(t *testing.T) {
+
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwk := &hauth2.JSONWebKey{
+		Kty: "EC",
+		Kid: "k1",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	}
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&hauth2.OpenIDConfiguration{
+			Issuer:  srv.URL,
+			JwksUri: srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&hauth2.JSONWebKeySet{Keys: []*hauth2.JSONWebKey{jwk}})
+	})
+
+	fv, err := hauth2.NewFederatedVerifier(&hauth2.FederatedIssuer{
+		Issuer:    srv.URL,
+		Audiences: []string{"hauth"},
+		Rules: []*hauth2.FederatedClaimRule{
+			{Claim: "sub", Target: "sub", Prefix: "idp:"},
+			{Claim: "groups", Target: "groups"},
+			{Claim: "realm_access.roles", Target: "roles", Values: map[string]string{"admin": "1"}},
+			{Claim: "tenant", Target: "scopes", Prefix: "tenant:"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tn := time.Now().Unix()
+	claims := map[string]any{
+		"iss":    srv.URL,
+		"sub":    "u1",
+		"aud":    []string{"other", "hauth"},
+		"iat":    tn,
+		"exp":    tn + 60,
+		"groups": []string{"staff"},
+		"tenant": "t1",
+		"realm_access": map[string]any{
+			"roles": []string{"admin", "viewer"},
+		},
+	}
+
+	idt, err := fv.Verify(tJwtSign("ES256", "k1", claims, privateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idt.Sub != "idp:u1" || !idt.Allow("staff") || len(idt.Roles) != 1 || idt.Roles[0] != 1 ||
+		hauth2.ScopeFiltersString(idt.Scopes) != "tenant:t1" {
+		t.Fatalf("Failed on FederatedVerifier claim rules %v", idt)
+	}
+
+	if _, err = fv.Verify(tJwtSign("ES256", "k2", claims, privateKey)); err == nil {
+		t.Fatal("Failed on FederatedVerifier unknown kid")
+	}
+
+	if _, err = fv.Verify(tJwtSign("HS256", "k1", claims, jwk.X)); err == nil {
+		t.Fatal("Failed on FederatedVerifier alg HS256")
+	}
+
+	// the default rules namespace the subject and groups by the issuer alias
+	fv2, err := hauth2.NewFederatedVerifier(&hauth2.FederatedIssuer{
+		Issuer:    srv.URL,
+		Audiences: []string{"hauth"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alias := strings.TrimPrefix(srv.URL, "http://")
+	claims["groups"] = []string{"staff", "admin"}
+	if idt, err = fv2.Verify(tJwtSign("ES256", "k1", claims, privateKey)); err != nil ||
+		idt.Sub != alias+":u1" || !idt.Allow(alias+":staff") {
+		t.Fatalf("Failed on FederatedVerifier default rules %v %v", idt, err)
+	}
+	if idt.Allow("admin") || idt.Allow("staff") {
+		t.Fatal("Failed on FederatedVerifier default rules, external group matches a local group")
+	}
+
+	if _, err = hauth2.NewFederatedVerifier(
+		&hauth2.FederatedIssuer{Issuer: srv.URL, Audiences: []string{"hauth"}, Alias: "idp"},
+		&hauth2.FederatedIssuer{Issuer: "https://idp.example.com", Audiences: []string{"hauth"}, Alias: "idp"},
+	); err == nil {
+		t.Fatal("Failed on FederatedVerifier duplicate alias")
+	}
+
+	claims["aud"] = "other"
+	if _, err = fv.Verify(tJwtSign("ES256", "k1", claims, privateKey)); err == nil {
+		t.Fatal("Failed on FederatedVerifier audience")
+	}
+
+	claims["aud"], claims["exp"] = "hauth", tn-120
+	if _, err = fv.Verify(tJwtSign("ES256", "k1", claims, privateKey)); err == nil {
+		t.Fatal("Failed on FederatedVerifier expired")
+	}
+
+	claims["exp"], claims["iss"] = tn+60, "https://idp.example.com"
+	if _, err = fv.Verify(tJwtSign("ES256", "k1", claims, privateKey)); err == nil {
+		t.Fatal("Failed on FederatedVerifier issuer")
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+// GroupEntry is a group of the GroupDirectory. The members of the
+// Subgroups are members of the group, and the Roles are granted to all
+// members.
+type GroupEntry struct {
+	Name      string   `json:"name"`
+	Title     string   `json:"title,omitempty"`
+	Members   []string `json:"members,omitempty"` // IdentityToken.Sub
+	Subgroups []string `json:"subgroups,omitempty"`
+	Roles     []uint32 `json:"roles,omitempty"`
+}
+
+// GroupDirectory stores the GroupEntry items, GroupGet returns nil if the
+// group is not found.
+type GroupDirectory interface {
+	GroupGet(name string) (*GroupEntry, error)
+	GroupSet(group *GroupEntry) error
+	GroupDel(name string) error
+	GroupList() ([]*GroupEntry, error)
+}
+
+// GroupDirectoryVersion is implemented by the directories which count their
+// changes, the GroupManager rebuilds its cache when the version changes,
+// e.g. after a change made through Directory or by another process.
+type GroupDirectoryVersion interface {
+	GroupVersion() (uint64, error)
+}
+
+// memoryGroupDirectory is the embedded GroupDirectory, all groups are kept
+// in memory and written to a JSON file on each change if path is set.
+type memoryGroupDirectory struct {
+	mu      sync.RWMutex
+	path    string
+	items   map[string]*GroupEntry
+	version uint64
+}
+
+func NewMemoryGroupDirectory() GroupDirectory {
+	return &memoryGroupDirectory{
+		items: map[string]*GroupEntry{},
+	}
+}
+
+func NewFileGroupDirectory(path string) (GroupDirectory, error) {
+
+	it := &memoryGroupDirectory{
+		path:  filepath.Clean(path),
+		items: map[string]*GroupEntry{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(it.path), 0700); err != nil {
+		return nil, err
+	}
+
+	bs, err := os.ReadFile(it.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		var groups []*GroupEntry
+		if err = jsonDecode(bs, &groups); err != nil {
+			return nil, err
+		}
+		for _, v := range groups {
+			it.items[v.Name] = v
+		}
+	}
+
+	return it, nil
+}
+
+func (it *memoryGroupDirectory) GroupGet(name string) (*GroupEntry, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if v, ok := it.items[name]; ok {
+		return v.clone(), nil
+	}
+	return nil, nil
+}
+
+func (it *memoryGroupDirectory) GroupSet(group *GroupEntry) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	prev, ok := it.items[group.Name]
+	it.items[group.Name] = group.clone()
+	if err := it.flush(); err != nil {
+		if ok {
+			it.items[group.Name] = prev
+		} else {
+			delete(it.items, group.Name)
+		}
+		return err
+	}
+	it.version += 1
+	return nil
+}
+
+func (it *memoryGroupDirectory) GroupDel(name string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	prev, ok := it.items[name]
+	if !ok {
+		return nil
+	}
+	delete(it.items, name)
+	if err := it.flush(); err != nil {
+		it.items[name] = prev
+		return err
+	}
+	it.version += 1
+	return nil
+}
+
+func (it *memoryGroupDirectory) GroupVersion() (uint64, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return it.version, nil
+}
+
+func (it *memoryGroupDirectory) GroupList() ([]*GroupEntry, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	ls := make([]*GroupEntry, 0, len(it.items))
+	for _, v := range it.items {
+		ls = append(ls, v.clone())
+	}
+	slices.SortFunc(ls, func(a, b *GroupEntry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ls, nil
+}
+
+func (it *memoryGroupDirectory) flush() error {
+	if it.path == "" {
+		return nil
+	}
+	ls := make([]*GroupEntry, 0, len(it.items))
+	for _, v := range it.items {
+		ls = append(ls, v)
+	}
+	return fileWriteAtomic(it.path, jsonEncode(ls))
+}
+
+func (it *GroupEntry) clone() *GroupEntry {
+	cp := *it
+	cp.Members = slices.Clone(it.Members)
+	cp.Subgroups = slices.Clone(it.Subgroups)
+	cp.Roles = slices.Clone(it.Roles)
+	return &cp
+}
+
+// GroupManager resolves the nested groups of a GroupDirectory. The
+// transitive closure of the groups is cached until the next change made by
+// the manager, or until the version of a GroupDirectoryVersion changes.
+// Invalidate drops the cache of the other directories after the changes
+// made through Directory or by other processes.
+//
+// The groups and roles of a session are resolved at check time by passing
+// the manager to IdentityToken.Allow or IdentityToken.Permit, so that the
+// membership changes take effect without a new login.
+type GroupManager struct {
+	mu  sync.RWMutex
+	dir GroupDirectory
+
+	closure *groupClosure
+}
+
+type groupClosure struct {
+	version uint64
+	groups  map[string]bool
+	members map[string][]string // sub: all groups of the member
+	roles   map[string][]uint32 // group: roles
+}
+
+// NewGroupManager creates a GroupManager, optional args is a GroupDirectory,
+// the default is in-memory.
+func NewGroupManager(args ...any) *GroupManager {
+	it := &GroupManager{}
+	for _, arg := range args {
+		switch arg.(type) {
+		case GroupDirectory:
+			it.dir = arg.(GroupDirectory)
+		}
+	}
+	if it.dir == nil {
+		it.dir = NewMemoryGroupDirectory()
+	}
+	return it
+}
+
+func (it *GroupManager) Directory() GroupDirectory {
+	return it.dir
+}
+
+// Invalidate drops the cached closure of the groups.
+func (it *GroupManager) Invalidate() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.closure = nil
+}
+
+// GroupSet adds or replaces the group, the subgroups must not contain the
+// group itself.
+func (it *GroupManager) GroupSet(group *GroupEntry) error {
+
+	if group == nil || group.Name == "" {
+		return errors.New("group name not set")
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	groups, err := it.dir.GroupList()
+	if err != nil {
+		return err
+	}
+
+	subgroups := map[string][]string{}
+	for _, g := range groups {
+		subgroups[g.Name] = g.Subgroups
+	}
+	subgroups[group.Name] = group.Subgroups
+
+	var (
+		queue = slices.Clone(group.Subgroups)
+		seen  = map[string]bool{}
+	)
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if v == group.Name {
+			return errors.New("group " + group.Name + " contains itself")
+		}
+		if !seen[v] {
+			seen[v] = true
+			queue = append(queue, subgroups[v]...)
+		}
+	}
+
+	it.closure = nil
+	return it.dir.GroupSet(group)
+}
+
+func (it *GroupManager) GroupGet(name string) (*GroupEntry, error) {
+	return it.dir.GroupGet(name)
+}
+
+func (it *GroupManager) GroupDel(name string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.closure = nil
+	return it.dir.GroupDel(name)
+}
+
+// MemberAdd adds the member sub to the group.
+func (it *GroupManager) MemberAdd(name, sub string) error {
+	return it.memberUpdate(name, func(g *GroupEntry) {
+		if !slices.Contains(g.Members, sub) {
+			g.Members = append(g.Members, sub)
+		}
+	})
+}
+
+// MemberDel removes the member sub from the group.
+func (it *GroupManager) MemberDel(name, sub string) error {
+	return it.memberUpdate(name, func(g *GroupEntry) {
+		if n := slices.Index(g.Members, sub); n >= 0 {
+			g.Members = slices.Delete(g.Members, n, n+1)
+		}
+	})
+}
+
+func (it *GroupManager) memberUpdate(name string, fn func(g *GroupEntry)) error {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	g, err := it.dir.GroupGet(name)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		return errors.New("group " + name + " not found")
+	}
+
+	fn(g)
+
+	it.closure = nil
+	return it.dir.GroupSet(g)
+}
+
+// MemberGroups returns the groups of the member sub, including the groups
+// containing them, ordered by name.
+func (it *GroupManager) MemberGroups(sub string) ([]string, error) {
+	c, err := it.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(c.members[sub]), nil
+}
+
+// Principal returns the principal of the token with the groups and roles
+// resolved by the directory. The token groups which are in the directory
+// are replaced by the current memberships of the token subject.
+func (it *GroupManager) Principal(token *IdentityToken) (*hauth1.Principal, error) {
+
+	c, err := it.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	p := token.Principal()
+	p.Roles = slices.Clone(p.Roles)
+
+	groups := slices.Clone(c.members[p.Id])
+	for _, g := range p.Groups {
+		if !c.groups[g] && !slices.Contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	p.Groups = groups
+
+	for _, g := range groups {
+		for _, id := range c.roles[g] {
+			if !slices.Contains(p.Roles, id) {
+				p.Roles = append(p.Roles, id)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// resolve returns the cached closure, or computes it from the directory.
+func (it *GroupManager) resolve() (*groupClosure, error) {
+
+	var version uint64
+	dv, versioned := it.dir.(GroupDirectoryVersion)
+	if versioned {
+		v, err := dv.GroupVersion()
+		if err != nil {
+			return nil, err
+		}
+		version = v
+	}
+
+	it.mu.RLock()
+	c := it.closure
+	it.mu.RUnlock()
+	if c != nil && c.version == version {
+		return c, nil
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.closure != nil && it.closure.version == version {
+		return it.closure, nil
+	}
+
+	groups, err := it.dir.GroupList()
+	if err != nil {
+		return nil, err
+	}
+
+	c = &groupClosure{
+		version: version,
+		groups:  map[string]bool{},
+		members: map[string][]string{},
+		roles:   map[string][]uint32{},
+	}
+
+	parents := map[string][]string{} // group: the groups containing it
+	for _, g := range groups {
+		c.groups[g.Name] = true
+		c.roles[g.Name] = g.Roles
+		for _, sg := range g.Subgroups {
+			parents[sg] = append(parents[sg], g.Name)
+		}
+	}
+
+	ancestors := map[string][]string{} // group: itself and its ancestors
+	for _, g := range groups {
+		var (
+			queue = []string{g.Name}
+			seen  = map[string]bool{}
+		)
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			if !seen[v] {
+				seen[v] = true
+				ancestors[g.Name] = append(ancestors[g.Name], v)
+				queue = append(queue, parents[v]...)
+			}
+		}
+	}
+
+	for _, g := range groups {
+		for _, sub := range g.Members {
+			for _, v := range ancestors[g.Name] {
+				if !slices.Contains(c.members[sub], v) {
+					c.members[sub] = append(c.members[sub], v)
+				}
+			}
+		}
+	}
+	for _, v := range c.members {
+		slices.Sort(v)
+	}
+
+	it.closure = c
+	return c, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+// tGroupDirectory hides the GroupVersion of the directory.
+type tGroupDirectory struct {
+	hauth2.GroupDirectory
+}
+
+func Test_GroupManager(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "groups.json")
+
+	dir, err := hauth2.NewFileGroupDirectory(path)
+	if err != nil {
+		t.Fatal("Failed on NewFileGroupDirectory " + err.Error())
+	}
+	mgr := hauth2.NewGroupManager(dir)
+
+	roles := hauth1.NewRoleTable()
+	roles.RoleSet(&hauth1.Role{Id: 500, Name: "eng-deployer", Permissions: []string{"app.deploy"}})
+
+	for _, g := range []*hauth2.GroupEntry{
+		{Name: "eng", Subgroups: []string{"backend", "frontend"}, Roles: []uint32{500}},
+		{Name: "backend", Members: []string{"alice"}},
+		{Name: "frontend", Members: []string{"bob"}},
+		{Name: "staff", Subgroups: []string{"eng"}},
+	} {
+		if err := mgr.GroupSet(g); err != nil {
+			t.Fatal("Failed on GroupSet " + err.Error())
+		}
+	}
+
+	if err := mgr.GroupSet(&hauth2.GroupEntry{Name: "backend", Subgroups: []string{"staff"}}); err == nil {
+		t.Fatal("Failed on GroupSet cycle")
+	}
+
+	if groups, err := mgr.MemberGroups("alice"); err != nil ||
+		!slices.Equal(groups, []string{"backend", "eng", "staff"}) {
+		t.Fatalf("Failed on MemberGroups %v", groups)
+	}
+
+	// the token groups are resolved at check time
+	token := tSessionToken("alice")
+	token.Groups = []string{"frontend", "external"}
+
+	if !token.Allow("staff", mgr) || !token.Allow("external", mgr) || token.Allow("frontend", mgr) {
+		t.Fatal("Failed on Allow GroupManager")
+	}
+	if token.Allow("staff") {
+		t.Fatal("Failed on Allow without GroupManager")
+	}
+	if err := token.Permit("app.deploy", mgr, roles); err != nil {
+		t.Fatal("Failed on Permit group roles " + err.Error())
+	}
+
+	if err := mgr.MemberDel("backend", "alice"); err != nil {
+		t.Fatal("Failed on MemberDel " + err.Error())
+	}
+	if token.Allow("staff", mgr) || token.Permit("app.deploy", mgr, roles) == nil {
+		t.Fatal("Failed on Allow after MemberDel")
+	}
+
+	if err := mgr.MemberAdd("frontend", "alice"); err != nil {
+		t.Fatal("Failed on MemberAdd " + err.Error())
+	}
+
+	// the changes made through the directory are seen by the manager
+	if err := mgr.Directory().GroupSet(&hauth2.GroupEntry{Name: "ops", Members: []string{"alice"}}); err != nil {
+		t.Fatal("Failed on Directory GroupSet " + err.Error())
+	}
+	if !token.Allow("ops", mgr) {
+		t.Fatal("Failed on Allow after Directory GroupSet")
+	}
+
+	// the directories without version are refreshed by Invalidate
+	mgr2 := hauth2.NewGroupManager(tGroupDirectory{dir})
+	if token.Allow("sre", mgr2) {
+		t.Fatal("Failed on Allow GroupManager")
+	}
+	dir.GroupSet(&hauth2.GroupEntry{Name: "sre", Members: []string{"alice"}})
+	if token.Allow("sre", mgr2) {
+		t.Fatal("Failed on Allow cached")
+	}
+	mgr2.Invalidate()
+	if !token.Allow("sre", mgr2) {
+		t.Fatal("Failed on Allow after Invalidate")
+	}
+
+	// file directory
+	if dir, err = hauth2.NewFileGroupDirectory(path); err != nil {
+		t.Fatal("Failed on NewFileGroupDirectory reload " + err.Error())
+	}
+	mgr = hauth2.NewGroupManager(dir)
+	if !token.Allow("eng", mgr) || !token.Allow("frontend", mgr) {
+		t.Fatal("Failed on Allow after reload")
+	}
+}
@@ -16,10 +16,37 @@ package hauth
 
 import (
 	"context"
+	"encoding/json"
+	"net"
+	"sync"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
 )
 
+// grpcJsonCodecName is the content-subtype of the gRPC services defined in
+// this package, the messages are plain Go structs encoded in JSON. The
+// clients force the codec per call, the servers register it (under this
+// name only) when a service of this package is registered.
+const grpcJsonCodecName = "hauth-json"
+
+var grpcJsonCodecOnce sync.Once
+
+func grpcJsonCodecRegister() {
+	grpcJsonCodecOnce.Do(func() {
+		if encoding.GetCodecV2(grpcJsonCodecName) == nil {
+			encoding.RegisterCodec(grpcJsonCodec{})
+		}
+	})
+}
+
 type grpcAppCredential struct {
 	ac AuthConnector
 }
@@ -41,3 +68,150 @@ func (s grpcAppCredential) GetRequestMetadata(
 func (s grpcAppCredential) RequireTransportSecurity() bool {
 	return false
 }
+
+// NewGrpcAuthUnaryClientInterceptor works along with the credentials of
+// NewGrpcAppCredential: a call rejected as unauthenticated is retried once
+// after a new login, and the access tokens renewed by the server are passed
+// to the AuthConnector.
+func NewGrpcAuthUnaryClientInterceptor(ac AuthConnector) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply any,
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+
+		var md metadata.MD
+		opts = append(opts, grpc.Header(&md))
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) == codes.Unauthenticated && ac.AccessKey().Type != "App" {
+			ac.ResetAccessToken()
+			md = nil
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		if v := md.Get(appHttpHeaderName); len(v) > 0 {
+			ac.RefreshAccessToken(v[0])
+		}
+
+		return err
+	}
+}
+
+// NewGrpcSessionUnaryInterceptor authenticates the calls by their access
+// token, which must be bound to a live session of sessMgr. The session is
+// put in the context (see AuthContextSession), and if it has been extended a
+// renewed access token is sent back in the response header.
+func NewGrpcSessionUnaryInterceptor(
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+
+		sess, renewed, err := grpcAuthSession(ctx, keyMgr, sessMgr)
+		if err != nil {
+			return nil, err
+		}
+
+		if renewed != "" {
+			grpc.SetHeader(ctx, metadata.Pairs(appHttpHeaderName, renewed))
+		}
+
+		return handler(context.WithValue(ctx, AuthContextKey, sess), req)
+	}
+}
+
+// NewGrpcSessionStreamInterceptor is the stream version of
+// NewGrpcSessionUnaryInterceptor.
+func NewGrpcSessionStreamInterceptor(
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+) grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+
+		sess, renewed, err := grpcAuthSession(ss.Context(), keyMgr, sessMgr)
+		if err != nil {
+			return err
+		}
+
+		if renewed != "" {
+			ss.SetHeader(metadata.Pairs(appHttpHeaderName, renewed))
+		}
+
+		return handler(srv, &grpcSessionServerStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ss.Context(), AuthContextKey, sess),
+		})
+	}
+}
+
+type grpcSessionServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcSessionServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcAuthSession(
+	ctx context.Context,
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+) (*IdentityToken, string, error) {
+
+	token, err := NewAccessTokenWithContext(ctx)
+	if err != nil {
+		return nil, "", status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	sess, renewed, err := authSession(keyMgr, sessMgr, token)
+	if err != nil {
+		return nil, "", status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return sess, renewed, nil
+}
+
+// NewSessionMetaWithContext describes the client of an incoming gRPC call.
+func NewSessionMetaWithContext(ctx context.Context) *SessionMeta {
+	meta := &SessionMeta{}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			meta.ClientIp = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("user-agent"); len(v) > 0 {
+			meta.UserAgent = v[0]
+		}
+	}
+	return meta
+}
+
+type grpcJsonCodec struct{}
+
+func (grpcJsonCodec) Name() string {
+	return grpcJsonCodecName
+}
+
+func (grpcJsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (grpcJsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
@@ -28,16 +28,37 @@ type AuthConnector interface {
 	LoginToken() string
 	AccessToken() string
 	RefreshAccessToken(at string) error
+	ResetAccessToken()
+	IdentityToken() *IdentityToken
+	Close() error
 }
 
 type IdentityAuthService interface {
 	AuthLogin(*AuthLoginRequest) (*AuthLoginResponse, error)
 }
 
+// IdentityAuthRefreshService is implemented by the IdentityAuthService
+// which issue refresh tokens.
+type IdentityAuthRefreshService interface {
+	AuthRefresh(*AuthRefreshRequest) (*AuthLoginResponse, error)
+}
+
 type SessionTokenManager interface {
-	RefreshToken(token IdentityToken)
-	ReSign(accessToken string, identityToken IdentityToken) (string, error)
+	RefreshToken(token IdentityToken, args ...any) error
+	ReSign(accessToken string, identityToken IdentityToken, args ...any) (string, error)
 	Token(id string) *IdentityToken
+	Sessions(sub string) []*SessionItem
+	Revoke(id string) error
+	IssueRefreshToken(identityToken IdentityToken, args ...any) (string, error)
+	RotateRefreshToken(refreshToken string) (*AuthLoginResponse, error)
+	Close() error
+}
+
+// SessionTokenSigner is implemented by the SessionTokenManager which signs
+// the access tokens with a dedicated key, only the access tokens signed by
+// this key are accepted as session tokens.
+type SessionTokenSigner interface {
+	SignKeyId() string
 }
 
 type AppValidator interface {
@@ -51,15 +72,27 @@ type TokenHeader struct {
 }
 
 type AuthLoginRequest struct {
-	LoginToken string `json:"login_token"`
+	LoginToken string `json:"login_token,omitempty"`
+
+	// Name and Password of a user of a UserDirectory, see UserManager.
+	Name     string `json:"name,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Otp is the second factor of the users who enrolled one, see OTPManager.
+	Otp string `json:"otp,omitempty"`
 }
 
 type AuthLoginResponse struct {
 	Error         string        `json:"error,omitempty"`
 	AccessToken   string        `json:"access_token"`
+	RefreshToken  string        `json:"refresh_token,omitempty"`
 	IdentityToken IdentityToken `json:"identity_token"`
 }
 
+type AuthRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type AuthClaims struct {
 	Jti   string `json:"jti,omitempty"` // JWT ID
 	Iat   int64  `json:"iat"`           // Issued At Time
@@ -0,0 +1,167 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+func NewAccessTokenWithHttpRequest(r *http.Request) (*AccessToken, error) {
+
+	if v := r.Header.Get(appHttpHeaderName); len(v) > 5 {
+		return NewAccessToken(v)
+	}
+
+	if v := r.Header.Get("Authorization"); len(v) > 7 &&
+		strings.EqualFold(v[:7], "Bearer ") {
+		return NewAccessToken(strings.TrimSpace(v[7:]))
+	}
+
+	return nil, errors.New("token not found")
+}
+
+// NewHttpSessionHandler is the HTTP version of NewGrpcSessionUnaryInterceptor,
+// the renewed access token is sent back in the x-hauth2 response header.
+func NewHttpSessionHandler(
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+	next http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		token, err := NewAccessTokenWithHttpRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sess, renewed, err := authSession(keyMgr, sessMgr, token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if renewed != "" {
+			w.Header().Set(appHttpHeaderName, renewed)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), AuthContextKey, sess)))
+	})
+}
+
+// NewSessionMetaWithHttpRequest describes the client of r, the address is
+// the one of the connection (proxy headers are not trusted).
+func NewSessionMetaWithHttpRequest(r *http.Request) *SessionMeta {
+	meta := &SessionMeta{
+		UserAgent: r.UserAgent(),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		meta.ClientIp = host
+	}
+	return meta
+}
+
+type httpAuthTransport struct {
+	ac   AuthConnector
+	base http.RoundTripper
+}
+
+// NewHttpAuthTransport sets the access token of ac on the requests. A
+// request rejected with 401 is retried once after a new login (if its body
+// can be replayed), and the access tokens renewed by the server are passed
+// to the AuthConnector.
+func NewHttpAuthTransport(ac AuthConnector, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &httpAuthTransport{
+		ac:   ac,
+		base: base,
+	}
+}
+
+func (it *httpAuthTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+
+	req := r.Clone(r.Context())
+	req.Header.Set(appHttpHeaderName, it.ac.AccessToken())
+
+	resp, err := it.base.RoundTrip(req)
+
+	if err == nil && resp.StatusCode == http.StatusUnauthorized &&
+		it.ac.AccessKey().Type != "App" &&
+		(r.Body == nil || r.Body == http.NoBody || r.GetBody != nil) {
+
+		req = r.Clone(r.Context())
+		if r.GetBody != nil {
+			if req.Body, err = r.GetBody(); err != nil {
+				return resp, nil
+			}
+		}
+		resp.Body.Close()
+
+		it.ac.ResetAccessToken()
+		req.Header.Set(appHttpHeaderName, it.ac.AccessToken())
+
+		resp, err = it.base.RoundTrip(req)
+	}
+
+	if err == nil {
+		if v := resp.Header.Get(appHttpHeaderName); v != "" {
+			it.ac.RefreshAccessToken(v)
+		}
+	}
+
+	return resp, err
+}
+
+// httpClientAccessKey authenticates the caller of an HTTP endpoint by its
+// AccessKey, either with HTTP Basic (id:secret) or with an access token
+// signed by the key.
+func httpClientAccessKey(r *http.Request, keyMgr *hauth1.AccessKeyManager) (*hauth1.AccessKey, error) {
+
+	if id, secret, ok := r.BasicAuth(); ok {
+		return accessKeyValid(keyMgr, id, secret)
+	}
+
+	token, err := NewAccessTokenWithHttpRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.Verify(keyMgr)
+}
+
+func accessKeyValid(keyMgr *hauth1.AccessKeyManager, id, secret string) (*hauth1.AccessKey, error) {
+	ak := keyMgr.KeyGet(id)
+	if ak == nil ||
+		subtle.ConstantTimeCompare([]byte(ak.Secret), []byte(secret)) != 1 {
+		return nil, errors.New("invalid access-key")
+	}
+	return ak, nil
+}
+
+func httpJsonReply(w http.ResponseWriter, status int, o any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(jsonEncode(o))
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	identityAuthServiceName        = "hooto.hauth.v2.IdentityAuthService"
+	identityAuthServiceLoginPath   = "/" + identityAuthServiceName + "/AuthLogin"
+	identityAuthServiceRefreshPath = "/" + identityAuthServiceName + "/AuthRefresh"
+
+	identityAuthHttpLoginPath   = "/auth-login"
+	identityAuthHttpRefreshPath = "/auth-refresh"
+
+	identityAuthServiceTimeout = 10 * time.Second
+)
+
+// NewIdentityAuthServiceHttpClient creates a client of the HTTP JSON
+// endpoints (endpoint + "/auth-login", endpoint + "/auth-refresh") served
+// by NewIdentityAuthServiceHttpHandler. Optional args is a *http.Client,
+// the default one times out after 10 seconds.
+func NewIdentityAuthServiceHttpClient(endpoint string, args ...any) IdentityAuthService {
+	c := &identityAuthServiceHttpClient{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		client: &http.Client{
+			Timeout: identityAuthServiceTimeout,
+		},
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *http.Client:
+			c.client = arg.(*http.Client)
+		}
+	}
+	return c
+}
+
+type identityAuthServiceHttpClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (it *identityAuthServiceHttpClient) AuthLogin(req *AuthLoginRequest) (*AuthLoginResponse, error) {
+	return it.call(identityAuthHttpLoginPath, req)
+}
+
+func (it *identityAuthServiceHttpClient) AuthRefresh(req *AuthRefreshRequest) (*AuthLoginResponse, error) {
+	return it.call(identityAuthHttpRefreshPath, req)
+}
+
+func (it *identityAuthServiceHttpClient) call(path string, req any) (*AuthLoginResponse, error) {
+
+	resp, err := it.client.Post(it.endpoint+path, "application/json",
+		bytes.NewReader(jsonEncode(req)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rs AuthLoginResponse
+	if err = jsonDecodeReader(resp.Body, &rs); err != nil {
+		return nil, fmt.Errorf("auth status %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if rs.Error == "" {
+			rs.Error = fmt.Sprintf("auth status %d", resp.StatusCode)
+		}
+		return nil, errors.New(rs.Error)
+	}
+
+	return &rs, nil
+}
+
+// NewIdentityAuthServiceGrpcClient creates a client of the gRPC service
+// registered by RegisterIdentityAuthServiceServer, each call times out after
+// 10 seconds.
+func NewIdentityAuthServiceGrpcClient(conn grpc.ClientConnInterface) IdentityAuthService {
+	return &identityAuthServiceGrpcClient{
+		conn: conn,
+	}
+}
+
+type identityAuthServiceGrpcClient struct {
+	conn grpc.ClientConnInterface
+}
+
+func (it *identityAuthServiceGrpcClient) AuthLogin(req *AuthLoginRequest) (*AuthLoginResponse, error) {
+	return it.invoke(identityAuthServiceLoginPath, req)
+}
+
+func (it *identityAuthServiceGrpcClient) AuthRefresh(req *AuthRefreshRequest) (*AuthLoginResponse, error) {
+	return it.invoke(identityAuthServiceRefreshPath, req)
+}
+
+func (it *identityAuthServiceGrpcClient) invoke(method string, req any) (*AuthLoginResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), identityAuthServiceTimeout)
+	defer cancel()
+	var rs AuthLoginResponse
+	err := it.conn.Invoke(ctx, method, req, &rs, grpc.ForceCodec(grpcJsonCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// NewIdentityAuthServiceHttpHandler serves srv on the paths "/auth-login"
+// and "/auth-refresh" (matched as suffix so the handler can be mounted on
+// any prefix), the latter if srv is an IdentityAuthRefreshService.
+func NewIdentityAuthServiceHttpHandler(srv IdentityAuthService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			rs  *AuthLoginResponse
+			err error
+		)
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, identityAuthHttpLoginPath):
+			var req AuthLoginRequest
+			if err = jsonDecodeReader(r.Body, &req); err != nil {
+				httpJsonReply(w, http.StatusBadRequest, &AuthLoginResponse{
+					Error: err.Error(),
+				})
+				return
+			}
+			rs, err = srv.AuthLogin(&req)
+
+		case strings.HasSuffix(r.URL.Path, identityAuthHttpRefreshPath):
+			rsrv, ok := srv.(IdentityAuthRefreshService)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			var req AuthRefreshRequest
+			if err = jsonDecodeReader(r.Body, &req); err != nil {
+				httpJsonReply(w, http.StatusBadRequest, &AuthLoginResponse{
+					Error: err.Error(),
+				})
+				return
+			}
+			rs, err = rsrv.AuthRefresh(&req)
+
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if err != nil {
+			httpJsonReply(w, http.StatusUnauthorized, &AuthLoginResponse{
+				Error: err.Error(),
+			})
+		} else if rs == nil {
+			httpJsonReply(w, http.StatusInternalServerError, &AuthLoginResponse{
+				Error: "auth service returned no response",
+			})
+		} else if rs.Error != "" {
+			httpJsonReply(w, http.StatusUnauthorized, rs)
+		} else {
+			httpJsonReply(w, http.StatusOK, rs)
+		}
+	})
+}
+
+func RegisterIdentityAuthServiceServer(s grpc.ServiceRegistrar, srv IdentityAuthService) {
+	grpcJsonCodecRegister()
+	s.RegisterService(&identityAuthServiceDesc, srv)
+}
+
+var identityAuthServiceDesc = grpc.ServiceDesc{
+	ServiceName: identityAuthServiceName,
+	HandlerType: (*IdentityAuthService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AuthLogin",
+			Handler:    identityAuthServiceLoginHandler,
+		},
+		{
+			MethodName: "AuthRefresh",
+			Handler:    identityAuthServiceRefreshHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func identityAuthServiceLoginHandler(
+	srv any,
+	ctx context.Context,
+	dec func(any) error,
+	interceptor grpc.UnaryServerInterceptor,
+) (any, error) {
+
+	in := new(AuthLoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return identityAuthServiceReply(srv.(IdentityAuthService).AuthLogin(req.(*AuthLoginRequest)))
+	}
+
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+
+	return interceptor(ctx, in, &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: identityAuthServiceLoginPath,
+	}, handler)
+}
+
+func identityAuthServiceRefreshHandler(
+	srv any,
+	ctx context.Context,
+	dec func(any) error,
+	interceptor grpc.UnaryServerInterceptor,
+) (any, error) {
+
+	in := new(AuthRefreshRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	rsrv, ok := srv.(IdentityAuthRefreshService)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "AuthRefresh not implemented")
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return identityAuthServiceReply(rsrv.AuthRefresh(req.(*AuthRefreshRequest)))
+	}
+
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+
+	return interceptor(ctx, in, &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: identityAuthServiceRefreshPath,
+	}, handler)
+}
+
+func identityAuthServiceReply(rs *AuthLoginResponse, err error) (any, error) {
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if rs.Error != "" {
+		return nil, status.Error(codes.Unauthenticated, rs.Error)
+	}
+	return rs, nil
+}
@@ -15,6 +15,7 @@
 package hauth
 
 import (
+	"errors"
 	"slices"
 	"time"
 
@@ -37,43 +38,140 @@ type IdentityToken struct {
 	Scopes []*hauth1.ScopeFilter `json:"scopes,omitempty"`
 }
 
+// RoleRegistry is the default RoleTable of IdentityToken.Permit. Sharing it
+// with the AccessKeyManager (hauth1.NewAccessKeyManager(RoleRegistry))
+// resolves the roles of keys and tokens the same way.
+var RoleRegistry = hauth1.NewRoleTable()
+
 func (it *IdentityToken) IsExpired() bool {
 	return it == nil || it.Exp <= time.Now().Unix()
 }
 
-func (it *IdentityToken) Allow(user string, args ...any) bool {
-	if it == nil || user == "" {
-		return false
+// Principal returns the principal of the token for the hauth1.Authorizer
+// requests.
+func (it *IdentityToken) Principal() *hauth1.Principal {
+	p := &hauth1.Principal{
+		Id:     it.Sub,
+		Type:   it.Type,
+		Roles:  it.Roles,
+		Groups: it.Groups,
+		Scopes: it.Scopes,
+	}
+	if p.Type == "" {
+		p.Type = "User"
+	}
+	return p
+}
+
+// OwnerAuthorizer allows the requests to the resources owned by the
+// principal, the Resource is the owner name: the id of the principal or one
+// of its groups. The App principals are also allowed by one of the Scopes.
+var OwnerAuthorizer hauth1.Authorizer = ownerAuthorizer{}
+
+type ownerAuthorizer struct{}
+
+func (ownerAuthorizer) Authorize(req *hauth1.Request) *hauth1.Decision {
+
+	p := req.Principal
+	if p == nil || req.Resource == "" {
+		return &hauth1.Decision{Reasons: []string{"principal or resource not found"}}
+	}
+
+	if req.Resource == p.Id {
+		return &hauth1.Decision{Allowed: true, Reasons: []string{"owner " + p.Id}}
+	}
+	if slices.Contains(p.Groups, req.Resource) {
+		return &hauth1.Decision{Allowed: true, Reasons: []string{"owner group " + req.Resource}}
+	}
+
+	if p.Type == "App" {
+		for _, scope := range req.Scopes {
+			if scope == nil {
+				continue
+			}
+			if v := scopeMatch(p.Scopes, scope); v != nil {
+				return &hauth1.Decision{
+					Allowed: true,
+					Scope:   v,
+					Reasons: []string{"scope " + v.Name + "=" + v.Value + " allows " + scope.Value},
+				}
+			}
+		}
 	}
 
+	return &hauth1.Decision{Reasons: []string{"owner=" + req.Resource + " not match"}}
+}
+
+// Allow checks if the token owns the resources of user, see OwnerAuthorizer.
+// The groups of the token are resolved by the *GroupManager given in args.
+func (it *IdentityToken) Allow(user string, args ...any) bool {
+
 	if it.IsExpired() {
 		return false
 	}
 
-	if user == it.Sub ||
-		slices.Contains(it.Groups, user) {
-
-		return true
+	req := &hauth1.Request{
+		Principal: it.Principal(),
+		Resource:  user,
 	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *hauth1.ScopeFilter:
+			req.Scopes = append(req.Scopes, arg.(*hauth1.ScopeFilter))
+		case *GroupManager:
+			p, err := arg.(*GroupManager).Principal(it)
+			if err != nil {
+				return false
+			}
+			req.Principal = p
+		}
+	}
+
+	return OwnerAuthorizer.Authorize(req).Allowed
+}
 
-	if it.Type == "App" {
+// Permit checks if the roles of the token grant permission, and if the
+// scopes of the token allow each *hauth1.ScopeFilter given in args (the
+// scope values are matched exactly). The roles are resolved by the
+// *hauth1.RoleTable given in args, or by RoleRegistry, including the roles
+// of the groups of the token if a *GroupManager is given. An empty
+// permission checks the scopes only.
+func (it *IdentityToken) Permit(permission string, args ...any) error {
 
-		if len(it.Scopes) > 0 && len(args) > 0 {
+	if it.IsExpired() {
+		return errors.New("token expired")
+	}
 
-			for _, arg := range args {
-				if arg == nil {
-					continue
-				}
-				switch arg.(type) {
-				case *hauth1.ScopeFilter:
-					scope := arg.(*hauth1.ScopeFilter)
-					if scopesAllow(it.Scopes, scope) {
-						return true
-					}
-				}
+	var (
+		table = RoleRegistry
+		req   = &hauth1.Request{
+			Principal: it.Principal(),
+			Action:    permission,
+		}
+	)
+	for _, arg := range args {
+		switch arg.(type) {
+		case *hauth1.ScopeFilter:
+			scope := arg.(*hauth1.ScopeFilter)
+			if scope == nil {
+				continue
+			}
+			if len(it.Scopes) == 0 {
+				return errors.New("token/scopes not found")
+			}
+			if scopeMatch(it.Scopes, scope) == nil {
+				return errors.New("token/scopes/" + scope.Name + "=" + scope.Value + " not match")
+			}
+		case *hauth1.RoleTable:
+			table = arg.(*hauth1.RoleTable)
+		case *GroupManager:
+			p, err := arg.(*GroupManager).Principal(it)
+			if err != nil {
+				return err
 			}
+			req.Principal = p
 		}
 	}
 
-	return false
+	return table.Authorize(req).Err()
 }
@@ -0,0 +1,126 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"testing"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_IdentityToken_Permit(t *testing.T) {
+
+	roles := hauth1.NewRoleTable()
+	roles.RoleSet(&hauth1.Role{Id: 100, Name: "viewer", Permissions: []string{"doc.read"}})
+	roles.RoleSet(&hauth1.Role{Id: 200, Name: "editor", Permissions: []string{"doc.write"}, Parents: []uint32{100}})
+
+	token := tSessionToken("guest")
+	token.Roles = []uint32{200}
+	token.Scopes = []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "z1")}
+
+	if err := token.Permit("doc.read", hauth2.NewScopeFilter("zone", "z1"), roles); err != nil {
+		t.Fatal("Failed on Permit " + err.Error())
+	}
+	if err := token.Permit("doc.delete", roles); err == nil {
+		t.Fatal("Failed on Permit permission")
+	}
+	if err := token.Permit("doc.read", hauth2.NewScopeFilter("zone", "z2"), roles); err == nil {
+		t.Fatal("Failed on Permit scope")
+	}
+
+	// the scope values of the tokens are not comma-separated lists
+	token.Scopes = []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "z1,z2")}
+	if err := token.Permit("doc.read", hauth2.NewScopeFilter("zone", "z2"), roles); err == nil {
+		t.Fatal("Failed on Permit scope exact value")
+	}
+	if err := token.Permit("doc.read", hauth2.NewScopeFilter("zone", "z1,z2"), roles); err != nil {
+		t.Fatal("Failed on Permit scope exact value " + err.Error())
+	}
+	app := tSessionToken("app-1")
+	app.Type, app.Scopes = "App", token.Scopes
+	if app.Allow("guest", hauth2.NewScopeFilter("zone", "z2")) ||
+		!app.Allow("guest", hauth2.NewScopeFilter("zone", "z1,z2")) {
+		t.Fatal("Failed on Allow scope exact value")
+	}
+	token.Scopes = []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "z1")}
+
+	// the keys share the role table of the tokens
+	table := hauth1.NewRoleTable()
+	table.RoleSet(&hauth1.Role{Id: 200, Name: "editor", Permissions: []string{"doc.delete"}})
+	keyMgr := hauth1.NewAccessKeyManager(table)
+	if keyMgr.RoleTable() != table {
+		t.Fatal("Failed on NewAccessKeyManager RoleTable")
+	}
+	if err := token.Permit("doc.delete", table); err != nil {
+		t.Fatal("Failed on Permit RoleTable " + err.Error())
+	}
+}
+
+func Test_Authorizer(t *testing.T) {
+
+	token := tSessionToken("alice")
+	token.Groups = []string{"eng"}
+
+	req := &hauth1.Request{
+		Principal: token.Principal(),
+		Action:    "viewer",
+		Resource:  "doc:1",
+	}
+
+	if d := hauth2.OwnerAuthorizer.Authorize(&hauth1.Request{
+		Principal: req.Principal,
+		Resource:  "eng",
+	}); !d.Allowed || d.String() != "owner group eng" {
+		t.Fatal("Failed on OwnerAuthorizer")
+	}
+
+	rels, _ := hauth2.NewRelationManager(nil)
+	rels.TupleWrite(&hauth2.RelationTuple{Object: "doc:1", Relation: "viewer", Subject: "group:eng#member"})
+
+	doc, _ := hauth2.ParsePolicyDocument([]byte(`{"statements": [
+		{"sid": "eng-docs", "effect": "allow", "actions": ["viewer"], "resources": ["doc:1"],
+		 "principals": ["group:eng"]}]}`))
+	policy, _ := hauth2.NewPolicyEngine(doc, hauth1.NewRoleTable())
+
+	for _, az := range []hauth1.Authorizer{rels, policy} {
+		if d := az.Authorize(req); !d.Allowed {
+			t.Fatal("Failed on Authorize " + d.String())
+		}
+	}
+	if d := policy.Authorize(req); d.Permission != "eng-docs" {
+		t.Fatal("Failed on Authorize statement " + d.Permission)
+	}
+
+	// the scopes of the request are checked by the policies
+	req.Scopes = []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "z1")}
+	if d := policy.Authorize(req); d.Allowed {
+		t.Fatal("Failed on Authorize scopes not found")
+	}
+	token.Scopes = []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "z1")}
+	req.Principal = token.Principal()
+	if d := policy.Authorize(req); !d.Allowed || d.Scope == nil || d.Scope.Value != "z1" {
+		t.Fatal("Failed on Authorize scopes " + d.String())
+	}
+	req.Scopes = nil
+
+	token.Groups = nil
+	req.Principal = token.Principal()
+	for _, az := range []hauth1.Authorizer{rels, policy, hauth1.NewRoleTable()} {
+		if d := az.Authorize(req); d.Allowed || len(d.Reasons) == 0 {
+			t.Fatal("Failed on Authorize deny")
+		}
+	}
+}
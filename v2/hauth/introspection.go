@@ -0,0 +1,256 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc7662
+
+const (
+	introspectionServiceName    = "hooto.hauth.v2.Introspection"
+	introspectionIntrospectPath = "/" + introspectionServiceName + "/Introspect"
+)
+
+type IntrospectionRequest struct {
+	Token         string `json:"token"`
+	TokenTypeHint string `json:"token_type_hint,omitempty"`
+}
+
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+
+	// extensions of hauth
+	Roles  []uint32 `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Type   string   `json:"type,omitempty"`
+}
+
+type IntrospectionService interface {
+	Introspect(ctx context.Context, req *IntrospectionRequest) (*IntrospectionResponse, error)
+}
+
+type TokenIntrospector struct {
+	keyMgr  *hauth1.AccessKeyManager
+	sessMgr SessionTokenManager
+}
+
+func NewTokenIntrospector(
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+) *TokenIntrospector {
+	return &TokenIntrospector{
+		keyMgr:  keyMgr,
+		sessMgr: sessMgr,
+	}
+}
+
+// Introspect implements IntrospectionService, the caller must present an
+// access token signed by one of the App keys of the AccessKeyManager.
+func (it *TokenIntrospector) Introspect(
+	ctx context.Context, req *IntrospectionRequest,
+) (*IntrospectionResponse, error) {
+
+	token, err := NewAccessTokenWithContext(ctx)
+	if err == nil {
+		var ak *hauth1.AccessKey
+		if ak, err = token.Verify(it.keyMgr); err == nil {
+			err = introspectionCallerValid(ak)
+		}
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return it.introspect(req.Token), nil
+}
+
+// ServeHTTP handles an introspection request (application/x-www-form-urlencoded)
+// of an App key caller authenticated by HTTP Basic or by an access token.
+func (it *TokenIntrospector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ak, err := httpClientAccessKey(r, it.keyMgr)
+	if err == nil {
+		err = introspectionCallerValid(ak)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hauth"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	httpJsonReply(w, http.StatusOK, it.introspect(r.PostForm.Get("token")))
+}
+
+// introspectionCallerValid allows the App keys (clients and resource servers)
+// to introspect the tokens, but not the User keys.
+func introspectionCallerValid(ak *hauth1.AccessKey) error {
+	if ak.Type != "App" {
+		return errors.New("introspection denied : App access-key required")
+	}
+	return nil
+}
+
+// introspect looks up the session of a session token without recording its
+// activity, the token must be signed by the sign key of sessMgr and match
+// the subject and type of the session.
+func (it *TokenIntrospector) introspect(accessToken string) *IntrospectionResponse {
+
+	inactive := &IntrospectionResponse{}
+
+	token, err := NewAccessToken(accessToken)
+	if err != nil {
+		return inactive
+	}
+
+	ak, err := token.Verify(it.keyMgr)
+	if err != nil {
+		return inactive
+	}
+
+	if signer, ok := it.sessMgr.(SessionTokenSigner); ok &&
+		token.Header.Kid == signer.SignKeyId() {
+		var sess *IdentityToken
+		if item := sessionPeek(it.sessMgr, token.Claims.Jti); item != nil {
+			sess = item.Token
+		}
+		if sess == nil || sess.IsExpired() ||
+			sess.Sub != token.Claims.Sub ||
+			!identityTypeEqual(sess.Type, token.Claims.Type) {
+			return inactive
+		}
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     ScopeFiltersString(sess.Scopes),
+			Username:  sess.Sub,
+			TokenType: "Bearer",
+			Exp:       min(sess.Exp, token.Claims.Exp),
+			Iat:       token.Claims.Iat,
+			Sub:       sess.Sub,
+			Jti:       sess.Jti,
+			Roles:     sess.Roles,
+			Groups:    sess.Groups,
+			Type:      sess.Type,
+		}
+	}
+
+	// tokens signed by the App type keys themselves are not bound to a session
+	if ak.Type == "App" {
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     ScopeFiltersString(ak.Scopes),
+			ClientId:  ak.Id,
+			Username:  ak.User,
+			TokenType: "Bearer",
+			Exp:       token.Claims.Exp,
+			Iat:       token.Claims.Iat,
+			Sub:       ak.User,
+			Jti:       token.Claims.Jti,
+			Type:      ak.Type,
+		}
+	}
+
+	return inactive
+}
+
+// IdentityToken converts an active response to the IdentityToken it
+// describes, or returns nil if the token is not active.
+func (it *IntrospectionResponse) IdentityToken() *IdentityToken {
+	if it == nil || !it.Active {
+		return nil
+	}
+	return &IdentityToken{
+		Jti:    it.Jti,
+		Sub:    it.Sub,
+		Iat:    it.Iat,
+		Exp:    it.Exp,
+		Roles:  it.Roles,
+		Groups: it.Groups,
+		Type:   it.Type,
+		Scopes: ParseScopeFilters(it.Scope),
+	}
+}
+
+func RegisterIntrospectionServer(s grpc.ServiceRegistrar, srv IntrospectionService) {
+	grpcJsonCodecRegister()
+	s.RegisterService(&introspectionServiceDesc, srv)
+}
+
+var introspectionServiceDesc = grpc.ServiceDesc{
+	ServiceName: introspectionServiceName,
+	HandlerType: (*IntrospectionService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Introspect",
+			Handler:    introspectionIntrospectHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func introspectionIntrospectHandler(
+	srv any,
+	ctx context.Context,
+	dec func(any) error,
+	interceptor grpc.UnaryServerInterceptor,
+) (any, error) {
+
+	in := new(IntrospectionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(IntrospectionService).Introspect(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: introspectionIntrospectPath,
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(IntrospectionService).Introspect(ctx, req.(*IntrospectionRequest))
+	}
+
+	return interceptor(ctx, in, info, handler)
+}
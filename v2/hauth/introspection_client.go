@@ -0,0 +1,216 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+const (
+	introspectionCacheTtl = 60 * time.Second
+	introspectionCacheMax = 10000
+)
+
+// IntrospectionClient queries an introspection endpoint for resource
+// servers, responses are cached until the token expires or the cache ttl
+// (default 60 seconds) elapses, whichever comes first.
+type IntrospectionClient struct {
+	mu         sync.RWMutex
+	introspect func(context.Context, *IntrospectionRequest) (*IntrospectionResponse, error)
+	cacheTtl   int64
+	items      map[string]*introspectionCacheItem
+}
+
+type introspectionCacheItem struct {
+	rs  *IntrospectionResponse
+	exp int64
+}
+
+// NewIntrospectionHttpClient creates a client of the HTTP endpoint, the
+// caller authenticates with the AccessKey by HTTP Basic. Optional args are
+// a *http.Client and the cache ttl (time.Duration).
+func NewIntrospectionHttpClient(
+	endpoint string,
+	ak *hauth1.AccessKey,
+	args ...any,
+) *IntrospectionClient {
+
+	hc := http.DefaultClient
+	for _, arg := range args {
+		switch arg.(type) {
+		case *http.Client:
+			hc = arg.(*http.Client)
+		}
+	}
+
+	c := newIntrospectionClient(args...)
+
+	c.introspect = func(ctx context.Context, req *IntrospectionRequest) (*IntrospectionResponse, error) {
+
+		form := url.Values{}
+		form.Set("token", req.Token)
+		if req.TokenTypeHint != "" {
+			form.Set("token_type_hint", req.TokenTypeHint)
+		}
+
+		hr, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		hr.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		hr.Header.Set("Accept", "application/json")
+		hr.SetBasicAuth(ak.Id, ak.Secret)
+
+		resp, err := hc.Do(hr)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("introspection status %d", resp.StatusCode)
+		}
+
+		var rs IntrospectionResponse
+		if err = jsonDecodeReader(resp.Body, &rs); err != nil {
+			return nil, err
+		}
+		return &rs, nil
+	}
+
+	return c
+}
+
+// NewIntrospectionGrpcClient creates a client of the gRPC service, the
+// caller authenticates with the per-RPC credentials of conn (see
+// NewGrpcAppCredential). Optional args is the cache ttl (time.Duration).
+func NewIntrospectionGrpcClient(
+	conn grpc.ClientConnInterface,
+	args ...any,
+) *IntrospectionClient {
+
+	c := newIntrospectionClient(args...)
+
+	c.introspect = func(ctx context.Context, req *IntrospectionRequest) (*IntrospectionResponse, error) {
+		var rs IntrospectionResponse
+		err := conn.Invoke(ctx, introspectionIntrospectPath, req, &rs, grpc.ForceCodec(grpcJsonCodec{}))
+		if err != nil {
+			return nil, err
+		}
+		return &rs, nil
+	}
+
+	return c
+}
+
+func newIntrospectionClient(args ...any) *IntrospectionClient {
+	c := &IntrospectionClient{
+		cacheTtl: int64(introspectionCacheTtl / time.Second),
+		items:    map[string]*introspectionCacheItem{},
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case time.Duration:
+			c.cacheTtl = int64(arg.(time.Duration) / time.Second)
+		}
+	}
+	return c
+}
+
+func (it *IntrospectionClient) Introspect(ctx context.Context, token string) (*IntrospectionResponse, error) {
+
+	if token == "" {
+		return nil, errors.New("token not found")
+	}
+
+	var (
+		hs  = sha256.Sum256([]byte(token))
+		key = string(hs[:])
+		tn  = time.Now().Unix()
+	)
+
+	it.mu.RLock()
+	item, ok := it.items[key]
+	it.mu.RUnlock()
+
+	if ok && item.exp > tn {
+		return item.rs, nil
+	}
+
+	rs, err := it.introspect(ctx, &IntrospectionRequest{
+		Token: token,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if it.cacheTtl > 0 {
+
+		exp := tn + it.cacheTtl
+		if rs.Active && rs.Exp > 0 && rs.Exp < exp {
+			exp = rs.Exp
+		}
+
+		it.mu.Lock()
+		if len(it.items) >= introspectionCacheMax {
+			it.sweep(tn)
+		}
+		it.items[key] = &introspectionCacheItem{
+			rs:  rs,
+			exp: exp,
+		}
+		it.mu.Unlock()
+	}
+
+	return rs, nil
+}
+
+// sweep drops the expired items, and if the cache is still full, the tenth
+// of the items which expire first.
+func (it *IntrospectionClient) sweep(tn int64) {
+	for k, v := range it.items {
+		if v.exp <= tn {
+			delete(it.items, k)
+		}
+	}
+	if len(it.items) < introspectionCacheMax {
+		return
+	}
+	keys := make([]string, 0, len(it.items))
+	for k := range it.items {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Compare(it.items[a].exp, it.items[b].exp)
+	})
+	for _, k := range keys[:len(keys)-introspectionCacheMax*9/10] {
+		delete(it.items, k)
+	}
+}
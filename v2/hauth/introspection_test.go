@@ -0,0 +1,230 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_TokenIntrospector_Http(t *testing.T) {
+
+	var (
+		keyMgr    = hauth1.NewAccessKeyManager()
+		serverKey = hauth2.NewUserAccessKey()
+		clientKey = hauth2.NewAppAccessKey()
+	)
+	keyMgr.KeySet(serverKey)
+	keyMgr.KeySet(clientKey)
+
+	var (
+		sessMgr = hauth2.NewSessionTokenManager(keyMgr)
+		tn      = time.Now().Unix()
+		token   = hauth2.IdentityToken{
+			Jti:    uuid.NewString(),
+			Sub:    "guest",
+			Iat:    tn,
+			Exp:    tn + 3600,
+			Roles:  []uint32{100},
+			Groups: []string{"staff"},
+			Scopes: []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "z1")},
+		}
+	)
+
+	defer sessMgr.Close()
+
+	accessToken, err := sessMgr.ReSign("", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(hauth2.NewTokenIntrospector(keyMgr, sessMgr))
+	defer srv.Close()
+
+	c := hauth2.NewIntrospectionHttpClient(srv.URL, clientKey)
+
+	rs, err := c.Introspect(context.Background(), accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Active || rs.Sub != "guest" || rs.Scope != "zone:z1" ||
+		len(rs.Roles) != 1 || len(rs.Groups) != 1 {
+		t.Fatalf("Failed on Introspect %v", rs)
+	}
+
+	if it := rs.IdentityToken(); it == nil || !it.Allow("staff") {
+		t.Fatal("Failed on IntrospectionResponse.IdentityToken")
+	}
+
+	if rs, err = c.Introspect(context.Background(), accessToken+"x"); err != nil {
+		t.Fatal(err)
+	} else if rs.Active {
+		t.Fatal("Failed on Introspect (invalid token)")
+	}
+
+	// a token of the session signed by another key of keyMgr
+	forged, err := hauth2.Sign(hauth2.TokenHeader{Kid: serverKey.Id}, hauth2.AccessTokenClaims{
+		Jti: token.Jti,
+		Sub: token.Sub,
+		Iat: token.Iat,
+		Exp: token.Exp,
+	}, []byte(serverKey.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs, err = c.Introspect(context.Background(), forged); err != nil {
+		t.Fatal(err)
+	} else if rs.Active {
+		t.Fatal("Failed on Introspect (forged token)")
+	}
+
+	// unknown caller
+	c = hauth2.NewIntrospectionHttpClient(srv.URL, hauth2.NewAppAccessKey())
+	if _, err = c.Introspect(context.Background(), accessToken); err == nil {
+		t.Fatal("Failed on Introspect (unauthenticated)")
+	}
+
+	// User key caller
+	c = hauth2.NewIntrospectionHttpClient(srv.URL, serverKey)
+	if _, err = c.Introspect(context.Background(), accessToken); err == nil {
+		t.Fatal("Failed on Introspect (User key caller)")
+	}
+}
+
+func Test_TokenIntrospector_NoTouch(t *testing.T) {
+
+	var (
+		keyMgr    = hauth1.NewAccessKeyManager()
+		signKey   = hauth2.NewUserAccessKey()
+		clientKey = hauth2.NewAppAccessKey()
+		store     = hauth2.NewMemorySessionStore(0)
+		tn        = time.Now().UnixMilli()
+		token     = tSessionToken("guest")
+	)
+	keyMgr.KeySet(clientKey)
+
+	// the session last seen ten minutes ago
+	store.Put(&hauth2.SessionItem{
+		Token:    &token,
+		Created:  tn - 600e3,
+		LastSeen: tn - 600e3,
+	})
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, store, signKey, &hauth2.SessionConfig{
+		IdleTimeout: 3600,
+	})
+	defer sessMgr.Close()
+
+	accessToken, err := hauth2.Sign(hauth2.TokenHeader{Kid: signKey.Id}, hauth2.AccessTokenClaims{
+		Jti: token.Jti,
+		Sub: token.Sub,
+		Iat: token.Iat,
+		Exp: token.Exp,
+	}, []byte(signKey.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(hauth2.NewTokenIntrospector(keyMgr, sessMgr))
+	defer srv.Close()
+
+	rs, err := hauth2.NewIntrospectionHttpClient(srv.URL, clientKey).Introspect(context.Background(), accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Active || rs.Exp != token.Exp {
+		t.Fatalf("Failed on Introspect %v", rs)
+	}
+
+	// the introspection is not an activity of the session
+	if item, _ := store.Get(token.Jti); item == nil ||
+		item.LastSeen != tn-600e3 || item.Token.Exp != token.Exp {
+		t.Fatal("Failed on Introspect, session touched")
+	}
+}
+
+func Test_TokenIntrospector_Grpc(t *testing.T) {
+
+	var (
+		keyMgr    = hauth1.NewAccessKeyManager()
+		clientKey = hauth2.NewAppAccessKey()
+		sessMgr   = hauth2.NewSessionTokenManager(keyMgr, hauth2.NewUserAccessKey())
+		lis       = bufconn.Listen(1 << 20)
+	)
+	keyMgr.KeySet(clientKey)
+	defer sessMgr.Close()
+
+	token := tSessionToken("guest")
+	token.Groups = []string{"staff"}
+
+	accessToken, err := sessMgr.ReSign("", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := grpc.NewServer()
+	hauth2.RegisterIntrospectionServer(gs, hauth2.NewTokenIntrospector(keyMgr, sessMgr))
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	dial := func(ak *hauth1.AccessKey) *grpc.ClientConn {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(hauth2.NewGrpcAppCredential(
+				hauth2.NewAuthConnectorWithAccessKey(ak))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial(clientKey)
+	defer conn.Close()
+
+	c := hauth2.NewIntrospectionGrpcClient(conn)
+
+	rs, err := c.Introspect(context.Background(), accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Active || rs.Sub != "guest" || len(rs.Groups) != 1 {
+		t.Fatalf("Failed on gRPC Introspect %v", rs)
+	}
+
+	if rs, err = c.Introspect(context.Background(), accessToken+"x"); err != nil || rs.Active {
+		t.Fatal("Failed on gRPC Introspect (invalid token)")
+	}
+
+	// unknown caller
+	conn2 := dial(hauth2.NewAppAccessKey())
+	defer conn2.Close()
+	if _, err = hauth2.NewIntrospectionGrpcClient(conn2).Introspect(context.Background(), accessToken); err == nil {
+		t.Fatal("Failed on gRPC Introspect (unauthenticated)")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc6749
+
+const (
+	oauth2AuthorizePath = "/oauth2/authorize"
+	oauth2TokenPath     = "/oauth2/token"
+
+	oauth2AccessTokenTtl int64 = 3600 // seconds
+	oauth2AuthCodeTtl    int64 = 60   // seconds
+)
+
+type OAuth2Config struct {
+	// Issuer is the https URL of the OpenID Connect provider, the OpenID
+	// Connect endpoints are only served if it is set.
+	Issuer string `json:"issuer,omitempty"`
+
+	// AccessTokenTtl of the issued access tokens in seconds (default 3600).
+	AccessTokenTtl int64 `json:"access_token_ttl,omitempty"`
+}
+
+type OAuth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+}
+
+type OAuth2ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// OAuth2Server serves the OAuth 2.0 endpoints on top of the AccessKeys of
+// keyMgr, the issued access tokens are the sessions of sessMgr.
+type OAuth2Server struct {
+	mu      sync.RWMutex
+	keyMgr  *hauth1.AccessKeyManager
+	sessMgr SessionTokenManager
+	cfg     OAuth2Config
+	mux     *http.ServeMux
+	auth    OAuth2Authenticator
+	clients map[string]*OAuth2Client
+	codes   map[string]*oauth2AuthCode
+	oidcKey *rsa.PrivateKey
+	oidcKid string
+}
+
+// NewOAuth2Server creates an OAuth2Server, optional args are an
+// *OAuth2Config, an OAuth2Authenticator (or OAuth2AuthenticatorFunc) for the
+// authorization endpoint, the registered *OAuth2Client and the
+// *rsa.PrivateKey which signs the id_tokens (generated if not given).
+// sessMgr must be given its sign key, the access tokens signed by a
+// generated key are lost on restart.
+func NewOAuth2Server(
+	keyMgr *hauth1.AccessKeyManager,
+	sessMgr SessionTokenManager,
+	args ...any,
+) (*OAuth2Server, error) {
+	if sm, ok := sessMgr.(*sessionTokenManager); ok && sm.signKeyAuto {
+		return nil, errors.New("session sign key not set")
+	}
+	it := &OAuth2Server{
+		keyMgr:  keyMgr,
+		sessMgr: sessMgr,
+		mux:     http.NewServeMux(),
+		clients: map[string]*OAuth2Client{},
+		codes:   map[string]*oauth2AuthCode{},
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *OAuth2Config:
+			it.cfg = *arg.(*OAuth2Config)
+
+		case OAuth2Authenticator:
+			it.auth = arg.(OAuth2Authenticator)
+
+		case func(http.ResponseWriter, *http.Request, *OAuth2Client) *IdentityToken:
+			it.auth = OAuth2AuthenticatorFunc(
+				arg.(func(http.ResponseWriter, *http.Request, *OAuth2Client) *IdentityToken))
+
+		case *OAuth2Client:
+			it.ClientSet(arg.(*OAuth2Client))
+
+		case *rsa.PrivateKey:
+			it.oidcKey = arg.(*rsa.PrivateKey)
+		}
+	}
+	if it.cfg.AccessTokenTtl <= 0 {
+		it.cfg.AccessTokenTtl = oauth2AccessTokenTtl
+	}
+	if it.auth == nil {
+		it.auth = OAuth2AuthenticatorFunc(it.accessTokenAuthenticate)
+	}
+	it.mux.HandleFunc(oauth2AuthorizePath, it.serveAuthorize)
+	it.mux.HandleFunc(oauth2TokenPath, it.serveToken)
+	if it.cfg.Issuer != "" {
+		it.cfg.Issuer = strings.TrimRight(it.cfg.Issuer, "/")
+		if it.oidcKey == nil {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				return nil, err
+			}
+			it.oidcKey = key
+		}
+		it.oidcKid = NewRsaJSONWebKey(&it.oidcKey.PublicKey).Thumbprint()
+		it.mux.HandleFunc(oidcConfigurationPath, it.serveOpenIDConfiguration)
+		it.mux.HandleFunc(oidcJwksPath, it.serveJwks)
+		it.mux.HandleFunc(oidcUserInfoPath, it.serveUserInfo)
+	}
+	return it, nil
+}
+
+func (it *OAuth2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	it.mux.ServeHTTP(w, r)
+}
+
+func (it *OAuth2Server) serveToken(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		oauth2ErrorReply(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+
+	case "client_credentials":
+		it.clientCredentialsGrant(w, r)
+
+	case "authorization_code":
+		it.authorizationCodeGrant(w, r)
+
+	case "refresh_token":
+		it.refreshTokenGrant(w, r)
+
+	default:
+		oauth2ErrorReply(w, http.StatusBadRequest, "unsupported_grant_type", grantType)
+	}
+}
+
+// clientCredentialsGrant issues an access token to an App type AccessKey,
+// restricted to the requested scopes granted by AccessKey.Scopes.
+func (it *OAuth2Server) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+
+	ak, ok := it.clientAuth(w, r)
+	if !ok {
+		return
+	}
+
+	if ak.Type != "App" {
+		oauth2ErrorReply(w, http.StatusBadRequest, "unauthorized_client",
+			"client_credentials grant is only allowed to App type access keys")
+		return
+	}
+
+	scopes := ak.Scopes
+	if v := r.PostForm.Get("scope"); v != "" {
+		if scopes = scopesIntersect(ak.Scopes, ParseScopeFilters(v)); len(scopes) == 0 {
+			oauth2ErrorReply(w, http.StatusBadRequest, "invalid_scope", v)
+			return
+		}
+	}
+
+	sub := ak.User
+	if sub == "" {
+		sub = ak.Id
+	}
+
+	tn := time.Now().Unix()
+	token := IdentityToken{
+		Jti:    uuid.NewString(),
+		Sub:    sub,
+		Iat:    tn,
+		Exp:    tn + it.cfg.AccessTokenTtl,
+		Type:   "App",
+		Scopes: scopes,
+	}
+
+	meta := NewSessionMetaWithHttpRequest(r)
+	meta.KeyId = ak.Id
+
+	accessToken, err := it.sessMgr.ReSign("", token, meta)
+	if err != nil {
+		oauth2ErrorReply(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	httpJsonReply(w, http.StatusOK, &OAuth2TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   it.cfg.AccessTokenTtl,
+		Scope:       ScopeFiltersString(scopes),
+	})
+}
+
+// clientAuth authenticates an AccessKey as the client.
+func (it *OAuth2Server) clientAuth(w http.ResponseWriter, r *http.Request) (*hauth1.AccessKey, bool) {
+
+	id, secret, basic, ok := oauth2ClientCredentials(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	ak, err := accessKeyValid(it.keyMgr, id, secret)
+	if err != nil {
+		oauth2InvalidClientReply(w, basic, err.Error())
+		return nil, false
+	}
+
+	return ak, true
+}
+
+// oauth2ClientCredentials reads the client credentials from HTTP Basic or
+// from the client_id and client_secret parameters (RFC 6749 section 2.3.1).
+func oauth2ClientCredentials(w http.ResponseWriter, r *http.Request) (string, string, bool, bool) {
+
+	var (
+		id, secret, basic = r.BasicAuth()
+		formId            = r.PostForm.Get("client_id")
+	)
+
+	if basic {
+		if formId != "" && formId != id {
+			oauth2ErrorReply(w, http.StatusBadRequest, "invalid_request",
+				"multiple client authentication methods")
+			return "", "", false, false
+		}
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = formId, r.PostForm.Get("client_secret")
+	}
+
+	return id, secret, basic, true
+}
+
+func oauth2InvalidClientReply(w http.ResponseWriter, basic bool, desc string) {
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hauth"`)
+	}
+	oauth2ErrorReply(w, http.StatusUnauthorized, "invalid_client", desc)
+}
+
+func oauth2ErrorReply(w http.ResponseWriter, status int, code, desc string) {
+	httpJsonReply(w, status, &OAuth2ErrorResponse{
+		Error:            code,
+		ErrorDescription: desc,
+	})
+}
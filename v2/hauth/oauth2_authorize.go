@@ -0,0 +1,432 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+// OAuth2Client is a client registered for the authorization code grant.
+type OAuth2Client struct {
+	Id   string `json:"id" toml:"id"`
+	Name string `json:"name,omitempty" toml:"name,omitempty"`
+
+	// Secret of a confidential client, empty for a public client which
+	// authenticates with PKCE only.
+	Secret string `json:"secret,omitempty" toml:"secret,omitempty"`
+
+	// RedirectUris are compared to the redirect_uri parameter by exact match.
+	RedirectUris []string `json:"redirect_uris" toml:"redirect_uris"`
+
+	// Scopes which may be granted to the client.
+	Scopes []*hauth1.ScopeFilter `json:"scopes,omitempty" toml:"scopes,omitempty"`
+}
+
+// OAuth2Authenticator authenticates the user of an authorization request.
+// It returns nil after writing its own response, e.g. a login page which
+// sends the user back to the authorization endpoint once logged in.
+type OAuth2Authenticator interface {
+	Authenticate(w http.ResponseWriter, r *http.Request, client *OAuth2Client) *IdentityToken
+}
+
+type OAuth2AuthenticatorFunc func(w http.ResponseWriter, r *http.Request, client *OAuth2Client) *IdentityToken
+
+func (fn OAuth2AuthenticatorFunc) Authenticate(w http.ResponseWriter, r *http.Request, client *OAuth2Client) *IdentityToken {
+	return fn(w, r, client)
+}
+
+type oauth2AuthCode struct {
+	clientId    string
+	redirectUri string // empty if not given in the authorization request
+	challenge   string
+	token       IdentityToken
+	exp         int64
+	used        bool
+	issued      string // jti of the access token issued with this code
+
+	// OpenID Connect authentication request
+	openid   bool
+	nonce    string
+	authTime int64
+}
+
+// ClientSet registers or replaces an OAuth2Client.
+func (it *OAuth2Server) ClientSet(client *OAuth2Client) error {
+	if client == nil || client.Id == "" {
+		return errors.New("client id not set")
+	}
+	if len(client.RedirectUris) == 0 {
+		return errors.New("redirect uris not set")
+	}
+	for _, v := range client.RedirectUris {
+		if u, err := url.Parse(v); err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return errors.New("invalid redirect uri " + v)
+		}
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.clients[client.Id] = client
+	return nil
+}
+
+func (it *OAuth2Server) ClientGet(id string) *OAuth2Client {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return it.clients[id]
+}
+
+func (it *OAuth2Server) ClientDel(id string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	delete(it.clients, id)
+}
+
+// serveAuthorize handles the authorization request of the authorization
+// code grant, PKCE (RFC 7636) with the S256 method is mandatory.
+func (it *OAuth2Server) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		oauth2ErrorReply(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	// the user agent must not be redirected to an unverified redirect uri
+	client := it.ClientGet(r.Form.Get("client_id"))
+	if client == nil {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_client", "client not found")
+		return
+	}
+
+	redirectUri := r.Form.Get("redirect_uri")
+	switch {
+	case redirectUri != "":
+		if !slices.Contains(client.RedirectUris, redirectUri) {
+			oauth2ErrorReply(w, http.StatusBadRequest, "invalid_request", "redirect_uri mismatch")
+			return
+		}
+
+	case len(client.RedirectUris) == 1:
+		redirectUri = client.RedirectUris[0]
+
+	default:
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_request", "redirect_uri not set")
+		return
+	}
+
+	var (
+		state    = r.Form.Get("state")
+		redirect = func(args ...string) {
+			u, _ := url.Parse(redirectUri)
+			q := u.Query()
+			for i := 0; i+1 < len(args); i += 2 {
+				if args[i+1] != "" {
+					q.Set(args[i], args[i+1])
+				}
+			}
+			if state != "" {
+				q.Set("state", state)
+			}
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+		}
+	)
+
+	if v := r.Form.Get("response_type"); v != "code" {
+		redirect("error", "unsupported_response_type")
+		return
+	}
+
+	challenge := r.Form.Get("code_challenge")
+	if r.Form.Get("code_challenge_method") != "S256" || len(challenge) != 43 {
+		redirect("error", "invalid_request",
+			"error_description", "code_challenge with the S256 method is required")
+		return
+	}
+
+	var (
+		scopes    = client.Scopes
+		requested = ParseScopeFilters(r.Form.Get("scope"))
+		openid    = false
+	)
+	if it.cfg.Issuer != "" {
+		requested = slices.DeleteFunc(requested, func(v *hauth1.ScopeFilter) bool {
+			if v.Name == "openid" && v.Value == "" {
+				openid = true
+			}
+			return v.Name == "openid"
+		})
+	}
+	if len(requested) > 0 {
+		if scopes = scopesIntersect(client.Scopes, requested); len(scopes) == 0 {
+			redirect("error", "invalid_scope")
+			return
+		}
+	}
+
+	user := it.auth.Authenticate(w, r, client)
+	if user == nil {
+		return
+	}
+	if user.IsExpired() || user.Sub == "" {
+		redirect("error", "access_denied")
+		return
+	}
+
+	token := *user
+	token.Scopes = scopes
+	if openid {
+		// the openid scope grants the access to the userinfo endpoint
+		token.Scopes = append([]*hauth1.ScopeFilter{NewScopeFilter("openid", "")}, scopes...)
+	}
+
+	code := bytesEncode(randGen(32))
+	it.codeSet(code, &oauth2AuthCode{
+		clientId:    client.Id,
+		redirectUri: r.Form.Get("redirect_uri"),
+		challenge:   challenge,
+		token:       token,
+		exp:         time.Now().Unix() + oauth2AuthCodeTtl,
+		openid:      openid,
+		nonce:       r.Form.Get("nonce"),
+		authTime:    user.Iat,
+	})
+
+	redirect("code", code)
+}
+
+// accessTokenAuthenticate is the default OAuth2Authenticator, the user is
+// authenticated by the access token of an existing session.
+func (it *OAuth2Server) accessTokenAuthenticate(w http.ResponseWriter, r *http.Request, client *OAuth2Client) *IdentityToken {
+	if token, err := NewAccessTokenWithHttpRequest(r); err == nil {
+		if sess, _, err := authSession(it.keyMgr, it.sessMgr, token); err == nil {
+			return sess
+		}
+	}
+	oauth2ErrorReply(w, http.StatusUnauthorized, "login_required", "")
+	return nil
+}
+
+// authorizationCodeGrant exchanges an authorization code for an access token
+// and a refresh token. A code is single-use, presenting it again revokes
+// the access token issued with it.
+func (it *OAuth2Server) authorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+
+	client, ok := it.clientAuthRegistered(w, r)
+	if !ok {
+		return
+	}
+
+	// the code is only consumed by the exchange of its client, so that a
+	// stolen code presented by another client can not burn it
+	codeId := r.PostForm.Get("code")
+	code := it.codeGet(codeId)
+	if code == nil || code.clientId != client.Id {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_grant", "code not found")
+		return
+	}
+
+	if code.redirectUri != "" && code.redirectUri != r.PostForm.Get("redirect_uri") {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+		return
+	}
+
+	if !pkceVerify(code.challenge, r.PostForm.Get("code_verifier")) {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+		return
+	}
+
+	if reused, issued := it.codeUse(codeId, code); reused {
+		if issued != "" {
+			it.sessMgr.Revoke(issued)
+		}
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_grant", "code reused")
+		return
+	}
+
+	tn := time.Now().Unix()
+	token := code.token
+	token.Jti = uuid.NewString()
+	token.Iat = tn
+	token.Exp = tn + it.cfg.AccessTokenTtl
+	if token.Type == "" {
+		token.Type = "User"
+	}
+
+	meta := NewSessionMetaWithHttpRequest(r)
+	meta.KeyId = client.Id
+
+	accessToken, err := it.sessMgr.ReSign("", token, meta)
+	if err != nil {
+		oauth2ErrorReply(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	it.codeIssued(code, token.Jti)
+
+	refreshToken, err := it.sessMgr.IssueRefreshToken(token, meta)
+	if err != nil {
+		oauth2ErrorReply(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	rs := &OAuth2TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    it.cfg.AccessTokenTtl,
+		RefreshToken: refreshToken,
+		Scope:        ScopeFiltersString(token.Scopes),
+	}
+
+	if code.openid {
+		if rs.IdToken, err = it.idTokenSign(client, &token, code.authTime, code.nonce); err != nil {
+			oauth2ErrorReply(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+	}
+
+	httpJsonReply(w, http.StatusOK, rs)
+}
+
+// refreshTokenGrant rotates a refresh token issued to the same client.
+func (it *OAuth2Server) refreshTokenGrant(w http.ResponseWriter, r *http.Request) {
+
+	client, ok := it.clientAuthRegistered(w, r)
+	if !ok {
+		return
+	}
+
+	refreshToken := r.PostForm.Get("refresh_token")
+	if !it.sessionOwned(client, refreshToken) {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_grant", "refresh_token not found")
+		return
+	}
+
+	rs, err := it.sessMgr.RotateRefreshToken(refreshToken)
+	if err != nil {
+		oauth2ErrorReply(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	httpJsonReply(w, http.StatusOK, &OAuth2TokenResponse{
+		AccessToken:  rs.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    rs.IdentityToken.Exp - time.Now().Unix(),
+		RefreshToken: rs.RefreshToken,
+		Scope:        ScopeFiltersString(rs.IdentityToken.Scopes),
+	})
+}
+
+// sessionOwned checks the session of refreshToken was issued to client, the
+// lookup does not record the activity of the session.
+func (it *OAuth2Server) sessionOwned(client *OAuth2Client, refreshToken string) bool {
+	n := strings.IndexByte(refreshToken, '.')
+	if n < 1 {
+		return false
+	}
+	sess := sessionPeek(it.sessMgr, refreshToken[:n])
+	return sess != nil && !sess.Token.IsExpired() && sess.KeyId == client.Id
+}
+
+// clientAuthRegistered authenticates a registered OAuth2Client, a public
+// client presents its client_id only.
+func (it *OAuth2Server) clientAuthRegistered(w http.ResponseWriter, r *http.Request) (*OAuth2Client, bool) {
+
+	id, secret, basic, ok := oauth2ClientCredentials(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	client := it.ClientGet(id)
+	if client == nil ||
+		subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		oauth2InvalidClientReply(w, basic, "invalid client")
+		return nil, false
+	}
+
+	return client, true
+}
+
+func (it *OAuth2Server) codeSet(code string, item *oauth2AuthCode) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	tn := time.Now().Unix()
+	for k, v := range it.codes {
+		if v.exp <= tn {
+			delete(it.codes, k)
+		}
+	}
+	it.codes[code] = item
+}
+
+// codeGet returns the unexpired code.
+func (it *OAuth2Server) codeGet(code string) *oauth2AuthCode {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	item, ok := it.codes[code]
+	if !ok {
+		return nil
+	}
+	if item.exp <= time.Now().Unix() {
+		delete(it.codes, code)
+		return nil
+	}
+	return item
+}
+
+// codeUse marks the code as used, reused is set if it has been exchanged
+// before, with the jti of the access token issued then.
+func (it *OAuth2Server) codeUse(code string, item *oauth2AuthCode) (bool, string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if item.used {
+		delete(it.codes, code)
+		return true, item.issued
+	}
+	item.used = true
+	return false, ""
+}
+
+func (it *OAuth2Server) codeIssued(item *oauth2AuthCode, jti string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	item.issued = jti
+}
+
+// pkceVerify checks the code_verifier against the S256 code_challenge.
+func pkceVerify(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare(
+		[]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
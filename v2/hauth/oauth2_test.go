@@ -0,0 +1,316 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func tOAuth2Token(srv *httptest.Server, ak *hauth1.AccessKey, basic bool, form url.Values) (int, *hauth2.OAuth2TokenResponse, error) {
+	if !basic {
+		form.Set("client_id", ak.Id)
+		form.Set("client_secret", ak.Secret)
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(ak.Id), url.QueryEscape(ak.Secret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	var rs hauth2.OAuth2TokenResponse
+	if resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(&rs); err != nil {
+			return 0, nil, err
+		}
+	}
+	return resp.StatusCode, &rs, nil
+}
+
+func Test_OAuth2Server_ClientCredentials_ScopeValues(t *testing.T) {
+
+	var (
+		keyMgr    = hauth1.NewAccessKeyManager()
+		clientKey = hauth2.NewAppAccessKey()
+	)
+	clientKey.Scopes = []*hauth1.ScopeFilter{
+		hauth2.NewScopeFilter("zone", "z1"),
+		hauth2.NewScopeFilter("zone", "z2"),
+	}
+	keyMgr.KeySet(clientKey)
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, hauth2.NewUserAccessKey())
+	defer sessMgr.Close()
+
+	oas, err := hauth2.NewOAuth2Server(keyMgr, sessMgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(oas)
+	defer srv.Close()
+
+	for scope, want := range map[string]string{
+		"zone:z2": "zone:z2",
+		"zone":    "zone:z1 zone:z2",
+		"zone:*":  "zone:z1 zone:z2",
+	} {
+		status, rs, err := tOAuth2Token(srv, clientKey, true, url.Values{
+			"grant_type": {"client_credentials"},
+			"scope":      {scope},
+		})
+		if err != nil || status != http.StatusOK || rs.Scope != want {
+			t.Fatalf("Failed on ClientCredentials scope %s : %d %v", scope, status, rs)
+		}
+	}
+}
+
+func Test_OAuth2Server_ClientCredentials(t *testing.T) {
+
+	var (
+		keyMgr    = hauth1.NewAccessKeyManager()
+		signKey   = hauth2.NewUserAccessKey()
+		clientKey = hauth2.NewAppAccessKey()
+	)
+	clientKey.Scopes = []*hauth1.ScopeFilter{
+		hauth2.NewScopeFilter("zone", "z1"),
+		hauth2.NewScopeFilter("app", "*"),
+	}
+	keyMgr.KeySet(clientKey)
+
+	// the access tokens must not be signed by a random client key
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr)
+	if _, err := hauth2.NewOAuth2Server(keyMgr, sessMgr); err == nil {
+		t.Fatal("Failed on NewOAuth2Server without sign key")
+	}
+	sessMgr.Close()
+
+	sessMgr = hauth2.NewSessionTokenManager(keyMgr, signKey)
+	defer sessMgr.Close()
+
+	oas, err := hauth2.NewOAuth2Server(keyMgr, sessMgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(oas)
+	defer srv.Close()
+
+	status, rs, err := tOAuth2Token(srv, clientKey, true, url.Values{
+		"grant_type": {"client_credentials"},
+		"scope":      {"zone:z1 app:a1 user:u1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || rs.TokenType != "Bearer" ||
+		rs.Scope != "zone:z1 app:a1" || rs.ExpiresIn != 3600 {
+		t.Fatalf("Failed on ClientCredentials Basic %d %v", status, rs)
+	}
+
+	at, err := hauth2.NewAccessToken(rs.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := sessMgr.Token(at.Claims.Jti); token == nil ||
+		token.Sub != clientKey.Id || token.Type != "App" || len(token.Scopes) != 2 {
+		t.Fatal("Failed on ClientCredentials IdentityToken")
+	}
+
+	if status, rs, err = tOAuth2Token(srv, clientKey, false, url.Values{
+		"grant_type": {"client_credentials"},
+	}); err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK || rs.Scope != "zone:z1 app:*" {
+		t.Fatalf("Failed on ClientCredentials Form %d %v", status, rs)
+	}
+
+	if status, _, _ = tOAuth2Token(srv, clientKey, false, url.Values{
+		"grant_type": {"client_credentials"},
+		"scope":      {"zone:z2"},
+	}); status != http.StatusBadRequest {
+		t.Fatalf("Failed on ClientCredentials invalid_scope %d", status)
+	}
+
+	badKey := &hauth1.AccessKey{
+		Id:     clientKey.Id,
+		Secret: clientKey.Secret + "x",
+	}
+	if status, _, _ = tOAuth2Token(srv, badKey, true, url.Values{
+		"grant_type": {"client_credentials"},
+	}); status != http.StatusUnauthorized {
+		t.Fatalf("Failed on ClientCredentials invalid_client %d", status)
+	}
+}
+
+func Test_OAuth2Server_AuthorizationCode(t *testing.T) {
+
+	var (
+		keyMgr = hauth1.NewAccessKeyManager()
+		client = &hauth2.OAuth2Client{
+			Id:           "web",
+			RedirectUris: []string{"https://app.example.com/cb"},
+			Scopes:       []*hauth1.ScopeFilter{hauth2.NewScopeFilter("zone", "*")},
+		}
+		user = &hauth2.IdentityToken{
+			Sub:    "guest",
+			Exp:    time.Now().Unix() + 60,
+			Groups: []string{"staff"},
+		}
+		verifier  = strings.Repeat("v", 43)
+		sum       = sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	)
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, hauth2.NewUserAccessKey())
+	defer sessMgr.Close()
+
+	oas, err := hauth2.NewOAuth2Server(keyMgr, sessMgr, client,
+		func(w http.ResponseWriter, r *http.Request, c *hauth2.OAuth2Client) *hauth2.IdentityToken {
+			return user
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(oas)
+	defer srv.Close()
+
+	hc := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	authorize := func(q url.Values) (int, url.Values) {
+		resp, err := hc.Get(srv.URL + "/oauth2/authorize?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		u, _ := url.Parse(resp.Header.Get("Location"))
+		return resp.StatusCode, u.Query()
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"web"},
+		"redirect_uri":          {"https://app.example.com/cb"},
+		"scope":                 {"zone:z1"},
+		"state":                 {"s1"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	status, rq := authorize(q)
+	if status != http.StatusFound || rq.Get("state") != "s1" || rq.Get("code") == "" {
+		t.Fatalf("Failed on Authorize %d %v", status, rq)
+	}
+
+	q2 := url.Values{}
+	for k, v := range q {
+		q2[k] = v
+	}
+	q2.Set("redirect_uri", "https://evil.example.com/cb")
+	if status, _ = authorize(q2); status != http.StatusBadRequest {
+		t.Fatalf("Failed on Authorize redirect_uri mismatch %d", status)
+	}
+
+	q2.Set("redirect_uri", "https://app.example.com/cb")
+	q2.Del("code_challenge_method")
+	if status, rq2 := authorize(q2); status != http.StatusFound || rq2.Get("error") != "invalid_request" {
+		t.Fatalf("Failed on Authorize without PKCE %d %v", status, rq2)
+	}
+
+	exchange := func(form url.Values) (int, *hauth2.OAuth2TokenResponse) {
+		form.Set("client_id", "web")
+		resp, err := http.PostForm(srv.URL+"/oauth2/token", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var rs hauth2.OAuth2TokenResponse
+		json.NewDecoder(resp.Body).Decode(&rs)
+		return resp.StatusCode, &rs
+	}
+
+	codeForm := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {rq.Get("code")},
+		"redirect_uri":  {"https://app.example.com/cb"},
+		"code_verifier": {strings.Repeat("x", 43)},
+	}
+	if status, _ = exchange(codeForm); status != http.StatusBadRequest {
+		t.Fatalf("Failed on AuthorizationCode code_verifier mismatch %d", status)
+	}
+
+	// failed attempts do not consume the code
+	codeForm.Set("code_verifier", verifier)
+	codeForm.Set("redirect_uri", "https://evil.example.com/cb")
+	if status, _ = exchange(codeForm); status != http.StatusBadRequest {
+		t.Fatalf("Failed on AuthorizationCode redirect_uri mismatch %d", status)
+	}
+	codeForm.Set("redirect_uri", "https://app.example.com/cb")
+
+	status, rs := exchange(codeForm)
+	if status != http.StatusOK || rs.RefreshToken == "" || rs.Scope != "zone:z1" {
+		t.Fatalf("Failed on AuthorizationCode %d %v", status, rs)
+	}
+
+	at, err := hauth2.NewAccessToken(rs.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := sessMgr.Token(at.Claims.Jti); token == nil ||
+		token.Sub != "guest" || !token.Allow("staff") {
+		t.Fatal("Failed on AuthorizationCode IdentityToken")
+	}
+
+	// a refresh token of a session which was not issued to the client
+	other, err := sessMgr.IssueRefreshToken(tSessionToken("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = exchange(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {other},
+	}); status != http.StatusBadRequest {
+		t.Fatalf("Failed on RefreshToken of another client %d", status)
+	}
+
+	status, rs2 := exchange(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {rs.RefreshToken},
+	})
+	if status != http.StatusOK || rs2.RefreshToken == "" || rs2.RefreshToken == rs.RefreshToken {
+		t.Fatalf("Failed on RefreshToken %d %v", status, rs2)
+	}
+
+	if status, _ = exchange(codeForm); status != http.StatusBadRequest ||
+		sessMgr.Token(at.Claims.Jti) != nil {
+		t.Fatalf("Failed on AuthorizationCode reused %d", status)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"net/http"
+	"slices"
+	"time"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+// https://openid.net/specs/openid-connect-core-1_0.html
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+
+const (
+	oidcConfigurationPath = "/.well-known/openid-configuration"
+	oidcJwksPath          = "/oauth2/jwks"
+	oidcUserInfoPath      = "/oauth2/userinfo"
+
+	oidcIdTokenAlg = "RS256"
+)
+
+// JSONWebKey is the public key of RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// Key returns the key of kid, or the only key if kid is empty.
+func (it *JSONWebKeySet) Key(kid string) *JSONWebKey {
+	if kid == "" && len(it.Keys) == 1 {
+		return it.Keys[0]
+	}
+	for _, v := range it.Keys {
+		if v.Kid == kid {
+			return v
+		}
+	}
+	return nil
+}
+
+func NewRsaJSONWebKey(key *rsa.PublicKey) *JSONWebKey {
+	return &JSONWebKey{
+		Kty: "RSA",
+		N:   bytesEncode(key.N.Bytes()),
+		E:   bytesEncode(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// PublicKey returns the *rsa.PublicKey or *ecdsa.PublicKey of the key.
+func (it *JSONWebKey) PublicKey() (any, error) {
+	switch it.Kty {
+
+	case "RSA":
+		n, err := bytesDecode(it.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := bytesDecode(it.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid key (e)")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch it.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("invalid key (crv:" + it.Crv + ")")
+		}
+		x, err := bytesDecode(it.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := bytesDecode(it.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid key (ec point)")
+		}
+		return key, nil
+	}
+
+	return nil, errors.New("invalid key (kty:" + it.Kty + ")")
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key.
+func (it *JSONWebKey) Thumbprint() string {
+	sum := sha256.Sum256([]byte(`{"e":"` + it.E + `","kty":"` + it.Kty + `","n":"` + it.N + `"}`))
+	return bytesEncode(sum[:])
+}
+
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// OIDCIdTokenClaims are the claims of an id_token, derived from the
+// IdentityToken of the user.
+type OIDCIdTokenClaims struct {
+	Iss      string   `json:"iss"`
+	Sub      string   `json:"sub"`
+	Aud      string   `json:"aud"`
+	Exp      int64    `json:"exp"`
+	Iat      int64    `json:"iat"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+	Nonce    string   `json:"nonce,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type OIDCUserInfo struct {
+	Sub    string   `json:"sub"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func (it *OAuth2Server) serveOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	httpJsonReply(w, http.StatusOK, &OpenIDConfiguration{
+		Issuer:                            it.cfg.Issuer,
+		AuthorizationEndpoint:             it.cfg.Issuer + oauth2AuthorizePath,
+		TokenEndpoint:                     it.cfg.Issuer + oauth2TokenPath,
+		UserInfoEndpoint:                  it.cfg.Issuer + oidcUserInfoPath,
+		JwksUri:                           it.cfg.Issuer + oidcJwksPath,
+		ScopesSupported:                   []string{"openid"},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{oidcIdTokenAlg},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "groups"},
+	})
+}
+
+func (it *OAuth2Server) serveJwks(w http.ResponseWriter, r *http.Request) {
+	key := NewRsaJSONWebKey(&it.oidcKey.PublicKey)
+	key.Use, key.Alg, key.Kid = "sig", oidcIdTokenAlg, it.oidcKid
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(jsonEncode(&JSONWebKeySet{
+		Keys: []*JSONWebKey{key},
+	}))
+}
+
+func (it *OAuth2Server) serveUserInfo(w http.ResponseWriter, r *http.Request) {
+
+	var sess *IdentityToken
+	if token, err := NewAccessTokenWithHttpRequest(r); err == nil {
+		sess, _, _ = authSession(it.keyMgr, it.sessMgr, token)
+	}
+	if sess == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauth2ErrorReply(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+
+	if !slices.ContainsFunc(sess.Scopes, func(v *hauth1.ScopeFilter) bool {
+		return v.Name == "openid"
+	}) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		oauth2ErrorReply(w, http.StatusForbidden, "insufficient_scope", "openid scope required")
+		return
+	}
+
+	httpJsonReply(w, http.StatusOK, &OIDCUserInfo{
+		Sub:    sess.Sub,
+		Groups: sess.Groups,
+	})
+}
+
+// idTokenSign issues the id_token of the user token to client, authTime is
+// the time the user authenticated.
+func (it *OAuth2Server) idTokenSign(client *OAuth2Client, token *IdentityToken, authTime int64, nonce string) (string, error) {
+
+	tn := time.Now().Unix()
+	claims := &OIDCIdTokenClaims{
+		Iss:      it.cfg.Issuer,
+		Sub:      token.Sub,
+		Aud:      client.Id,
+		Exp:      tn + it.cfg.AccessTokenTtl,
+		Iat:      tn,
+		AuthTime: authTime,
+		Nonce:    nonce,
+		Groups:   token.Groups,
+	}
+
+	header := TokenHeader{
+		Alg: oidcIdTokenAlg,
+		Typ: "JWT",
+		Kid: it.oidcKid,
+	}
+
+	signingString := bytesEncode(jsonEncode(header)) + "." +
+		bytesEncode(jsonEncode(claims))
+
+	bs, err := Signers.Signer(oidcIdTokenAlg).Sign(signingString, it.oidcKey)
+	if err != nil {
+		return "", err
+	}
+
+	return signingString + "." + bytesEncode(bs), nil
+}
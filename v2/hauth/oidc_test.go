@@ -0,0 +1,175 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func tHttpGetJson(hc *http.Client, req *http.Request, o any) (*http.Response, error) {
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if o != nil && resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(o)
+	}
+	return resp, err
+}
+
+func Test_OAuth2Server_OpenIDConnect(t *testing.T) {
+
+	var (
+		keyMgr = hauth1.NewAccessKeyManager()
+		client = &hauth2.OAuth2Client{
+			Id:           "web",
+			Secret:       "secret",
+			RedirectUris: []string{"https://app.example.com/cb"},
+		}
+		authTime = time.Now().Unix() - 10
+		user     = &hauth2.IdentityToken{
+			Sub:    "guest",
+			Iat:    authTime,
+			Exp:    authTime + 60,
+			Groups: []string{"staff"},
+		}
+		verifier  = strings.Repeat("v", 43)
+		sum       = sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	)
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, hauth2.NewUserAccessKey())
+	defer sessMgr.Close()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	oas, err := hauth2.NewOAuth2Server(keyMgr, sessMgr, client,
+		&hauth2.OAuth2Config{Issuer: srv.URL + "/"},
+		func(w http.ResponseWriter, r *http.Request, c *hauth2.OAuth2Client) *hauth2.IdentityToken {
+			return user
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/", oas)
+
+	hc := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var cfg hauth2.OpenIDConfiguration
+	req, _ := http.NewRequest("GET", srv.URL+"/.well-known/openid-configuration", nil)
+	if _, err := tHttpGetJson(hc, req, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Issuer != srv.URL || cfg.TokenEndpoint != srv.URL+"/oauth2/token" {
+		t.Fatalf("Failed on OpenIDConfiguration %v", cfg)
+	}
+
+	var jwks hauth2.JSONWebKeySet
+	req, _ = http.NewRequest("GET", cfg.JwksUri, nil)
+	if _, err := tHttpGetJson(hc, req, &jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatal("Failed on JSONWebKeySet")
+	}
+
+	req, _ = http.NewRequest("GET", cfg.AuthorizationEndpoint+"?"+url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"web"},
+		"scope":                 {"openid"},
+		"nonce":                 {"n1"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}.Encode(), nil)
+	resp, err := tHttpGetJson(hc, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(resp.Header.Get("Location"))
+
+	var rs hauth2.OAuth2TokenResponse
+	req, _ = http.NewRequest("POST", cfg.TokenEndpoint, strings.NewReader(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {u.Query().Get("code")},
+		"code_verifier": {verifier},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("web", "secret")
+	if resp, err = tHttpGetJson(hc, req, &rs); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed on AuthorizationCode %v", err)
+	}
+	if rs.IdToken == "" || rs.Scope != "openid" {
+		t.Fatalf("Failed on AuthorizationCode id_token %v", rs)
+	}
+
+	// verify the id_token by the JSONWebKeySet
+	var (
+		parts  = strings.Split(rs.IdToken, ".")
+		n, _   = base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+		e, _   = base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+		sig, _ = base64.RawURLEncoding.DecodeString(parts[2])
+		pub    = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		hashed = sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	)
+	if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Fatal(err)
+	}
+
+	var claims hauth2.OIDCIdTokenClaims
+	bs, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(bs, &claims)
+	if claims.Iss != srv.URL || claims.Sub != "guest" || claims.Aud != "web" ||
+		claims.Nonce != "n1" || claims.AuthTime != authTime {
+		t.Fatalf("Failed on OIDCIdTokenClaims %v", claims)
+	}
+
+	var info hauth2.OIDCUserInfo
+	req, _ = http.NewRequest("GET", cfg.UserInfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer "+rs.AccessToken)
+	if _, err = tHttpGetJson(hc, req, &info); err != nil ||
+		info.Sub != "guest" || len(info.Groups) != 1 {
+		t.Fatalf("Failed on UserInfo %v", info)
+	}
+
+	// the session tokens without the openid scope are rejected
+	sess := tSessionToken("guest")
+	accessToken, err := sessMgr.ReSign("", sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", cfg.UserInfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if resp, err = tHttpGetJson(hc, req, nil); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("Failed on UserInfo without openid scope")
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc6238
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+
+const (
+	totpDigits           = 6
+	totpPeriod     int64 = 30 // seconds
+	totpWindow           = 1  // accepted periods of clock drift
+	totpSecretSize       = 20
+
+	otpRecoveryCodes    = 10
+	otpRecoveryCodeSize = 16 // base32 characters, 80 bits
+
+	otpMaxFailures       = 5
+	otpLockout     int64 = 300 // seconds
+)
+
+var (
+	ErrOTPRequired = errors.New("otp required")
+	ErrOTPInvalid  = errors.New("invalid otp")
+	ErrOTPLocked   = errors.New("otp locked, too many failed attempts")
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// NewTOTPSecret returns a random base32 encoded secret.
+func NewTOTPSecret() string {
+	return totpEncoding.EncodeToString(randGen(totpSecretSize))
+}
+
+// TOTPKeyURI returns the otpauth:// URI of the secret, which is usually
+// shown as a QR code to be scanned by an authenticator app.
+func TOTPKeyURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := account
+	if issuer != "" {
+		q.Set("issuer", issuer)
+		label = issuer + ":" + account
+	}
+	return "otpauth://totp/" + url.PathEscape(label) + "?" + q.Encode()
+}
+
+// TOTPCode returns the code of secret at t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	return hotpCode(key, t.Unix()/totpPeriod), nil
+}
+
+// hotpCode is the HOTP value of RFC 4226.
+func hotpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	n := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[n:n+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// OTPEnrollment is the second factor of a user.
+type OTPEnrollment struct {
+	Sub string `json:"sub"`
+
+	// Secret is empty until the first enrollment is confirmed.
+	Secret string `json:"secret,omitempty"`
+
+	// LastCounter is the TOTP counter of the last accepted code, codes are
+	// only accepted once.
+	LastCounter int64 `json:"last_counter,omitempty"`
+
+	// RecoveryCodes are the argon2id hashes of the unused recovery codes,
+	// salted by RecoveryCodeSalt.
+	RecoveryCodes    []string `json:"recovery_codes,omitempty"`
+	RecoveryCodeSalt string   `json:"recovery_code_salt,omitempty"`
+
+	// Pending enrollment which replaces the active one once confirmed.
+	PendingSecret           string   `json:"pending_secret,omitempty"`
+	PendingRecoveryCodes    []string `json:"pending_recovery_codes,omitempty"`
+	PendingRecoveryCodeSalt string   `json:"pending_recovery_code_salt,omitempty"`
+
+	// Failures counts the invalid codes since the last accepted one, the
+	// codes are rejected until LockedUntil (unix time in seconds) once
+	// MaxFailures is reached.
+	Failures    int   `json:"failures,omitempty"`
+	LockedUntil int64 `json:"locked_until,omitempty"`
+
+	Updated int64 `json:"updated"`
+}
+
+type OTPStore interface {
+	Get(sub string) (*OTPEnrollment, error)
+	Put(item *OTPEnrollment) error
+	Delete(sub string) error
+}
+
+type memoryOTPStore struct {
+	mu    sync.RWMutex
+	items map[string]*OTPEnrollment
+}
+
+func NewMemoryOTPStore() OTPStore {
+	return &memoryOTPStore{
+		items: map[string]*OTPEnrollment{},
+	}
+}
+
+func (it *memoryOTPStore) Get(sub string) (*OTPEnrollment, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if item, ok := it.items[sub]; ok {
+		cp := *item
+		return &cp, nil
+	}
+	return nil, nil
+}
+
+func (it *memoryOTPStore) Put(item *OTPEnrollment) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	cp := *item
+	it.items[item.Sub] = &cp
+	return nil
+}
+
+func (it *memoryOTPStore) Delete(sub string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	delete(it.items, sub)
+	return nil
+}
+
+type OTPConfig struct {
+	// Issuer shown by the authenticator apps.
+	Issuer string `json:"issuer,omitempty"`
+
+	// MaxFailures is the number of invalid codes after which the codes of a
+	// user are rejected for Lockout seconds (default 5 and 300).
+	MaxFailures int   `json:"max_failures,omitempty"`
+	Lockout     int64 `json:"lockout,omitempty"`
+}
+
+// OTPEnrollResponse is shown once to the user on enrollment.
+type OTPEnrollResponse struct {
+	Secret        string   `json:"secret"`
+	KeyUri        string   `json:"key_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// OTPManager manages the TOTP second factor of users. An IdentityAuthService
+// requires the AuthLoginRequest.Otp of the users for whom Required is true:
+//
+//	if otpMgr.Required(sub) {
+//		if err := otpMgr.Verify(sub, req.Otp); err != nil {
+//			return nil, err
+//		}
+//	}
+type OTPManager struct {
+	mu    sync.Mutex
+	store OTPStore
+	cfg   OTPConfig
+}
+
+// NewOTPManager creates an OTPManager, optional args are an OTPStore (the
+// default is in-memory) and an *OTPConfig.
+func NewOTPManager(args ...any) *OTPManager {
+	it := &OTPManager{}
+	for _, arg := range args {
+		switch arg.(type) {
+		case OTPStore:
+			it.store = arg.(OTPStore)
+		case *OTPConfig:
+			it.cfg = *arg.(*OTPConfig)
+		}
+	}
+	if it.store == nil {
+		it.store = NewMemoryOTPStore()
+	}
+	if it.cfg.MaxFailures <= 0 {
+		it.cfg.MaxFailures = otpMaxFailures
+	}
+	if it.cfg.Lockout <= 0 {
+		it.cfg.Lockout = otpLockout
+	}
+	return it
+}
+
+// Enroll creates a new pending enrollment of sub, which replaces the
+// active one only after Confirm.
+func (it *OTPManager) Enroll(sub string) (*OTPEnrollResponse, error) {
+
+	if sub == "" {
+		return nil, errors.New("sub not set")
+	}
+
+	rs := &OTPEnrollResponse{
+		Secret: NewTOTPSecret(),
+	}
+	rs.KeyUri = TOTPKeyURI(it.cfg.Issuer, sub, rs.Secret)
+
+	var (
+		salt   = bytesEncode(randGen(passwordSaltSize))
+		hashes = []string{}
+	)
+	for i := 0; i < otpRecoveryCodes; i++ {
+		code := strings.ToLower(totpEncoding.EncodeToString(randGen(otpRecoveryCodeSize * 5 / 8)))
+		hash, err := otpRecoveryCodeHash(code, salt)
+		if err != nil {
+			return nil, err
+		}
+		rs.RecoveryCodes = append(rs.RecoveryCodes,
+			code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		hashes = append(hashes, hash)
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	item, err := it.store.Get(sub)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		item = &OTPEnrollment{Sub: sub}
+	}
+	item.PendingSecret, item.PendingRecoveryCodes = rs.Secret, hashes
+	item.PendingRecoveryCodeSalt = salt
+	item.Updated = time.Now().Unix()
+
+	if err := it.store.Put(item); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Confirm activates the pending enrollment of sub with a valid code.
+func (it *OTPManager) Confirm(sub, code string) error {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	item, err := it.store.Get(sub)
+	if err != nil {
+		return err
+	}
+	if item == nil || item.PendingSecret == "" {
+		return errors.New("enrollment not found")
+	}
+	if item.LockedUntil > time.Now().Unix() {
+		return ErrOTPLocked
+	}
+
+	counter, ok := totpVerify(item.PendingSecret, 0, code, time.Now())
+	if !ok {
+		return it.failure(item)
+	}
+
+	item.Secret, item.RecoveryCodes = item.PendingSecret, item.PendingRecoveryCodes
+	item.RecoveryCodeSalt = item.PendingRecoveryCodeSalt
+	item.PendingSecret, item.PendingRecoveryCodes = "", nil
+	item.PendingRecoveryCodeSalt = ""
+	item.LastCounter = counter
+	item.Failures, item.LockedUntil = 0, 0
+	item.Updated = time.Now().Unix()
+
+	return it.store.Put(item)
+}
+
+// Required returns true if sub has a confirmed enrollment.
+func (it *OTPManager) Required(sub string) bool {
+	item, err := it.store.Get(sub)
+	return err != nil || (item != nil && item.Secret != "")
+}
+
+// Verify checks a TOTP code or consumes a recovery code of sub. After
+// MaxFailures invalid codes, ErrOTPLocked is returned until the lockout
+// ends.
+func (it *OTPManager) Verify(sub, code string) error {
+
+	if code == "" {
+		return ErrOTPRequired
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	item, err := it.store.Get(sub)
+	if err != nil {
+		return err
+	}
+	if item == nil || item.Secret == "" {
+		return ErrOTPInvalid
+	}
+	if item.LockedUntil > time.Now().Unix() {
+		return ErrOTPLocked
+	}
+
+	if counter, ok := totpVerify(item.Secret, item.LastCounter, code, time.Now()); ok {
+		item.LastCounter = counter
+		item.Failures, item.LockedUntil = 0, 0
+		return it.store.Put(item)
+	}
+
+	hash, err := otpRecoveryCodeHash(code, item.RecoveryCodeSalt)
+	if err != nil {
+		return err
+	}
+	for i, v := range item.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(hash)) == 1 {
+			item.RecoveryCodes = append(item.RecoveryCodes[:i:i], item.RecoveryCodes[i+1:]...)
+			item.Failures, item.LockedUntil = 0, 0
+			return it.store.Put(item)
+		}
+	}
+
+	return it.failure(item)
+}
+
+// failure records an invalid code of item, and locks it once MaxFailures
+// is reached.
+func (it *OTPManager) failure(item *OTPEnrollment) error {
+	item.Failures += 1
+	if item.Failures >= it.cfg.MaxFailures {
+		item.Failures = 0
+		item.LockedUntil = time.Now().Unix() + it.cfg.Lockout
+	}
+	if err := it.store.Put(item); err != nil {
+		return err
+	}
+	if item.LockedUntil > 0 {
+		return ErrOTPLocked
+	}
+	return ErrOTPInvalid
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of sub.
+func (it *OTPManager) RecoveryCodesLeft(sub string) int {
+	if item, _ := it.store.Get(sub); item != nil {
+		return len(item.RecoveryCodes)
+	}
+	return 0
+}
+
+func (it *OTPManager) Remove(sub string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.store.Delete(sub)
+}
+
+// totpVerify returns the counter of code within the drift window, codes of
+// a counter not after last are rejected as replayed.
+func totpVerify(secret string, last int64, code string, t time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	c := t.Unix() / totpPeriod
+	for i := int64(-totpWindow); i <= totpWindow; i++ {
+		if c+i <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotpCode(key, c+i)), []byte(code)) == 1 {
+			return c + i, true
+		}
+	}
+	return 0, false
+}
+
+// otpRecoveryCodeHash hashes the normalized code by argon2id with the
+// default password parameters, the code is hashed once per Verify and
+// compared to all the unused codes, which share the salt of the user.
+func otpRecoveryCodeHash(code, salt string) (string, error) {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	key, err := (*PasswordHashConfig)(nil).fix().key([]byte(code), []byte(salt))
+	if err != nil {
+		return "", err
+	}
+	return bytesEncode(key), nil
+}
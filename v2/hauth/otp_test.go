@@ -0,0 +1,161 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_TOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // 12345678901234567890
+	for ts, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+	} {
+		if v, err := hauth2.TOTPCode(secret, time.Unix(ts, 0)); err != nil || v != code {
+			t.Fatalf("Failed on TOTPCode %d %s", ts, v)
+		}
+	}
+}
+
+func Test_OTPManager(t *testing.T) {
+
+	var (
+		store  = hauth2.NewMemoryOTPStore()
+		otpMgr = hauth2.NewOTPManager(store, &hauth2.OTPConfig{Issuer: "hooto"})
+	)
+
+	rs, err := otpMgr.Enroll("guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rs.KeyUri, "otpauth://totp/hooto:guest?") ||
+		len(rs.RecoveryCodes) != 10 || otpMgr.Required("guest") {
+		t.Fatal("Failed on Enroll")
+	}
+
+	// 80 bits recovery codes, stored as salted hashes
+	if len(strings.ReplaceAll(rs.RecoveryCodes[0], "-", "")) != 16 {
+		t.Fatal("Failed on Enroll recovery code " + rs.RecoveryCodes[0])
+	}
+	if item, _ := store.Get("guest"); item == nil || item.PendingRecoveryCodeSalt == "" ||
+		slices.Contains(item.PendingRecoveryCodes, rs.RecoveryCodes[0]) {
+		t.Fatal("Failed on Enroll recovery code hashes")
+	}
+
+	code, _ := hauth2.TOTPCode(rs.Secret, time.Now())
+	if err = otpMgr.Confirm("guest", code); err != nil {
+		t.Fatal(err)
+	}
+	if !otpMgr.Required("guest") {
+		t.Fatal("Failed on Confirm")
+	}
+
+	// replayed and drifted codes
+	if err = otpMgr.Verify("guest", code); err == nil {
+		t.Fatal("Failed on Verify replay")
+	}
+	code, _ = hauth2.TOTPCode(rs.Secret, time.Now().Add(30*time.Second))
+	if err = otpMgr.Verify("guest", code); err != nil {
+		t.Fatal("Failed on Verify drift " + err.Error())
+	}
+	code, _ = hauth2.TOTPCode(rs.Secret, time.Now().Add(5*time.Minute))
+	if err = otpMgr.Verify("guest", code); err == nil {
+		t.Fatal("Failed on Verify out of window")
+	}
+
+	if err = otpMgr.Verify("guest", strings.ToUpper(rs.RecoveryCodes[0])); err != nil {
+		t.Fatal("Failed on Verify recovery code " + err.Error())
+	}
+	if err = otpMgr.Verify("guest", rs.RecoveryCodes[0]); err == nil ||
+		otpMgr.RecoveryCodesLeft("guest") != 9 {
+		t.Fatal("Failed on Verify recovery code reuse")
+	}
+}
+
+func Test_OTPManager_Lockout(t *testing.T) {
+
+	otpMgr := hauth2.NewOTPManager(&hauth2.OTPConfig{MaxFailures: 3})
+
+	rs, err := otpMgr.Enroll("guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := hauth2.TOTPCode(rs.Secret, time.Now())
+	if err = otpMgr.Confirm("guest", code); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = otpMgr.Verify("guest", "abcdef"); err != hauth2.ErrOTPInvalid {
+			t.Fatalf("Failed on Verify invalid code #%d %v", i, err)
+		}
+	}
+	if err = otpMgr.Verify("guest", "abcdef"); err != hauth2.ErrOTPLocked {
+		t.Fatal("Failed on Verify lockout")
+	}
+
+	// the valid codes are rejected until the lockout ends
+	code, _ = hauth2.TOTPCode(rs.Secret, time.Now().Add(30*time.Second))
+	if err = otpMgr.Verify("guest", code); err != hauth2.ErrOTPLocked {
+		t.Fatal("Failed on Verify locked")
+	}
+	if err = otpMgr.Verify("guest", rs.RecoveryCodes[0]); err != hauth2.ErrOTPLocked ||
+		otpMgr.RecoveryCodesLeft("guest") != 10 {
+		t.Fatal("Failed on Verify locked recovery code")
+	}
+}
+
+func Test_AuthConnector_OtpLogin(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(3600)
+		ak  = hauth2.NewUserAccessKey()
+	)
+	defer srv.sessMgr.Close()
+
+	ak.User = "guest"
+	srv.keyMgr.KeySet(ak)
+
+	srv.otpMgr = hauth2.NewOTPManager()
+	rs, _ := srv.otpMgr.Enroll("guest")
+	code, _ := hauth2.TOTPCode(rs.Secret, time.Now().Add(-30*time.Second))
+	if err := srv.otpMgr.Confirm("guest", code); err != nil {
+		t.Fatal(err)
+	}
+
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak, srv)
+	if ac.AccessToken() != "" {
+		t.Fatal("Failed on login without otp")
+	}
+	ac.Close()
+
+	ac = hauth2.NewAuthConnectorWithAccessKey(ak, srv,
+		hauth2.AuthOtpProvider(func() (string, error) {
+			return hauth2.TOTPCode(rs.Secret, time.Now())
+		}))
+	defer ac.Close()
+
+	if ac.AccessToken() == "" || srv.logins.Load() != 1 {
+		t.Fatal("Failed on login with otp")
+	}
+}
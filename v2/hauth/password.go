@@ -0,0 +1,276 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md
+// https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html
+
+const (
+	PasswordAlgArgon2id     = "argon2id"
+	PasswordAlgScrypt       = "scrypt"
+	PasswordAlgPbkdf2Sha256 = "pbkdf2-sha256"
+
+	passwordSaltSize = 16
+	passwordKeySize  = 32
+)
+
+// PasswordHashConfig are the algorithm and parameters of the new password
+// hashes, the parameters are recorded in each hash (PHC string format).
+type PasswordHashConfig struct {
+	// Alg is argon2id (default), scrypt or pbkdf2-sha256.
+	Alg string `json:"alg,omitempty" toml:"alg,omitempty"`
+
+	// argon2id, default m=19456 (KiB), t=2, p=1
+	Argon2Memory  uint32 `json:"argon2_memory,omitempty" toml:"argon2_memory,omitempty"`
+	Argon2Time    uint32 `json:"argon2_time,omitempty" toml:"argon2_time,omitempty"`
+	Argon2Threads uint8  `json:"argon2_threads,omitempty" toml:"argon2_threads,omitempty"`
+
+	// scrypt, default N=2^17, r=8, p=1
+	ScryptLogN uint8 `json:"scrypt_log_n,omitempty" toml:"scrypt_log_n,omitempty"`
+	ScryptR    int   `json:"scrypt_r,omitempty" toml:"scrypt_r,omitempty"`
+	ScryptP    int   `json:"scrypt_p,omitempty" toml:"scrypt_p,omitempty"`
+
+	// pbkdf2-sha256, default 600000
+	Pbkdf2Iter int `json:"pbkdf2_iter,omitempty" toml:"pbkdf2_iter,omitempty"`
+}
+
+func (it *PasswordHashConfig) fix() *PasswordHashConfig {
+	cfg := PasswordHashConfig{}
+	if it != nil {
+		cfg = *it
+	}
+	if cfg.Alg == "" {
+		cfg.Alg = PasswordAlgArgon2id
+	}
+	if cfg.Argon2Memory == 0 {
+		cfg.Argon2Memory = 19456
+	}
+	if cfg.Argon2Time == 0 {
+		cfg.Argon2Time = 2
+	}
+	if cfg.Argon2Threads == 0 {
+		cfg.Argon2Threads = 1
+	}
+	if cfg.ScryptLogN == 0 {
+		cfg.ScryptLogN = 17
+	}
+	if cfg.ScryptR == 0 {
+		cfg.ScryptR = 8
+	}
+	if cfg.ScryptP == 0 {
+		cfg.ScryptP = 1
+	}
+	if cfg.Pbkdf2Iter == 0 {
+		cfg.Pbkdf2Iter = 600000
+	}
+	return &cfg
+}
+
+// params returns the PHC parameters of alg.
+func (it *PasswordHashConfig) params() string {
+	switch it.Alg {
+	case PasswordAlgArgon2id:
+		return fmt.Sprintf("v=%d$m=%d,t=%d,p=%d",
+			argon2.Version, it.Argon2Memory, it.Argon2Time, it.Argon2Threads)
+	case PasswordAlgScrypt:
+		return fmt.Sprintf("ln=%d,r=%d,p=%d", it.ScryptLogN, it.ScryptR, it.ScryptP)
+	case PasswordAlgPbkdf2Sha256:
+		return fmt.Sprintf("i=%d", it.Pbkdf2Iter)
+	}
+	return ""
+}
+
+func (it *PasswordHashConfig) key(password, salt []byte) ([]byte, error) {
+	switch it.Alg {
+	case PasswordAlgArgon2id:
+		return argon2.IDKey(password, salt,
+			it.Argon2Time, it.Argon2Memory, it.Argon2Threads, passwordKeySize), nil
+	case PasswordAlgScrypt:
+		return scrypt.Key(password, salt, 1<<it.ScryptLogN, it.ScryptR, it.ScryptP, passwordKeySize)
+	case PasswordAlgPbkdf2Sha256:
+		return pbkdf2.Key(sha256.New, string(password), salt, it.Pbkdf2Iter, passwordKeySize)
+	}
+	return nil, errors.New("invalid password hash alg " + it.Alg)
+}
+
+// PasswordHash returns the PHC string of password hashed by cfg, a nil cfg
+// is the default argon2id.
+func PasswordHash(password string, cfg *PasswordHashConfig) (string, error) {
+	cfg = cfg.fix()
+	salt := randGen(passwordSaltSize)
+	key, err := cfg.key([]byte(password), salt)
+	if err != nil {
+		return "", err
+	}
+	return "$" + cfg.Alg + "$" + cfg.params() + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+// PasswordVerify checks password against the PHC string hash, rehash is set
+// if the hash was not created with the algorithm and parameters of cfg.
+func PasswordVerify(password, hash string, cfg *PasswordHashConfig) (ok bool, rehash bool, err error) {
+
+	hcfg, salt, key, err := passwordHashParse(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	key2, err := hcfg.key([]byte(password), salt)
+	if err != nil {
+		return false, false, err
+	}
+	if subtle.ConstantTimeCompare(key, key2) != 1 {
+		return false, false, nil
+	}
+
+	cfg = cfg.fix()
+	rehash = cfg.Alg != hcfg.Alg || cfg.params() != hcfg.params() ||
+		len(key) != passwordKeySize
+	return true, rehash, nil
+}
+
+func passwordHashParse(hash string) (*PasswordHashConfig, []byte, []byte, error) {
+
+	// $alg[$v=19]$params$salt$hash
+	fields := strings.Split(hash, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return nil, nil, nil, errors.New("invalid password hash")
+	}
+
+	cfg := &PasswordHashConfig{Alg: fields[1]}
+	params := fields[len(fields)-3]
+
+	var err error
+	switch cfg.Alg {
+	case PasswordAlgArgon2id:
+		var v int
+		if len(fields) != 6 {
+			err = errors.New("invalid password hash")
+		} else if _, err = fmt.Sscanf(fields[2], "v=%d", &v); err == nil && v != argon2.Version {
+			err = errors.New("invalid argon2 version")
+		} else if err == nil {
+			_, err = fmt.Sscanf(params, "m=%d,t=%d,p=%d",
+				&cfg.Argon2Memory, &cfg.Argon2Time, &cfg.Argon2Threads)
+		}
+	case PasswordAlgScrypt:
+		_, err = fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &cfg.ScryptLogN, &cfg.ScryptR, &cfg.ScryptP)
+	case PasswordAlgPbkdf2Sha256:
+		_, err = fmt.Sscanf(params, "i=%d", &cfg.Pbkdf2Iter)
+	default:
+		err = errors.New("invalid password hash alg " + cfg.Alg)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[len(fields)-1])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errors.New("invalid password hash")
+	}
+
+	return cfg, salt, key, nil
+}
+
+// PasswordPolicy is checked when a password is set.
+type PasswordPolicy struct {
+	MinLength int `json:"min_length,omitempty" toml:"min_length,omitempty"` // default 8
+	MaxLength int `json:"max_length,omitempty" toml:"max_length,omitempty"` // default 128
+
+	RequireUpper  bool `json:"require_upper,omitempty" toml:"require_upper,omitempty"`
+	RequireLower  bool `json:"require_lower,omitempty" toml:"require_lower,omitempty"`
+	RequireDigit  bool `json:"require_digit,omitempty" toml:"require_digit,omitempty"`
+	RequireSymbol bool `json:"require_symbol,omitempty" toml:"require_symbol,omitempty"`
+
+	// Denied passwords (case-insensitive), the user name is always denied.
+	Denied []string `json:"denied,omitempty" toml:"denied,omitempty"`
+}
+
+func (it *PasswordPolicy) Check(name, password string) error {
+
+	var (
+		p      = PasswordPolicy{}
+		n      = len([]rune(password))
+		counts = map[string]int{}
+	)
+	if it != nil {
+		p = *it
+	}
+	if p.MinLength <= 0 {
+		p.MinLength = 8
+	}
+	if p.MaxLength <= 0 {
+		p.MaxLength = 128
+	}
+
+	if n < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if n > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			counts["upper"]++
+		case unicode.IsLower(c):
+			counts["lower"]++
+		case unicode.IsDigit(c):
+			counts["digit"]++
+		default:
+			counts["symbol"]++
+		}
+	}
+	for k, required := range map[string]bool{
+		"upper":  p.RequireUpper,
+		"lower":  p.RequireLower,
+		"digit":  p.RequireDigit,
+		"symbol": p.RequireSymbol,
+	} {
+		if required && counts[k] == 0 {
+			return errors.New("password must contain a " + k + " character")
+		}
+	}
+
+	if strings.EqualFold(password, name) {
+		return errors.New("password must not be the user name")
+	}
+	for _, v := range p.Denied {
+		if strings.EqualFold(password, v) {
+			return errors.New("password is too common")
+		}
+	}
+
+	return nil
+}
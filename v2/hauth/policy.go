@@ -0,0 +1,569 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hooto/htoml4g/htoml"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+const (
+	PolicyEffectAllow = "allow"
+	PolicyEffectDeny  = "deny"
+)
+
+// PolicyDocument is a set of allow and deny statements, encoded in TOML or
+// JSON:
+//
+//	[[statements]]
+//	sid = "office-read"
+//	effect = "allow"
+//	actions = ["storage.object.get"]
+//	resources = ["bucket/*/**"]
+//
+//	[[statements.conditions]]
+//	op = "ip_in"
+//	key = "context.client_ip"
+//	values = ["10.0.0.0/8"]
+type PolicyDocument struct {
+	Name       string             `json:"name,omitempty" toml:"name,omitempty"`
+	Statements []*PolicyStatement `json:"statements" toml:"statements"`
+}
+
+type PolicyStatement struct {
+	Sid    string `json:"sid,omitempty" toml:"sid,omitempty"`
+	Effect string `json:"effect" toml:"effect"`
+
+	// Actions and Resources are patterns with "*" and "**" wildcard segments,
+	// the segments of the resources are delimited by slashes only.
+	Actions   []string `json:"actions" toml:"actions"`
+	Resources []string `json:"resources,omitempty" toml:"resources,omitempty"`
+
+	// Principals restrict the statement to user:<sub>, group:<name>,
+	// role:<id or name> or type:<App|User>, all principals if empty.
+	Principals []string `json:"principals,omitempty" toml:"principals,omitempty"`
+
+	// Conditions must all be true.
+	Conditions []*PolicyCondition `json:"conditions,omitempty" toml:"conditions,omitempty"`
+}
+
+// PolicyCondition tests the attribute Key of the request, a value of
+// ${key} is replaced by the values of the attribute key.
+//
+// The attributes are subject.{sub,groups,roles,type,scopes},
+// resource.{name,<attrs>}, action and context.{client_ip,<attrs>}. Other
+// keys are rejected, and a condition on a resource, context or client_ip
+// attribute missing in the request fails an allow statement and applies a
+// deny statement.
+//
+// The operators are string_equals, string_not_equals, string_like (glob),
+// ip_in, ip_not_in (CIDR), time_between (values are HH:MM, HH:MM and an
+// optional time zone) and weekday_in (Mon, Tue, ... and an optional time
+// zone), the time operators test the time of the request.
+type PolicyCondition struct {
+	Op     string   `json:"op" toml:"op"`
+	Key    string   `json:"key,omitempty" toml:"key,omitempty"`
+	Values []string `json:"values" toml:"values"`
+}
+
+// PolicyRequest is the request of PolicyEngine.Evaluate.
+type PolicyRequest struct {
+	Action   string
+	Resource string
+
+	// ResourceAttrs are the resource.<name> attributes, e.g. owner_group.
+	ResourceAttrs map[string]string
+
+	ClientIp string
+
+	// Context are the context.<name> attributes.
+	Context map[string]string
+
+	// Time of the request, the current time if zero.
+	Time time.Time
+}
+
+type PolicyDecision struct {
+	Allowed bool
+
+	// Effect of the deciding statement, empty if no statement applies.
+	Effect string
+
+	// Statement is the sid of the deciding statement.
+	Statement string
+
+	Reason string
+}
+
+// ParsePolicyDocument decodes a JSON or TOML document.
+func ParsePolicyDocument(bs []byte) (*PolicyDocument, error) {
+	var (
+		doc PolicyDocument
+		err error
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("{")) {
+		err = jsonDecode(bs, &doc)
+	} else {
+		err = htoml.Decode(bs, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+type policyStatement struct {
+	*PolicyStatement
+	actions    *hauth1.PermissionSet
+	resources  *hauth1.PermissionSet
+	conditions []*policyCondition
+}
+
+type policyCondition struct {
+	*PolicyCondition
+	prefixes []netip.Prefix
+	start    int // minutes of the day
+	end      int
+	loc      *time.Location
+	weekdays []time.Weekday
+}
+
+// PolicyEngine evaluates the compiled statements of the policy documents
+// with deny-overrides semantics: a matching deny statement wins over the
+// allow statements, and a request matched by no statement is denied.
+type PolicyEngine struct {
+	statements []*policyStatement
+	roles      *hauth1.RoleTable
+}
+
+// NewPolicyEngine creates a PolicyEngine of the *PolicyDocument items given
+// in args, the role names of the subjects are resolved by the
+// *hauth1.RoleTable given in args, or by RoleRegistry.
+func NewPolicyEngine(args ...any) (*PolicyEngine, error) {
+	it := &PolicyEngine{
+		roles: RoleRegistry,
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case *PolicyDocument:
+			doc := arg.(*PolicyDocument)
+			for i, st := range doc.Statements {
+				cs, err := policyStatementCompile(st)
+				if err != nil {
+					return nil, fmt.Errorf("policy %s statement %d (%s) : %s", doc.Name, i, st.Sid, err.Error())
+				}
+				it.statements = append(it.statements, cs)
+			}
+		case *hauth1.RoleTable:
+			it.roles = arg.(*hauth1.RoleTable)
+		}
+	}
+	return it, nil
+}
+
+func policyStatementCompile(st *PolicyStatement) (*policyStatement, error) {
+
+	if st.Effect != PolicyEffectAllow && st.Effect != PolicyEffectDeny {
+		return nil, errors.New("invalid effect " + st.Effect)
+	}
+	if len(st.Actions) == 0 {
+		return nil, errors.New("actions not set")
+	}
+
+	cs := &policyStatement{
+		PolicyStatement: st,
+		actions:         hauth1.NewPermissionSet(st.Actions...),
+	}
+	if len(st.Resources) > 0 {
+		cs.resources = hauth1.NewPathSet(st.Resources...)
+	}
+
+	for _, c := range st.Conditions {
+		cc := &policyCondition{PolicyCondition: c}
+		switch c.Op {
+
+		case "string_equals", "string_not_equals", "string_like", "ip_in", "ip_not_in":
+			if err := policyAttrValid(c.Key); err != nil {
+				return nil, err
+			}
+			for _, v := range c.Values {
+				if strings.HasPrefix(v, "${") && strings.HasSuffix(v, "}") {
+					if err := policyAttrValid(v[2 : len(v)-1]); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		switch c.Op {
+
+		case "string_equals", "string_not_equals", "string_like":
+
+		case "ip_in", "ip_not_in":
+			for _, v := range c.Values {
+				p, err := netip.ParsePrefix(v)
+				if err != nil {
+					return nil, err
+				}
+				cc.prefixes = append(cc.prefixes, p.Masked())
+			}
+
+		case "time_between":
+			if len(c.Values) < 2 {
+				return nil, errors.New("time_between requires start and end")
+			}
+			var err error
+			if cc.start, err = policyMinutes(c.Values[0]); err != nil {
+				return nil, err
+			}
+			if cc.end, err = policyMinutes(c.Values[1]); err != nil {
+				return nil, err
+			}
+			cc.loc = time.Local
+			if len(c.Values) > 2 {
+				if cc.loc, err = time.LoadLocation(c.Values[2]); err != nil {
+					return nil, err
+				}
+			}
+
+		case "weekday_in":
+			cc.loc = time.Local
+			for i, v := range c.Values {
+				day := slices.IndexFunc(policyWeekdays, func(d string) bool {
+					return strings.EqualFold(d, v)
+				})
+				if day >= 0 {
+					cc.weekdays = append(cc.weekdays, time.Weekday(day))
+					continue
+				}
+				// the optional time zone follows the weekdays
+				loc, err := time.LoadLocation(v)
+				if err != nil || i+1 != len(c.Values) {
+					return nil, errors.New("invalid weekday " + v)
+				}
+				cc.loc = loc
+			}
+
+		default:
+			return nil, errors.New("invalid condition op " + c.Op)
+		}
+		cs.conditions = append(cs.conditions, cc)
+	}
+
+	return cs, nil
+}
+
+var policyWeekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+var policyAttrKeys = []string{
+	"action",
+	"subject.sub", "subject.groups", "subject.roles", "subject.type", "subject.scopes",
+	"resource.name",
+	"context.client_ip",
+}
+
+// policyAttrValid checks if key is a known attribute, or a resource.<name>
+// or context.<name> attribute of the request.
+func policyAttrValid(key string) error {
+	if slices.Contains(policyAttrKeys, key) {
+		return nil
+	}
+	for _, prefix := range []string{"resource.", "context."} {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return nil
+		}
+	}
+	return errors.New("invalid condition key " + key)
+}
+
+func policyMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Evaluate decides the request of principal, an *IdentityToken, an
+// *hauth1.AppValidator or an *hauth1.Principal.
+func (it *PolicyEngine) Evaluate(principal any, req *PolicyRequest) *PolicyDecision {
+
+	attrs, err := policyAttrs(principal, req, it.roles)
+	if err != nil {
+		return &PolicyDecision{Reason: err.Error()}
+	}
+
+	tn := req.Time
+	if tn.IsZero() {
+		tn = time.Now()
+	}
+
+	var allow *policyStatement
+	for _, st := range it.statements {
+		if !st.match(attrs, req, tn) {
+			continue
+		}
+		if st.Effect == PolicyEffectDeny {
+			return &PolicyDecision{
+				Effect:    PolicyEffectDeny,
+				Statement: st.Sid,
+				Reason:    "denied by statement " + st.Sid,
+			}
+		}
+		if allow == nil {
+			allow = st
+		}
+	}
+
+	if allow == nil {
+		return &PolicyDecision{Reason: "no statement applies"}
+	}
+
+	return &PolicyDecision{
+		Allowed:   true,
+		Effect:    PolicyEffectAllow,
+		Statement: allow.Sid,
+		Reason:    "allowed by statement " + allow.Sid,
+	}
+}
+
+func (it *policyStatement) match(attrs map[string][]string, req *PolicyRequest, tn time.Time) bool {
+
+	if !it.actions.Match(req.Action) {
+		return false
+	}
+	if it.resources != nil && !it.resources.Match(req.Resource) {
+		return false
+	}
+
+	if len(it.Principals) > 0 && !slices.ContainsFunc(it.Principals, func(p string) bool {
+		n := strings.IndexByte(p, ':')
+		if p == "*" {
+			return true
+		} else if n < 1 {
+			return false
+		}
+		return slices.Contains(attrs["principal."+p[:n]], p[n+1:])
+	}) {
+		return false
+	}
+
+	// a condition on an attribute missing in the request never widens the
+	// access: it fails the allow statements and applies the deny ones
+	for _, c := range it.conditions {
+		if ok, found := c.eval(attrs, tn); !found {
+			return it.Effect == PolicyEffectDeny
+		} else if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// eval returns the result of the condition, and false if an attribute of
+// the condition is missing in the request.
+func (it *policyCondition) eval(attrs map[string][]string, tn time.Time) (bool, bool) {
+
+	switch it.Op {
+	case "time_between", "weekday_in":
+		return it.evalTime(tn), true
+	}
+
+	values, ok := attrs[it.Key]
+	if !ok {
+		return false, false
+	}
+
+	wants := []string{}
+	for _, v := range it.Values {
+		if strings.HasPrefix(v, "${") && strings.HasSuffix(v, "}") {
+			vs, ok := attrs[v[2:len(v)-1]]
+			if !ok {
+				return false, false
+			}
+			wants = append(wants, vs...)
+		} else {
+			wants = append(wants, v)
+		}
+	}
+
+	return it.evalValues(values, wants), true
+}
+
+func (it *policyCondition) evalValues(values, wants []string) bool {
+
+	switch it.Op {
+
+	case "string_equals":
+		return slices.ContainsFunc(values, func(v string) bool {
+			return slices.Contains(wants, v)
+		})
+
+	case "string_not_equals":
+		return !slices.ContainsFunc(values, func(v string) bool {
+			return slices.Contains(wants, v)
+		})
+
+	case "string_like":
+		return slices.ContainsFunc(values, func(v string) bool {
+			return slices.ContainsFunc(wants, func(w string) bool {
+				ok, _ := path.Match(w, v)
+				return ok
+			})
+		})
+
+	case "ip_in", "ip_not_in":
+		hit := slices.ContainsFunc(values, func(v string) bool {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return false
+			}
+			addr = addr.Unmap()
+			return slices.ContainsFunc(it.prefixes, func(p netip.Prefix) bool {
+				return p.Contains(addr)
+			})
+		})
+		return hit == (it.Op == "ip_in")
+	}
+
+	return false
+}
+
+func (it *policyCondition) evalTime(tn time.Time) bool {
+
+	switch it.Op {
+
+	case "time_between":
+		t := tn.In(it.loc)
+		m := t.Hour()*60 + t.Minute()
+		if it.start <= it.end {
+			return it.start <= m && m < it.end
+		}
+		return m >= it.start || m < it.end // over midnight
+
+	case "weekday_in":
+		return slices.Contains(it.weekdays, tn.In(it.loc).Weekday())
+	}
+
+	return false
+}
+
+// policyAttrs collects the attributes of the principal and the request.
+func policyAttrs(principal any, req *PolicyRequest, table *hauth1.RoleTable) (map[string][]string, error) {
+
+	attrs := map[string][]string{
+		"action":        {req.Action},
+		"resource.name": {req.Resource},
+	}
+	if req.ClientIp != "" {
+		attrs["context.client_ip"] = []string{req.ClientIp}
+	}
+	for k, v := range req.ResourceAttrs {
+		attrs["resource."+k] = append(attrs["resource."+k], v)
+	}
+	for k, v := range req.Context {
+		attrs["context."+k] = append(attrs["context."+k], v)
+	}
+
+	var p *hauth1.Principal
+
+	switch principal.(type) {
+
+	case *IdentityToken:
+		token := principal.(*IdentityToken)
+		if token.IsExpired() {
+			return nil, errors.New("token expired")
+		}
+		p = token.Principal()
+
+	case *hauth1.AppValidator:
+		p = principal.(*hauth1.AppValidator).Principal()
+
+	case *hauth1.Principal:
+		p = principal.(*hauth1.Principal)
+	}
+
+	if p == nil {
+		return nil, errors.New("invalid principal")
+	}
+
+	roles := slices.Clone(p.RoleNames)
+	for _, id := range p.Roles {
+		roles = append(roles, strconv.FormatUint(uint64(id), 10))
+		if r := table.RoleGet(id); r != nil {
+			roles = append(roles, r.Name)
+		}
+	}
+
+	attrs["subject.sub"] = []string{p.Id}
+	attrs["subject.type"] = []string{p.Type}
+	attrs["subject.groups"] = p.Groups
+	attrs["subject.roles"] = roles
+	attrs["subject.scopes"] = []string{}
+	for _, v := range p.Scopes {
+		attrs["subject.scopes"] = append(attrs["subject.scopes"], v.Name+":"+v.Value)
+	}
+
+	attrs["principal.user"] = attrs["subject.sub"]
+	attrs["principal.type"] = attrs["subject.type"]
+	attrs["principal.group"] = p.Groups
+	attrs["principal.role"] = roles
+
+	return attrs, nil
+}
+
+// Authorize checks the scopes of req (the values are matched exactly), and
+// evaluates its action and resource, see Evaluate. The Permission of the
+// Decision is the sid of the deciding statement.
+func (it *PolicyEngine) Authorize(req *hauth1.Request) *hauth1.Decision {
+
+	rs := &hauth1.Decision{}
+
+	if len(req.Scopes) > 0 {
+		if req.Principal == nil || len(req.Principal.Scopes) == 0 {
+			rs.Reasons = append(rs.Reasons, "scopes not found")
+			return rs
+		}
+		for _, scope := range req.Scopes {
+			v := scopeMatch(req.Principal.Scopes, scope)
+			if v == nil {
+				rs.Reasons = append(rs.Reasons, "scopes/"+scope.Name+"="+scope.Value+" not match")
+				return rs
+			}
+			rs.Scope = v
+			rs.Reasons = append(rs.Reasons, "scope "+v.Name+"="+v.Value+" allows "+scope.Value)
+		}
+	}
+
+	d := it.Evaluate(req.Principal, &PolicyRequest{
+		Action:   req.Action,
+		Resource: req.Resource,
+	})
+	rs.Allowed, rs.Permission = d.Allowed, d.Statement
+	rs.Reasons = append(rs.Reasons, d.Reason)
+	return rs
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"testing"
+	"time"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+const tPolicyDocument = `
+name = "storage"
+
+[[statements]]
+sid = "group-read"
+effect = "allow"
+actions = ["storage.object.get", "storage.object.list"]
+resources = ["bucket/**"]
+
+[[statements.conditions]]
+op = "string_equals"
+key = "resource.owner_group"
+values = ["${subject.groups}"]
+
+[[statements.conditions]]
+op = "ip_in"
+key = "context.client_ip"
+values = ["10.0.0.0/8"]
+
+[[statements]]
+sid = "office-hours-write"
+effect = "allow"
+actions = ["storage.object.*"]
+resources = ["bucket/*/**"]
+principals = ["role:writer"]
+
+[[statements.conditions]]
+op = "time_between"
+values = ["09:00", "18:00", "UTC"]
+
+[[statements]]
+sid = "no-secrets"
+effect = "deny"
+actions = ["storage.**"]
+resources = ["bucket/secrets/**"]
+principals = ["type:App", "user:guest"]
+`
+
+func Test_PolicyEngine(t *testing.T) {
+
+	doc, err := hauth2.ParsePolicyDocument([]byte(tPolicyDocument))
+	if err != nil {
+		t.Fatal("Failed on ParsePolicyDocument " + err.Error())
+	}
+
+	roles := hauth1.NewRoleTable()
+	roles.RoleSet(&hauth1.Role{Id: 300, Name: "writer"})
+
+	engine, err := hauth2.NewPolicyEngine(doc, roles)
+	if err != nil {
+		t.Fatal("Failed on NewPolicyEngine " + err.Error())
+	}
+
+	token := tSessionToken("guest")
+	token.Groups = []string{"ops"}
+	token.Roles = []uint32{300}
+
+	var (
+		noon  = time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+		night = time.Date(2026, 1, 5, 22, 0, 0, 0, time.UTC)
+	)
+
+	for i, v := range []struct {
+		req     *hauth2.PolicyRequest
+		allowed bool
+		sid     string
+	}{
+		{&hauth2.PolicyRequest{
+			Action: "storage.object.get", Resource: "bucket/a/1",
+			ResourceAttrs: map[string]string{"owner_group": "ops"},
+			ClientIp:      "10.1.2.3", Time: night,
+		}, true, "group-read"},
+		{&hauth2.PolicyRequest{
+			Action: "storage.object.get", Resource: "bucket/a/1",
+			ResourceAttrs: map[string]string{"owner_group": "dev"},
+			ClientIp:      "10.1.2.3", Time: night,
+		}, false, ""},
+		{&hauth2.PolicyRequest{
+			Action: "storage.object.get", Resource: "bucket/a/1",
+			ResourceAttrs: map[string]string{"owner_group": "ops"},
+			ClientIp:      "192.168.1.1", Time: night,
+		}, false, ""},
+		{&hauth2.PolicyRequest{
+			Action: "storage.object.put", Resource: "bucket/a/1", Time: noon,
+		}, true, "office-hours-write"},
+		{&hauth2.PolicyRequest{
+			Action: "storage.object.put", Resource: "bucket/a/1", Time: night,
+		}, false, ""},
+		{&hauth2.PolicyRequest{
+			Action: "storage.object.put", Resource: "bucket/secrets/1", Time: noon,
+		}, false, "no-secrets"},
+	} {
+		d := engine.Evaluate(&token, v.req)
+		if d.Allowed != v.allowed || d.Statement != v.sid {
+			t.Fatalf("Failed on Evaluate #%d : %v", i, d)
+		}
+	}
+
+	// app keys
+	av := &hauth1.AppValidator{Key: &hauth1.AccessKey{Id: "app-1", Roles: []string{"writer"}}}
+	if d := engine.Evaluate(av, &hauth2.PolicyRequest{
+		Action: "storage.object.put", Resource: "bucket/b/1", Time: noon,
+	}); !d.Allowed {
+		t.Fatal("Failed on Evaluate App " + d.Reason)
+	}
+	if d := engine.Evaluate(av, &hauth2.PolicyRequest{
+		Action: "storage.object.get", Resource: "bucket/secrets/1", Time: noon,
+	}); d.Allowed || d.Effect != hauth2.PolicyEffectDeny {
+		t.Fatal("Failed on Evaluate App deny")
+	}
+
+	// json documents
+	doc, err = hauth2.ParsePolicyDocument([]byte(`{"statements": [
+		{"sid": "weekday", "effect": "allow", "actions": ["a.b"],
+		 "conditions": [{"op": "weekday_in", "values": ["Sat", "Sun"]}]}]}`))
+	if err != nil {
+		t.Fatal("Failed on ParsePolicyDocument JSON " + err.Error())
+	}
+	if engine, err = hauth2.NewPolicyEngine(doc, roles); err != nil {
+		t.Fatal("Failed on NewPolicyEngine JSON " + err.Error())
+	}
+	sat := time.Date(2026, 1, 10, 12, 0, 0, 0, time.Local)
+	if d := engine.Evaluate(&token, &hauth2.PolicyRequest{Action: "a.b", Time: sat}); !d.Allowed {
+		t.Fatal("Failed on Evaluate weekday_in")
+	}
+	if d := engine.Evaluate(&token, &hauth2.PolicyRequest{Action: "a.b", Time: sat.AddDate(0, 0, 2)}); d.Allowed {
+		t.Fatal("Failed on Evaluate weekday_in")
+	}
+
+	// invalid documents
+	doc.Statements[0].Conditions[0].Op = "regex"
+	if _, err = hauth2.NewPolicyEngine(doc, roles); err == nil {
+		t.Fatal("Failed on NewPolicyEngine invalid op")
+	}
+	doc.Statements[0].Conditions[0] = &hauth2.PolicyCondition{
+		Op: "string_equals", Key: "subject.group", Values: []string{"ops"}}
+	if _, err = hauth2.NewPolicyEngine(doc, roles); err == nil {
+		t.Fatal("Failed on NewPolicyEngine invalid key")
+	}
+}
+
+func Test_PolicyEngine_Attributes(t *testing.T) {
+
+	doc, err := hauth2.ParsePolicyDocument([]byte(`{"statements": [
+		{"sid": "reports", "effect": "allow", "actions": ["get"], "resources": ["bucket/*"]},
+		{"sid": "office", "effect": "deny", "actions": ["get"],
+		 "conditions": [{"op": "ip_not_in", "key": "context.client_ip", "values": ["10.0.0.0/8"]}]},
+		{"sid": "weekend", "effect": "deny", "actions": ["get"],
+		 "conditions": [{"op": "weekday_in", "values": ["Sat", "Sun", "America/New_York"]}]},
+		{"sid": "classified", "effect": "deny", "actions": ["get"],
+		 "conditions": [{"op": "string_equals", "key": "resource.label", "values": ["secret"]}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := hauth2.NewPolicyEngine(doc, hauth1.NewRoleTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		token = tSessionToken("guest")
+		// Monday 03:00 UTC is Sunday in New York
+		sun = time.Date(2026, 1, 5, 3, 0, 0, 0, time.UTC)
+		mon = time.Date(2026, 1, 5, 15, 0, 0, 0, time.UTC)
+	)
+
+	for i, v := range []struct {
+		req *hauth2.PolicyRequest
+		sid string
+	}{
+		{&hauth2.PolicyRequest{Action: "get", Resource: "bucket/report.pdf", ClientIp: "10.0.0.1",
+			ResourceAttrs: map[string]string{"label": "public"}, Time: mon}, "reports"},
+		{&hauth2.PolicyRequest{Action: "get", Resource: "bucket/report.pdf", ClientIp: "10.0.0.1",
+			ResourceAttrs: map[string]string{"label": "public"}, Time: sun}, "weekend"},
+		// the missing attributes apply the deny statements
+		{&hauth2.PolicyRequest{Action: "get", Resource: "bucket/report.pdf",
+			ResourceAttrs: map[string]string{"label": "public"}, Time: mon}, "office"},
+		{&hauth2.PolicyRequest{Action: "get", Resource: "bucket/report.pdf", ClientIp: "10.0.0.1",
+			Time: mon}, "classified"},
+	} {
+		d := engine.Evaluate(&token, v.req)
+		if d.Statement != v.sid || d.Allowed != (v.sid == "reports") {
+			t.Fatalf("Failed on Evaluate #%d : %v", i, d)
+		}
+	}
+}
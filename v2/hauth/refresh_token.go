@@ -0,0 +1,164 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	refreshTokenTtl     int64 = userAppAuthTtlMax // seconds
+	refreshTokenUsedMax       = 32
+)
+
+// RefreshTokenFamily tracks the refresh tokens issued for one session.
+// Only the latest token (Hash) may be exchanged, every exchanged token is
+// kept in Used so that a replayed token can be detected and the whole
+// family (the session) revoked.
+type RefreshTokenFamily struct {
+	Hash string   `json:"hash"`
+	Used []string `json:"used,omitempty"`
+	Exp  int64    `json:"exp"` // absolute lifetime of the family, unix time in seconds
+}
+
+// IssueRefreshToken binds a new refresh token family to the session of
+// identityToken and returns its first refresh token. The session is
+// created if it does not exist yet.
+func (it *sessionTokenManager) IssueRefreshToken(
+	token IdentityToken, args ...any,
+) (string, error) {
+
+	if token.Jti == "" {
+		return "", errors.New("invalid token")
+	}
+
+	refreshToken, hash := newRefreshToken(token.Jti)
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	item := &SessionItem{
+		Token: &token,
+		Refresh: &RefreshTokenFamily{
+			Hash: hash,
+			Exp:  time.Now().Unix() + refreshTokenTtl,
+		},
+	}
+	if prev, _ := it.store.Get(token.Jti); prev != nil {
+		item.Token = prev.Token
+	}
+
+	if err := it.put(item, args); err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. Each refresh token is single-use, presenting one that
+// has already been exchanged revokes the session and all of its tokens.
+func (it *sessionTokenManager) RotateRefreshToken(refreshToken string) (*AuthLoginResponse, error) {
+
+	n := strings.IndexByte(refreshToken, '.')
+	if n < 1 {
+		return nil, errors.New("invalid refresh-token")
+	}
+
+	var (
+		jti  = refreshToken[:n]
+		hash = refreshTokenHash(refreshToken)
+		tn   = time.Now().Unix()
+	)
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	item, err := it.store.Get(jti)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil || item.Refresh == nil {
+		return nil, errors.New("refresh-token not found")
+	}
+
+	if item.Refresh.Hash != hash {
+		if slices.Contains(item.Refresh.Used, hash) {
+			it.revoke(jti)
+			return nil, errors.New("refresh-token reused, session revoked")
+		}
+		return nil, errors.New("refresh-token not found")
+	}
+
+	if item.Refresh.Exp <= tn {
+		it.revoke(jti)
+		return nil, errors.New("refresh-token expired")
+	}
+
+	ttl := item.Token.Exp - item.Token.Iat
+	if ttl < userAppAuthTtlMin {
+		ttl = userAppAuthTtlMin
+	} else if ttl > userAppAuthTtlMax {
+		ttl = userAppAuthTtlMax
+	}
+
+	token := *item.Token
+	token.Iat = tn
+	token.Exp = min(tn+ttl, item.Refresh.Exp, item.Created/1e3+it.cfg.MaxLifetime)
+
+	accessToken, err := it.sign(token)
+	if err != nil {
+		return nil, err
+	}
+
+	nextToken, nextHash := newRefreshToken(jti)
+
+	used := append(slices.Clone(item.Refresh.Used), hash)
+	if n = len(used); n > refreshTokenUsedMax {
+		used = used[n-refreshTokenUsedMax:]
+	}
+
+	err = it.put(&SessionItem{
+		Token: &token,
+		Refresh: &RefreshTokenFamily{
+			Hash: nextHash,
+			Used: used,
+			Exp:  item.Refresh.Exp,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthLoginResponse{
+		AccessToken:   accessToken,
+		RefreshToken:  nextToken,
+		IdentityToken: token,
+	}, nil
+}
+
+func newRefreshToken(jti string) (string, string) {
+	token := jti + "." + bytesEncode(randGen(32))
+	return token, refreshTokenHash(token)
+}
+
+func refreshTokenHash(token string) string {
+	hs := sha256.Sum256([]byte(token))
+	return bytesEncode(hs[:])
+}
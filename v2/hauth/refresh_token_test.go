@@ -0,0 +1,78 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_SessionTokenManager_RotateRefreshToken(t *testing.T) {
+
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+
+	var (
+		sessMgr = hauth2.NewSessionTokenManager(keyMgr)
+		tn      = time.Now().Unix()
+		token   = hauth2.IdentityToken{
+			Jti: uuid.NewString(),
+			Sub: "guest",
+			Iat: tn,
+			Exp: tn + 3600,
+		}
+	)
+
+	defer sessMgr.Close()
+
+	rt1, err := sessMgr.IssueRefreshToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := sessMgr.RotateRefreshToken(rt1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.AccessToken == "" || rs.RefreshToken == "" || rs.RefreshToken == rt1 {
+		t.Fatal("Failed on RotateRefreshToken")
+	}
+	if rs.IdentityToken.Sub != token.Sub {
+		t.Fatal("Failed on RotateRefreshToken")
+	}
+
+	if _, err = sessMgr.RotateRefreshToken(token.Jti + ".invalid"); err == nil {
+		t.Fatal("Failed on RotateRefreshToken (invalid)")
+	}
+	if sessMgr.Token(token.Jti) == nil {
+		t.Fatal("Failed on RotateRefreshToken (invalid token revoked session)")
+	}
+
+	// reuse of rt1 revokes the whole family
+	if _, err = sessMgr.RotateRefreshToken(rt1); err == nil {
+		t.Fatal("Failed on RotateRefreshToken (reuse)")
+	}
+	if sessMgr.Token(token.Jti) != nil {
+		t.Fatal("Failed on RotateRefreshToken (session not revoked)")
+	}
+	if _, err = sessMgr.RotateRefreshToken(rs.RefreshToken); err == nil {
+		t.Fatal("Failed on RotateRefreshToken (family not revoked)")
+	}
+}
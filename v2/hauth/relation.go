@@ -0,0 +1,578 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
+
+const (
+	RelationGroupNamespace = "group"
+	RelationGroupMember    = "member"
+
+	relationMaxDepth = 32
+)
+
+// RelationTuple is a relation between an object and a subject, written as
+// namespace:object_id#relation@subject, where the subject is a user
+// (user:alice) or the userset of an object relation (group:eng#member).
+type RelationTuple struct {
+	Object   string `json:"object" toml:"object"`
+	Relation string `json:"relation" toml:"relation"`
+	Subject  string `json:"subject" toml:"subject"`
+}
+
+func ParseRelationTuple(s string) (*RelationTuple, error) {
+	n := strings.IndexByte(s, '@')
+	if n < 0 {
+		return nil, errors.New("invalid relation tuple " + s)
+	}
+	object, subject := s[:n], s[n+1:]
+	n = strings.LastIndexByte(object, '#')
+	if n < 0 {
+		return nil, errors.New("invalid relation tuple " + s)
+	}
+	t := &RelationTuple{
+		Object:   object[:n],
+		Relation: object[n+1:],
+		Subject:  subject,
+	}
+	if err := t.Valid(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (it *RelationTuple) Valid() error {
+	if strings.IndexByte(it.Object, ':') < 1 {
+		return errors.New("invalid relation object " + it.Object)
+	}
+	if it.Relation == "" {
+		return errors.New("relation not set")
+	}
+	if it.Subject == "" {
+		return errors.New("relation subject not set")
+	}
+	return nil
+}
+
+func (it *RelationTuple) String() string {
+	return it.Object + "#" + it.Relation + "@" + it.Subject
+}
+
+// RelationNamespace configures the relations of the objects in a namespace.
+//
+//	name = "doc"
+//
+//	[[relations]]
+//	name = "owner"
+//
+//	[[relations]]
+//	name = "viewer"
+//	union = [
+//		{ this = true },
+//		{ computed_userset = "owner" },
+//		{ tuple_to_userset = { tupleset = "parent", computed_userset = "viewer" } },
+//	]
+type RelationNamespace struct {
+	Name      string            `json:"name" toml:"name"`
+	Relations []*RelationConfig `json:"relations" toml:"relations"`
+}
+
+// RelationConfig defines a relation as the union of its usersets, only the
+// tuples written for the relation if Union is empty.
+type RelationConfig struct {
+	Name  string             `json:"name" toml:"name"`
+	Union []*RelationUserset `json:"union,omitempty" toml:"union,omitempty"`
+}
+
+type RelationUserset struct {
+	// This is the set of subjects of the tuples written for the relation.
+	This bool `json:"this,omitempty" toml:"this,omitempty"`
+
+	// ComputedUserset is another relation of the same object.
+	ComputedUserset string `json:"computed_userset,omitempty" toml:"computed_userset,omitempty"`
+
+	// TupleToUserset follows the tuples of the Tupleset relation to their
+	// subject objects, and the ComputedUserset relation of these objects.
+	TupleToUserset *RelationTupleToUserset `json:"tuple_to_userset,omitempty" toml:"tuple_to_userset,omitempty"`
+}
+
+type RelationTupleToUserset struct {
+	Tupleset        string `json:"tupleset" toml:"tupleset"`
+	ComputedUserset string `json:"computed_userset" toml:"computed_userset"`
+}
+
+// RelationStore stores the relation tuples, TupleList returns the tuples of
+// the object relation.
+type RelationStore interface {
+	TupleWrite(tuples ...*RelationTuple) error
+	TupleDelete(tuples ...*RelationTuple) error
+	TupleList(object, relation string) ([]*RelationTuple, error)
+}
+
+// memoryRelationStore is the embedded RelationStore, all tuples are kept in
+// memory and written to a JSON file on each change if path is set.
+type memoryRelationStore struct {
+	mu    sync.RWMutex
+	path  string
+	items map[string][]string // object#relation: subjects
+}
+
+func NewMemoryRelationStore() RelationStore {
+	return &memoryRelationStore{
+		items: map[string][]string{},
+	}
+}
+
+func NewFileRelationStore(path string) (RelationStore, error) {
+
+	it := &memoryRelationStore{
+		path:  filepath.Clean(path),
+		items: map[string][]string{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(it.path), 0700); err != nil {
+		return nil, err
+	}
+
+	bs, err := os.ReadFile(it.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		var tuples []*RelationTuple
+		if err = jsonDecode(bs, &tuples); err != nil {
+			return nil, err
+		}
+		for _, t := range tuples {
+			it.set(t)
+		}
+	}
+
+	return it, nil
+}
+
+func (it *memoryRelationStore) set(t *RelationTuple) bool {
+	key := t.Object + "#" + t.Relation
+	if slices.Contains(it.items[key], t.Subject) {
+		return false
+	}
+	it.items[key] = append(it.items[key], t.Subject)
+	return true
+}
+
+func (it *memoryRelationStore) del(t *RelationTuple) bool {
+	key := t.Object + "#" + t.Relation
+	n := slices.Index(it.items[key], t.Subject)
+	if n < 0 {
+		return false
+	}
+	if it.items[key] = slices.Delete(it.items[key], n, n+1); len(it.items[key]) == 0 {
+		delete(it.items, key)
+	}
+	return true
+}
+
+func (it *memoryRelationStore) TupleWrite(tuples ...*RelationTuple) error {
+	for _, t := range tuples {
+		if err := t.Valid(); err != nil {
+			return err
+		}
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	var done []*RelationTuple
+	for _, t := range tuples {
+		if it.set(t) {
+			done = append(done, t)
+		}
+	}
+	if err := it.flush(); err != nil {
+		for _, t := range done {
+			it.del(t)
+		}
+		return err
+	}
+	return nil
+}
+
+func (it *memoryRelationStore) TupleDelete(tuples ...*RelationTuple) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	var done []*RelationTuple
+	for _, t := range tuples {
+		if it.del(t) {
+			done = append(done, t)
+		}
+	}
+	if err := it.flush(); err != nil {
+		for _, t := range done {
+			it.set(t)
+		}
+		return err
+	}
+	return nil
+}
+
+func (it *memoryRelationStore) TupleList(object, relation string) ([]*RelationTuple, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	subjects := it.items[object+"#"+relation]
+	ls := make([]*RelationTuple, 0, len(subjects))
+	for _, s := range subjects {
+		ls = append(ls, &RelationTuple{
+			Object:   object,
+			Relation: relation,
+			Subject:  s,
+		})
+	}
+	return ls, nil
+}
+
+func (it *memoryRelationStore) flush() error {
+	if it.path == "" {
+		return nil
+	}
+	ls := []*RelationTuple{}
+	for key, subjects := range it.items {
+		n := strings.LastIndexByte(key, '#')
+		for _, s := range subjects {
+			ls = append(ls, &RelationTuple{
+				Object:   key[:n],
+				Relation: key[n+1:],
+				Subject:  s,
+			})
+		}
+	}
+	return fileWriteAtomic(it.path, jsonEncode(ls))
+}
+
+// RelationTree is the expanded userset of an object relation, the union of
+// the direct Subjects and of the Children usersets.
+type RelationTree struct {
+	Object   string          `json:"object"`
+	Relation string          `json:"relation"`
+	Subjects []string        `json:"subjects,omitempty"`
+	Children []*RelationTree `json:"children,omitempty"`
+}
+
+// RelationManager checks the relations of a RelationStore by the rewrite
+// rules of the namespaces. The relations of a namespace without config only
+// contain the subjects of their tuples.
+type RelationManager struct {
+	store      RelationStore
+	namespaces map[string]map[string]*RelationConfig
+}
+
+func NewRelationManager(store RelationStore, namespaces ...*RelationNamespace) (*RelationManager, error) {
+
+	if store == nil {
+		store = NewMemoryRelationStore()
+	}
+
+	it := &RelationManager{
+		store:      store,
+		namespaces: map[string]map[string]*RelationConfig{},
+	}
+
+	for _, ns := range namespaces {
+		if ns.Name == "" {
+			return nil, errors.New("namespace name not set")
+		}
+		rels := map[string]*RelationConfig{}
+		for _, rel := range ns.Relations {
+			rels[rel.Name] = rel
+		}
+		for _, rel := range ns.Relations {
+			for _, us := range rel.Union {
+				if us.ComputedUserset != "" && rels[us.ComputedUserset] == nil {
+					return nil, errors.New("namespace " + ns.Name + " relation " + us.ComputedUserset + " not found")
+				}
+				if us.TupleToUserset != nil && rels[us.TupleToUserset.Tupleset] == nil {
+					return nil, errors.New("namespace " + ns.Name + " relation " + us.TupleToUserset.Tupleset + " not found")
+				}
+			}
+		}
+		it.namespaces[ns.Name] = rels
+	}
+
+	return it, nil
+}
+
+func (it *RelationManager) Store() RelationStore {
+	return it.store
+}
+
+func (it *RelationManager) relation(object, relation string) (*RelationConfig, error) {
+	n := strings.IndexByte(object, ':')
+	if n < 1 {
+		return nil, errors.New("invalid relation object " + object)
+	}
+	rels, ok := it.namespaces[object[:n]]
+	if !ok {
+		return &RelationConfig{Name: relation}, nil
+	}
+	rel, ok := rels[relation]
+	if !ok {
+		return nil, errors.New("namespace " + object[:n] + " relation " + relation + " not found")
+	}
+	return rel, nil
+}
+
+func relationUnion(rel *RelationConfig) []*RelationUserset {
+	if len(rel.Union) == 0 {
+		return []*RelationUserset{{This: true}}
+	}
+	return rel.Union
+}
+
+// TupleWrite writes the tuples if their relations are defined.
+func (it *RelationManager) TupleWrite(tuples ...*RelationTuple) error {
+	for _, t := range tuples {
+		if err := t.Valid(); err != nil {
+			return err
+		}
+		if _, err := it.relation(t.Object, t.Relation); err != nil {
+			return err
+		}
+	}
+	return it.store.TupleWrite(tuples...)
+}
+
+func (it *RelationManager) TupleDelete(tuples ...*RelationTuple) error {
+	return it.store.TupleDelete(tuples...)
+}
+
+// Check checks if the tuple object#relation@subject is in the store, or
+// derived by the rewrite rules, e.g. Check("doc:1#viewer@user:alice").
+func (it *RelationManager) Check(tuple string) (bool, error) {
+	t, err := ParseRelationTuple(tuple)
+	if err != nil {
+		return false, err
+	}
+	return it.check(t.Object, t.Relation, t.Subject, 0, map[string]bool{})
+}
+
+// CheckIdentity checks if the subject user:<Sub>, or the userset
+// group:<name>#member of one of the Groups has the relation to object.
+func (it *RelationManager) CheckIdentity(token *IdentityToken, object, relation string) (bool, error) {
+
+	if token.IsExpired() {
+		return false, errors.New("token expired")
+	}
+
+	subject, err := it.checkPrincipal(token.Principal(), object, relation)
+	return subject != "", err
+}
+
+// Authorize checks if the principal has the relation Action to the object
+// Resource, see CheckIdentity.
+func (it *RelationManager) Authorize(req *hauth1.Request) *hauth1.Decision {
+
+	if req.Principal == nil {
+		return &hauth1.Decision{Reasons: []string{"principal not found"}}
+	}
+
+	subject, err := it.checkPrincipal(req.Principal, req.Resource, req.Action)
+	if err != nil {
+		return &hauth1.Decision{Reasons: []string{err.Error()}}
+	}
+	if subject == "" {
+		return &hauth1.Decision{Reasons: []string{
+			"relation " + req.Resource + "#" + req.Action + " not found"}}
+	}
+
+	return &hauth1.Decision{
+		Allowed: true,
+		Reasons: []string{"relation " + req.Resource + "#" + req.Action + "@" + subject},
+	}
+}
+
+// checkPrincipal returns the subject of the principal having the relation.
+func (it *RelationManager) checkPrincipal(p *hauth1.Principal, object, relation string) (string, error) {
+
+	subjects := []string{"user:" + p.Id}
+	for _, g := range p.Groups {
+		subjects = append(subjects, RelationGroupNamespace+":"+g+"#"+RelationGroupMember)
+	}
+
+	var lastErr error
+	for _, s := range subjects {
+		if ok, err := it.check(object, relation, s, 0, map[string]bool{}); err != nil {
+			lastErr = err
+		} else if ok {
+			return s, nil
+		}
+	}
+
+	return "", lastErr
+}
+
+// check walks the usersets of object#relation, visited holds the usersets
+// walked by the query, a cycle or a repeated branch is not walked again.
+func (it *RelationManager) check(object, relation, subject string, depth int, visited map[string]bool) (bool, error) {
+
+	if depth > relationMaxDepth {
+		return false, errors.New("relation max depth exceeded")
+	}
+
+	key := object + "#" + relation
+	if visited[key] {
+		return false, nil
+	}
+	visited[key] = true
+
+	if key == subject {
+		return true, nil
+	}
+
+	rel, err := it.relation(object, relation)
+	if err != nil {
+		return false, err
+	}
+
+	for _, us := range relationUnion(rel) {
+
+		if us.This {
+			tuples, err := it.store.TupleList(object, relation)
+			if err != nil {
+				return false, err
+			}
+			for _, t := range tuples {
+				if t.Subject == subject {
+					return true, nil
+				}
+			}
+			for _, t := range tuples {
+				if n := strings.LastIndexByte(t.Subject, '#'); n > 0 {
+					if ok, err := it.check(t.Subject[:n], t.Subject[n+1:], subject, depth+1, visited); ok || err != nil {
+						return ok, err
+					}
+				}
+			}
+		}
+
+		if us.ComputedUserset != "" {
+			if ok, err := it.check(object, us.ComputedUserset, subject, depth+1, visited); ok || err != nil {
+				return ok, err
+			}
+		}
+
+		if ttu := us.TupleToUserset; ttu != nil {
+			tuples, err := it.store.TupleList(object, ttu.Tupleset)
+			if err != nil {
+				return false, err
+			}
+			for _, t := range tuples {
+				if ok, err := it.check(relationSubjectObject(t.Subject), ttu.ComputedUserset, subject, depth+1, visited); ok || err != nil {
+					return ok, err
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func relationSubjectObject(subject string) string {
+	if n := strings.LastIndexByte(subject, '#'); n > 0 {
+		return subject[:n]
+	}
+	return subject
+}
+
+// Expand returns the userset tree of the object relation.
+func (it *RelationManager) Expand(object, relation string) (*RelationTree, error) {
+	return it.expand(object, relation, 0, map[string]bool{})
+}
+
+// expand returns the tree of object#relation, a userset expanded before by
+// the query is returned without its subjects and children.
+func (it *RelationManager) expand(object, relation string, depth int, visited map[string]bool) (*RelationTree, error) {
+
+	if depth > relationMaxDepth {
+		return nil, errors.New("relation max depth exceeded")
+	}
+
+	if visited[object+"#"+relation] {
+		return &RelationTree{Object: object, Relation: relation}, nil
+	}
+	visited[object+"#"+relation] = true
+
+	rel, err := it.relation(object, relation)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &RelationTree{
+		Object:   object,
+		Relation: relation,
+	}
+
+	add := func(object, relation string) error {
+		child, err := it.expand(object, relation, depth+1, visited)
+		if err == nil {
+			tree.Children = append(tree.Children, child)
+		}
+		return err
+	}
+
+	for _, us := range relationUnion(rel) {
+
+		if us.This {
+			tuples, err := it.store.TupleList(object, relation)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range tuples {
+				if n := strings.LastIndexByte(t.Subject, '#'); n > 0 {
+					if err = add(t.Subject[:n], t.Subject[n+1:]); err != nil {
+						return nil, err
+					}
+				} else {
+					tree.Subjects = append(tree.Subjects, t.Subject)
+				}
+			}
+		}
+
+		if us.ComputedUserset != "" {
+			if err = add(object, us.ComputedUserset); err != nil {
+				return nil, err
+			}
+		}
+
+		if ttu := us.TupleToUserset; ttu != nil {
+			tuples, err := it.store.TupleList(object, ttu.Tupleset)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range tuples {
+				if err = add(relationSubjectObject(t.Subject), ttu.ComputedUserset); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return tree, nil
+}
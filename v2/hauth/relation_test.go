@@ -0,0 +1,155 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_RelationManager(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "relations.json")
+
+	store, err := hauth2.NewFileRelationStore(path)
+	if err != nil {
+		t.Fatal("Failed on NewFileRelationStore " + err.Error())
+	}
+
+	namespaces := []*hauth2.RelationNamespace{
+		{
+			Name: "folder",
+			Relations: []*hauth2.RelationConfig{
+				{Name: "viewer"},
+			},
+		},
+		{
+			Name: "doc",
+			Relations: []*hauth2.RelationConfig{
+				{Name: "parent"},
+				{Name: "editor"},
+				{Name: "viewer", Union: []*hauth2.RelationUserset{
+					{This: true},
+					{ComputedUserset: "editor"},
+					{TupleToUserset: &hauth2.RelationTupleToUserset{
+						Tupleset: "parent", ComputedUserset: "viewer",
+					}},
+				}},
+			},
+		},
+	}
+
+	mgr, err := hauth2.NewRelationManager(store, namespaces...)
+	if err != nil {
+		t.Fatal("Failed on NewRelationManager " + err.Error())
+	}
+
+	for _, s := range []string{
+		"doc:123#editor@user:alice",
+		"doc:123#parent@folder:f1",
+		"folder:f1#viewer@group:eng#member",
+		"group:eng#member@user:bob",
+		"group:eng#member@group:ops#member",
+	} {
+		tuple, err := hauth2.ParseRelationTuple(s)
+		if err != nil {
+			t.Fatal("Failed on ParseRelationTuple " + err.Error())
+		}
+		if tuple.String() != s {
+			t.Fatal("Failed on RelationTuple.String " + tuple.String())
+		}
+		if err = mgr.TupleWrite(tuple); err != nil {
+			t.Fatal("Failed on TupleWrite " + err.Error())
+		}
+	}
+
+	if err := mgr.TupleWrite(&hauth2.RelationTuple{
+		Object: "doc:123", Relation: "owner", Subject: "user:alice",
+	}); err == nil {
+		t.Fatal("Failed on TupleWrite undefined relation")
+	}
+
+	for s, want := range map[string]bool{
+		"doc:123#editor@user:alice":         true,
+		"doc:123#viewer@user:alice":         true,  // computed userset
+		"doc:123#viewer@user:bob":           true,  // tuple to userset, group member
+		"doc:123#viewer@group:ops#member":   true,  // nested group
+		"doc:123#editor@user:bob":           false, // viewer only
+		"doc:456#viewer@user:alice":         false,
+		"folder:f1#viewer@user:carol":       false,
+		"folder:f1#viewer@group:eng#member": true,
+	} {
+		if ok, err := mgr.Check(s); err != nil || ok != want {
+			t.Fatalf("Failed on Check %s : %v %v", s, ok, err)
+		}
+	}
+
+	// identity tokens
+	token := tSessionToken("carol")
+	if ok, _ := mgr.CheckIdentity(&token, "doc:123", "viewer"); ok {
+		t.Fatal("Failed on CheckIdentity")
+	}
+	token.Groups = []string{"ops"}
+	if ok, err := mgr.CheckIdentity(&token, "doc:123", "viewer"); !ok || err != nil {
+		t.Fatal("Failed on CheckIdentity Groups")
+	}
+
+	// expand
+	tree, err := mgr.Expand("doc:123", "viewer")
+	if err != nil || len(tree.Children) != 2 {
+		t.Fatal("Failed on Expand")
+	}
+	if !slices.Contains(tree.Children[0].Subjects, "user:alice") {
+		t.Fatal("Failed on Expand computed userset")
+	}
+	if g := tree.Children[1].Children[0]; g.Object != "group:eng" ||
+		!slices.Contains(g.Subjects, "user:bob") {
+		t.Fatal("Failed on Expand tuple to userset")
+	}
+
+	// file store
+	if err = mgr.TupleDelete(&hauth2.RelationTuple{
+		Object: "group:eng", Relation: "member", Subject: "user:bob",
+	}); err != nil {
+		t.Fatal("Failed on TupleDelete " + err.Error())
+	}
+	if store, err = hauth2.NewFileRelationStore(path); err != nil {
+		t.Fatal("Failed on NewFileRelationStore reload " + err.Error())
+	}
+	mgr, _ = hauth2.NewRelationManager(store, namespaces...)
+	if ok, _ := mgr.Check("doc:123#viewer@user:bob"); ok {
+		t.Fatal("Failed on Check after TupleDelete")
+	}
+	if ok, _ := mgr.Check("doc:123#viewer@user:alice"); !ok {
+		t.Fatal("Failed on Check after reload")
+	}
+
+	// cycles of nested groups
+	mgr.TupleWrite(&hauth2.RelationTuple{
+		Object: "group:ops", Relation: "member", Subject: "group:eng#member",
+	})
+	if ok, err := mgr.Check("doc:123#viewer@user:nobody"); ok || err != nil {
+		t.Fatalf("Failed on Check cycle : %v", err)
+	}
+	if ok, err := mgr.Check("doc:123#viewer@group:ops#member"); !ok || err != nil {
+		t.Fatalf("Failed on Check cycle : %v", err)
+	}
+	if _, err := mgr.Expand("doc:123", "viewer"); err != nil {
+		t.Fatal("Failed on Expand cycle " + err.Error())
+	}
+}
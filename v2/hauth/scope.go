@@ -14,7 +14,12 @@
 
 package hauth
 
-import hauth1 "github.com/hooto/hauth/go/hauth/v1"
+import (
+	"slices"
+	"strings"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+)
 
 func NewScopeFilter(name, value string) *hauth1.ScopeFilter {
 	return &hauth1.ScopeFilter{
@@ -23,14 +28,69 @@ func NewScopeFilter(name, value string) *hauth1.ScopeFilter {
 	}
 }
 
-func scopesAllow(scopes []*hauth1.ScopeFilter, scope *hauth1.ScopeFilter) bool {
+// ScopeFiltersString formats scopes as a space-delimited list of
+// "name:value" items, as used by the scope parameter of OAuth 2.0.
+func ScopeFiltersString(scopes []*hauth1.ScopeFilter) string {
+	ar := make([]string, 0, len(scopes))
 	for _, v := range scopes {
-		if scope.Name != v.Name {
-			continue
+		if v.Value == "" {
+			ar = append(ar, v.Name)
+		} else {
+			ar = append(ar, v.Name+":"+v.Value)
+		}
+	}
+	return strings.Join(ar, " ")
+}
+
+// ParseScopeFilters parses a list formatted by ScopeFiltersString.
+func ParseScopeFilters(s string) []*hauth1.ScopeFilter {
+	scopes := []*hauth1.ScopeFilter{}
+	for _, v := range strings.Fields(s) {
+		if n := strings.IndexByte(v, ':'); n > 0 {
+			scopes = append(scopes, NewScopeFilter(v[:n], v[n+1:]))
+		} else {
+			scopes = append(scopes, NewScopeFilter(v, ""))
 		}
-		if v.Value == "*" || v.Value == scope.Value {
-			return true
+	}
+	return scopes
+}
+
+// scopeMatch returns the scope of scopes allowing scope, unlike
+// hauth1.ScopeMatch the values of the tokens are matched exactly ("*"
+// allows all values).
+func scopeMatch(scopes []*hauth1.ScopeFilter, scope *hauth1.ScopeFilter) *hauth1.ScopeFilter {
+	for _, v := range scopes {
+		if v.Name == scope.Name && (v.Value == "*" || v.Value == scope.Value) {
+			return v
+		}
+	}
+	return nil
+}
+
+// scopesIntersect returns the requested scopes which are granted by the
+// allowed ones, a requested scope without a value (or "*") is narrowed to
+// all the allowed values of its name.
+func scopesIntersect(allowed, requested []*hauth1.ScopeFilter) []*hauth1.ScopeFilter {
+	scopes := []*hauth1.ScopeFilter{}
+	add := func(name, value string) {
+		if !slices.ContainsFunc(scopes, func(v *hauth1.ScopeFilter) bool {
+			return v.Name == name && v.Value == value
+		}) {
+			scopes = append(scopes, NewScopeFilter(name, value))
+		}
+	}
+	for _, req := range requested {
+		for _, v := range allowed {
+			if req.Name != v.Name {
+				continue
+			}
+			if req.Value == "" || req.Value == "*" {
+				add(v.Name, v.Value)
+			} else if v.Value == "*" || v.Value == req.Value {
+				add(req.Name, req.Value)
+				break
+			}
 		}
 	}
-	return false
+	return scopes
 }
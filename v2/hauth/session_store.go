@@ -0,0 +1,225 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionStore is the storage of the sessions of a SessionTokenManager.
+// Items are treated as immutable values, the manager puts a new item for
+// every update.
+type SessionStore interface {
+	// Get returns the item of id, or nil if not found.
+	Get(id string) (*SessionItem, error)
+	Put(item *SessionItem) error
+	Delete(id string) error
+	// Scan calls fn for each item until fn returns false, fn must not
+	// modify the store.
+	Scan(fn func(item *SessionItem) bool) error
+	// ExpireBefore deletes the items which expiry is before t (unix time in
+	// seconds) and returns the number of deleted items.
+	ExpireBefore(t int64) (int, error)
+	Close() error
+}
+
+type SessionItem struct {
+	Token   *IdentityToken      `json:"token"`
+	Refresh *RefreshTokenFamily `json:"refresh,omitempty"`
+
+	Created   int64  `json:"created,omitempty"`   // unix time in milliseconds
+	LastSeen  int64  `json:"last_seen,omitempty"` // unix time in milliseconds
+	ClientIp  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	KeyId     string `json:"key_id,omitempty"`
+}
+
+// Expiry returns the unix time (in seconds) after which the item can be
+// dropped, a session lives as long as its token or its refresh tokens.
+func (it *SessionItem) Expiry() int64 {
+	if it.Refresh != nil && it.Refresh.Exp > it.Token.Exp {
+		return it.Refresh.Exp
+	}
+	return it.Token.Exp
+}
+
+const (
+	memorySessionStoreShards = 32
+)
+
+// memorySessionStore is a sharded in-memory SessionStore, each shard is
+// guarded by its own lock. The number of items is counted over all shards,
+// if a maximum size is set the least recently used items of the shard being
+// written (then of the next shards) are evicted.
+type memorySessionStore struct {
+	shards [memorySessionStoreShards]*memorySessionShard
+	max    int64
+	size   atomic.Int64
+}
+
+type memorySessionShard struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // front is the most recently used
+}
+
+// NewMemorySessionStore creates a SessionStore which keeps at most maxSize
+// items (0 means unlimited), evicting the least recently used ones.
+func NewMemorySessionStore(maxSize int) SessionStore {
+	it := &memorySessionStore{
+		max: int64(max(0, maxSize)),
+	}
+	for i := range it.shards {
+		it.shards[i] = &memorySessionShard{
+			items: map[string]*list.Element{},
+			lru:   list.New(),
+		}
+	}
+	return it
+}
+
+func (it *memorySessionStore) shardIndex(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % memorySessionStoreShards)
+}
+
+func (it *memorySessionStore) shard(id string) *memorySessionShard {
+	return it.shards[it.shardIndex(id)]
+}
+
+func (it *memorySessionStore) Get(id string) (*SessionItem, error) {
+	s := it.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[id]; ok {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*SessionItem), nil
+	}
+	return nil, nil
+}
+
+func (it *memorySessionStore) Put(item *SessionItem) error {
+	idx := it.shardIndex(item.Token.Jti)
+	if !it.shards[idx].put(item) {
+		return nil
+	}
+	if n := it.size.Add(1); it.max > 0 && n > it.max {
+		for i := 0; i < memorySessionStoreShards; i++ {
+			over := it.size.Load() - it.max
+			if over <= 0 {
+				break
+			}
+			s := it.shards[(idx+i)%memorySessionStoreShards]
+			it.size.Add(-int64(s.evict(int(over), item.Token.Jti)))
+		}
+	}
+	return nil
+}
+
+// put stores the item and returns true if it is a new one.
+func (it *memorySessionShard) put(item *SessionItem) bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if elem, ok := it.items[item.Token.Jti]; ok {
+		elem.Value = item
+		it.lru.MoveToFront(elem)
+		return false
+	}
+	it.items[item.Token.Jti] = it.lru.PushFront(item)
+	return true
+}
+
+// evict removes at most n least recently used items, except the item of
+// keep, and returns the number of removed items.
+func (it *memorySessionShard) evict(n int, keep string) int {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	num := 0
+	for elem := it.lru.Back(); elem != nil && num < n; {
+		prev := elem.Prev()
+		if jti := elem.Value.(*SessionItem).Token.Jti; jti != keep {
+			it.lru.Remove(elem)
+			delete(it.items, jti)
+			num += 1
+		}
+		elem = prev
+	}
+	return num
+}
+
+func (it *memorySessionStore) Delete(id string) error {
+	s := it.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[id]; ok {
+		s.lru.Remove(elem)
+		delete(s.items, id)
+		it.size.Add(-1)
+	}
+	return nil
+}
+
+func (it *memorySessionStore) Scan(fn func(item *SessionItem) bool) error {
+	for _, s := range it.shards {
+		if !s.scan(fn) {
+			break
+		}
+	}
+	return nil
+}
+
+func (it *memorySessionShard) scan(fn func(item *SessionItem) bool) bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	for elem := it.lru.Front(); elem != nil; elem = elem.Next() {
+		if !fn(elem.Value.(*SessionItem)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (it *memorySessionStore) ExpireBefore(t int64) (int, error) {
+	n := 0
+	for _, s := range it.shards {
+		n += s.expireBefore(t)
+	}
+	it.size.Add(-int64(n))
+	return n, nil
+}
+
+func (it *memorySessionShard) expireBefore(t int64) int {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	n := 0
+	for elem := it.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if item := elem.Value.(*SessionItem); item.Expiry() <= t {
+			it.lru.Remove(elem)
+			delete(it.items, item.Token.Jti)
+			n += 1
+		}
+		elem = next
+	}
+	return n
+}
+
+func (it *memorySessionStore) Close() error {
+	return nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	fileSessionStoreCompactMin = 1024 // records
+)
+
+// fileSessionStore is an embedded SessionStore that keeps all items in
+// memory and appends every change to a log file. The log is replayed on
+// open and compacted once the stale records outnumber the live items.
+// Deletes are synced to disk so that a revoked session stays revoked, the
+// last puts may be lost on a system crash.
+type fileSessionStore struct {
+	mu      sync.RWMutex
+	path    string
+	fp      *os.File
+	items   map[string]*SessionItem
+	records int
+}
+
+type fileSessionRecord struct {
+	Op   string       `json:"op"`
+	Id   string       `json:"id,omitempty"`
+	Item *SessionItem `json:"item,omitempty"`
+}
+
+func NewFileSessionStore(path string) (SessionStore, error) {
+
+	it := &fileSessionStore{
+		path:  filepath.Clean(path),
+		items: map[string]*SessionItem{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(it.path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := it.replay(); err != nil {
+		return nil, err
+	}
+
+	fp, err := os.OpenFile(it.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	it.fp = fp
+
+	return it, nil
+}
+
+func (it *fileSessionStore) replay() error {
+
+	fp, err := os.OpenFile(it.path, os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+
+	var (
+		rd     = bufio.NewReader(fp)
+		offset int64
+	)
+
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// incomplete record of an interrupted write
+				return fp.Truncate(offset)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var rec fileSessionRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			// only the last record can be torn by an interrupted write
+			if _, err2 := rd.Peek(1); err2 == io.EOF {
+				return fp.Truncate(offset)
+			}
+			return fmt.Errorf("session log %s corrupted at offset %d : %s",
+				it.path, offset, err.Error())
+		}
+		offset += int64(len(line))
+		it.records += 1
+
+		switch rec.Op {
+		case "put":
+			if rec.Item != nil && rec.Item.Token != nil {
+				it.items[rec.Item.Token.Jti] = rec.Item
+			}
+		case "del":
+			delete(it.items, rec.Id)
+		}
+	}
+}
+
+func (it *fileSessionStore) Get(id string) (*SessionItem, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return it.items[id], nil
+}
+
+func (it *fileSessionStore) Put(item *SessionItem) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if err := it.write(&fileSessionRecord{Op: "put", Item: item}, false); err != nil {
+		return err
+	}
+	it.items[item.Token.Jti] = item
+	return it.compact(false)
+}
+
+func (it *fileSessionStore) Delete(id string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if _, ok := it.items[id]; !ok {
+		return nil
+	}
+	if err := it.write(&fileSessionRecord{Op: "del", Id: id}, true); err != nil {
+		return err
+	}
+	delete(it.items, id)
+	return it.compact(false)
+}
+
+func (it *fileSessionStore) Scan(fn func(item *SessionItem) bool) error {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	for _, item := range it.items {
+		if !fn(item) {
+			break
+		}
+	}
+	return nil
+}
+
+func (it *fileSessionStore) ExpireBefore(t int64) (int, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	var buf bytes.Buffer
+	n := 0
+	for k, item := range it.items {
+		if item.Expiry() <= t {
+			buf.Write(jsonEncode(&fileSessionRecord{Op: "del", Id: k}))
+			buf.WriteByte('\n')
+			n += 1
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := it.fp.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	for k, item := range it.items {
+		if item.Expiry() <= t {
+			delete(it.items, k)
+		}
+	}
+	it.records += n
+	return n, it.compact(false)
+}
+
+func (it *fileSessionStore) Close() error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.fp == nil {
+		return nil
+	}
+	err := it.compact(true)
+	if err2 := it.fp.Close(); err == nil {
+		err = err2
+	}
+	it.fp = nil
+	return err
+}
+
+// write appends rec to the log, and syncs the log to disk if sync is set.
+func (it *fileSessionStore) write(rec *fileSessionRecord, sync bool) error {
+	if it.fp == nil {
+		return errors.New("session store closed")
+	}
+	if _, err := it.fp.Write(append(jsonEncode(rec), '\n')); err != nil {
+		return err
+	}
+	it.records += 1
+	if sync {
+		return it.fp.Sync()
+	}
+	return nil
+}
+
+// compact rewrites the log with one record per live item, unless force is
+// set it only runs when the log has grown to twice the number of items.
+func (it *fileSessionStore) compact(force bool) error {
+
+	if !force && (it.records < fileSessionStoreCompactMin ||
+		it.records <= 2*len(it.items)) {
+		return nil
+	}
+
+	tmpPath := it.path + ".tmp"
+
+	fp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(fp)
+	for _, item := range it.items {
+		wr.Write(jsonEncode(&fileSessionRecord{Op: "put", Item: item}))
+		wr.WriteByte('\n')
+	}
+	if err = wr.Flush(); err == nil {
+		err = fp.Sync()
+	}
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, it.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	it.fp.Close()
+	if it.fp, err = os.OpenFile(it.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return err
+	}
+	it.records = len(it.items)
+
+	return nil
+}
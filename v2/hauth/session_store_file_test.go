@@ -0,0 +1,169 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_FileSessionStore(t *testing.T) {
+
+	var (
+		path = filepath.Join(t.TempDir(), "sessions.log")
+		tn   = time.Now().Unix()
+	)
+
+	store, err := hauth2.NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		store.Put(&hauth2.SessionItem{
+			Token: &hauth2.IdentityToken{
+				Jti: fmt.Sprintf("%04d", i%100),
+				Sub: fmt.Sprintf("user-%d", i),
+				Exp: tn + int64(i%100),
+			},
+		})
+	}
+	store.Delete("0099")
+
+	if n, _ := store.ExpireBefore(tn + 10); n != 11 {
+		t.Fatalf("Failed on ExpireBefore, deleted %d", n)
+	}
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err = hauth2.NewFileSessionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	n := 0
+	store.Scan(func(item *hauth2.SessionItem) bool {
+		n += 1
+		return true
+	})
+	if n != 88 {
+		t.Fatalf("Failed on replay, items %d", n)
+	}
+
+	if item, _ := store.Get("0098"); item == nil || item.Token.Sub != "user-2998" {
+		t.Fatal("Failed on replay")
+	}
+}
+
+func Test_FileSessionStore_Corrupted(t *testing.T) {
+
+	var (
+		dir  = t.TempDir()
+		put  = `{"op":"put","item":{"token":{"jti":"s1","sub":"guest","iat":0,"exp":0}}}` + "\n"
+		torn = `{"op":"put","item":{"token":{"jti":"s2"`
+	)
+
+	// a torn last record is dropped
+	path := filepath.Join(dir, "torn.log")
+	os.WriteFile(path, []byte(put+torn), 0600)
+
+	store, err := hauth2.NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if item, _ := store.Get("s1"); item == nil {
+		t.Fatal("Failed on replay of a torn log")
+	}
+	if bs, _ := os.ReadFile(path); string(bs) != put {
+		t.Fatalf("Failed on truncate of a torn log %q", bs)
+	}
+
+	// a corrupted record followed by others is an error
+	path = filepath.Join(dir, "corrupted.log")
+	os.WriteFile(path, []byte(put+torn+"\n"+put), 0600)
+
+	if _, err = hauth2.NewFileSessionStore(path); err == nil {
+		t.Fatal("Failed on replay of a corrupted log")
+	}
+	if bs, _ := os.ReadFile(path); string(bs) != put+torn+"\n"+put {
+		t.Fatal("Failed on replay of a corrupted log, log changed")
+	}
+}
+
+func Test_SessionTokenManager_FileSessionStore(t *testing.T) {
+
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+
+	var (
+		path  = filepath.Join(t.TempDir(), "sessions.log")
+		tn    = time.Now().Unix()
+		token = hauth2.IdentityToken{
+			Jti: uuid.NewString(),
+			Sub: "guest",
+			Iat: tn,
+			Exp: tn + 3600,
+		}
+	)
+
+	store, err := hauth2.NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, store)
+
+	refreshToken, err := sessMgr.IssueRefreshToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessMgr.Close()
+
+	// the store given by the caller is left open
+	if sessions := sessMgr.Sessions(token.Sub); len(sessions) != 1 {
+		t.Fatalf("Failed on Close, sessions %d", len(sessions))
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	if store, err = hauth2.NewFileSessionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	sessMgr = hauth2.NewSessionTokenManager(keyMgr, store)
+	defer sessMgr.Close()
+
+	if sessMgr.Token(token.Jti) == nil {
+		t.Fatal("Failed on restart")
+	}
+	if _, err = sessMgr.RotateRefreshToken(refreshToken); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_MemorySessionStore_LRU(t *testing.T) {
+
+	var (
+		store = hauth2.NewMemorySessionStore(64)
+		tn    = time.Now().Unix()
+	)
+
+	for i := 0; i < 1000; i++ {
+		store.Put(&hauth2.SessionItem{
+			Token: &hauth2.IdentityToken{
+				Jti: fmt.Sprintf("%d", i),
+				Exp: tn + int64(i),
+			},
+		})
+		// keep "0" in use
+		store.Get("0")
+	}
+
+	n := 0
+	store.Scan(func(item *hauth2.SessionItem) bool {
+		n += 1
+		return true
+	})
+	if n != 64 {
+		t.Fatalf("Failed on LRU, items %d", n)
+	}
+
+	if item, _ := store.Get("0"); item == nil {
+		t.Fatal("Failed on LRU, recently used item evicted")
+	}
+	if item, _ := store.Get("999"); item == nil {
+		t.Fatal("Failed on LRU, last item evicted")
+	}
+
+	if m, _ := store.ExpireBefore(tn + 1000); m != n {
+		t.Fatalf("Failed on ExpireBefore %d/%d", m, n)
+	}
+}
+
+func Test_MemorySessionStore_MaxSize(t *testing.T) {
+
+	// the limit is global, not per shard
+	for _, size := range []int{1, 3, 40} {
+		store := hauth2.NewMemorySessionStore(size)
+		for i := 0; i < 200; i++ {
+			store.Put(&hauth2.SessionItem{
+				Token: &hauth2.IdentityToken{
+					Jti: fmt.Sprintf("%d", i),
+				},
+			})
+		}
+		n := 0
+		store.Scan(func(item *hauth2.SessionItem) bool {
+			n += 1
+			return true
+		})
+		if n != size {
+			t.Fatalf("Failed on MaxSize %d, items %d", size, n)
+		}
+		if item, _ := store.Get("199"); item == nil {
+			t.Fatalf("Failed on MaxSize %d, last item evicted", size)
+		}
+	}
+}
+
+func Benchmark_MemorySessionStore_Get(b *testing.B) {
+
+	store := hauth2.NewMemorySessionStore(0)
+	for i := 0; i < 10000; i++ {
+		store.Put(&hauth2.SessionItem{
+			Token: &hauth2.IdentityToken{
+				Jti: fmt.Sprintf("%d", i),
+			},
+		})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			store.Get(fmt.Sprintf("%d", i%10000))
+			i += 1
+		}
+	})
+}
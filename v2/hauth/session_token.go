@@ -16,55 +16,425 @@ package hauth
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
 	hauth1 "github.com/hooto/hauth/go/hauth/v1"
 )
 
-func NewSessionTokenManager(keyMgr *hauth1.AccessKeyManager) SessionTokenManager {
-	return &sessionTokenManager{
+const (
+	sessionSweepInterval    int64 = 60 // seconds
+	sessionLastSeenInterval int64 = 60 // seconds
+)
+
+type SessionConfig struct {
+	// MaxSize limits the number of sessions kept by the default in-memory
+	// store, the least recently used sessions are evicted first. 0 means
+	// unlimited.
+	MaxSize int `json:"max_size,omitempty"`
+
+	// SweepInterval of the background janitor which drops the expired
+	// sessions, in seconds (default 60).
+	SweepInterval int64 `json:"sweep_interval,omitempty"`
+
+	// MaxPerSubject limits the number of sessions of one subject
+	// (IdentityToken.Sub), 0 means unlimited. A new session of a subject
+	// at the limit evicts its oldest session, or is rejected if
+	// RejectOverLimit is set.
+	MaxPerSubject   int  `json:"max_per_subject,omitempty"`
+	RejectOverLimit bool `json:"reject_over_limit,omitempty"`
+
+	// IdleTimeout ends a session which has not been active for the given
+	// number of seconds, 0 disables it. Activity, observed by Token, slides
+	// IdentityToken.Exp forward up to MaxLifetime seconds (default 30 days)
+	// after the session was created.
+	IdleTimeout int64 `json:"idle_timeout,omitempty"`
+	MaxLifetime int64 `json:"max_lifetime,omitempty"`
+}
+
+// SessionMeta describes the client of a session, it can be given in the
+// args of the SessionTokenManager methods which create or update sessions.
+type SessionMeta struct {
+	ClientIp  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	KeyId     string `json:"key_id,omitempty"`
+}
+
+// NewSessionTokenManager creates a SessionTokenManager, sessions are kept
+// in memory unless a SessionStore is given in args, a *SessionConfig can
+// be given to tune it. Access tokens are signed by the *hauth1.AccessKey
+// given in args, or by a key generated at creation, which is added to keyMgr.
+// The generated key is lost on restart, so is the validity of the access
+// tokens signed by it.
+// Close must be called to stop the background janitor, a given SessionStore
+// is left open and must be closed by the caller.
+func NewSessionTokenManager(
+	keyMgr *hauth1.AccessKeyManager,
+	args ...any,
+) SessionTokenManager {
+	it := &sessionTokenManager{
 		keyMgr: keyMgr,
-		items:  map[string]*IdentityToken{},
+		subs:   map[string]map[string]int64{},
+		closed: make(chan struct{}),
 	}
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+		switch arg.(type) {
+		case SessionStore:
+			it.store = arg.(SessionStore)
+		case *SessionConfig:
+			it.cfg = *arg.(*SessionConfig)
+		case *hauth1.AccessKey:
+			it.signKey = arg.(*hauth1.AccessKey)
+			keyMgr.KeySet(it.signKey)
+		}
+	}
+	if it.signKey == nil {
+		it.signKey = NewUserAccessKey()
+		it.signKeyAuto = true
+		keyMgr.KeySet(it.signKey)
+	}
+	if it.store == nil {
+		it.store = NewMemorySessionStore(it.cfg.MaxSize)
+		it.storeOwned = true
+	}
+	if it.cfg.SweepInterval <= 0 {
+		it.cfg.SweepInterval = sessionSweepInterval
+	}
+	if it.cfg.MaxLifetime <= 0 {
+		it.cfg.MaxLifetime = userAppAuthTtlMax
+	}
+	it.store.Scan(func(item *SessionItem) bool {
+		it.index(item)
+		return true
+	})
+	go it.janitor(time.Duration(it.cfg.SweepInterval) * time.Second)
+	return it
 }
 
 type sessionTokenManager struct {
-	mu      sync.RWMutex
-	keyMgr  *hauth1.AccessKeyManager
-	items   map[string]*IdentityToken
-	cleared int64
+	mu          sync.Mutex
+	keyMgr      *hauth1.AccessKeyManager
+	signKey     *hauth1.AccessKey
+	signKeyAuto bool // the sign key is generated by the manager
+	store       SessionStore
+	storeOwned  bool // the store is created by the manager
+	cfg         SessionConfig
+	subs        map[string]map[string]int64 // sub -> jti -> expiry
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func (it *sessionTokenManager) SignKeyId() string {
+	return it.signKey.Id
 }
 
 func (it *sessionTokenManager) Token(id string) *IdentityToken {
-	it.clear()
-	it.mu.RLock()
-	defer it.mu.RUnlock()
-	if token, ok := it.items[id]; ok {
-		return token
+	item, _ := it.store.Get(id)
+	if item == nil {
+		return nil
+	}
+	return it.touch(item)
+}
+
+// peek returns the live session id without recording its activity.
+func (it *sessionTokenManager) peek(id string) *SessionItem {
+	item, _ := it.store.Get(id)
+	if item == nil || it.idle(item, time.Now().UnixMilli()) {
+		return nil
+	}
+	return item
+}
+
+// sessionPeek returns the live session id of sessMgr without side effects
+// if sessMgr supports it, or by Token and Sessions otherwise.
+func sessionPeek(sessMgr SessionTokenManager, id string) *SessionItem {
+	if sm, ok := sessMgr.(*sessionTokenManager); ok {
+		return sm.peek(id)
+	}
+	if token := sessMgr.Token(id); token != nil {
+		for _, item := range sessMgr.Sessions(token.Sub) {
+			if item.Token.Jti == id {
+				return item
+			}
+		}
 	}
 	return nil
 }
 
-func (it *sessionTokenManager) RefreshToken(token IdentityToken) {
+// touch records the activity of a session in LastSeen. With an idle
+// timeout, the session is ended if it has been idle for too long or its
+// expiration is extended otherwise. The store is only written once per
+// tenth of the idle timeout, or once per minute without idle timeout.
+func (it *sessionTokenManager) touch(item *SessionItem) *IdentityToken {
+
+	var (
+		tn       = time.Now().UnixMilli()
+		timeout  = it.cfg.IdleTimeout * 1e3
+		interval = sessionLastSeenInterval * 1e3
+	)
+
+	if it.idle(item, tn) {
+		it.Revoke(item.Token.Jti)
+		return nil
+	}
+
+	if timeout > 0 {
+		interval = max(timeout/10, 1e3)
+	}
+	if tn-item.LastSeen < interval {
+		return item.Token
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if item, _ = it.store.Get(item.Token.Jti); item == nil {
+		return nil
+	}
+
+	var (
+		token = *item.Token
+		next  = *item
+	)
+
+	if timeout > 0 {
+		exp := min(tn/1e3+it.cfg.IdleTimeout, item.Created/1e3+it.cfg.MaxLifetime)
+		if exp > token.Exp {
+			token.Exp = exp
+		}
+	}
+
+	next.Token = &token
+	next.LastSeen = tn
+
+	if err := it.store.Put(&next); err != nil {
+		return item.Token
+	}
+	it.index(&next)
+
+	return &token
+}
+
+func (it *sessionTokenManager) RefreshToken(token IdentityToken, args ...any) error {
 	if token.Jti == "" {
-		return
+		return errors.New("invalid token")
 	}
 	it.mu.Lock()
 	defer it.mu.Unlock()
-	it.items[token.Jti] = &token
+	return it.put(&SessionItem{Token: &token}, args)
 }
 
-func (it *sessionTokenManager) ReSign(accessToken string, token IdentityToken) (string, error) {
+func (it *sessionTokenManager) ReSign(
+	accessToken string, token IdentityToken, args ...any,
+) (string, error) {
 	//
 	if token.Jti == "" {
 		return "", errors.New("invalid key")
 	}
 
-	ak := it.keyMgr.KeyRand()
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	token.Exp = min(token.Exp, it.expMax(token.Jti))
+
+	accessToken, err := it.sign(token)
+	if err != nil {
+		return "", err
+	}
+
+	if err := it.put(&SessionItem{Token: &token}, args); err != nil {
+		return "", err
+	}
+
+	return accessToken, nil
+}
+
+// Sessions returns the live sessions of the subject, oldest first.
+func (it *sessionTokenManager) Sessions(sub string) []*SessionItem {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.sessions(sub)
+}
+
+func (it *sessionTokenManager) Revoke(id string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.revoke(id)
+}
+
+// put stores a new copy of the session, a SessionItem is never modified once
+// it is stored. The refresh tokens and the metadata of the previous copy are
+// kept unless set in item or args.
+func (it *sessionTokenManager) put(item *SessionItem, args []any) error {
+
+	tn := time.Now().UnixMilli()
+
+	prev, err := it.store.Get(item.Token.Jti)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil || prev.Token.Sub != item.Token.Sub {
+		if err = it.admit(item.Token.Sub); err != nil {
+			return err
+		}
+	}
+
+	if prev != nil {
+		if item.Refresh == nil {
+			item.Refresh = prev.Refresh
+		}
+		item.Created = prev.Created
+		item.ClientIp = prev.ClientIp
+		item.UserAgent = prev.UserAgent
+		item.KeyId = prev.KeyId
+	} else {
+		item.Created = tn
+	}
+	item.LastSeen = tn
+
+	// the copies keep the items held by the store unchanged
+	if exp := item.Created/1e3 + it.cfg.MaxLifetime; item.Token.Exp > exp {
+		token := *item.Token
+		token.Exp = exp
+		item.Token = &token
+	}
+	if exp := item.Created/1e3 + it.cfg.MaxLifetime; item.Refresh != nil && item.Refresh.Exp > exp {
+		refresh := *item.Refresh
+		refresh.Exp = exp
+		item.Refresh = &refresh
+	}
+
+	for _, arg := range args {
+		switch arg.(type) {
+		case *SessionMeta:
+			if meta := arg.(*SessionMeta); meta != nil {
+				if meta.ClientIp != "" {
+					item.ClientIp = meta.ClientIp
+				}
+				if meta.UserAgent != "" {
+					item.UserAgent = meta.UserAgent
+				}
+				if meta.KeyId != "" {
+					item.KeyId = meta.KeyId
+				}
+			}
+		}
+	}
+
+	if err = it.store.Put(item); err != nil {
+		return err
+	}
+	if prev != nil && prev.Token.Sub != item.Token.Sub {
+		it.unindex(prev.Token.Sub, item.Token.Jti)
+	}
+	it.index(item)
+
+	return nil
+}
+
+// admit makes room for a new session of sub, or rejects it, according to
+// the MaxPerSubject limit.
+func (it *sessionTokenManager) admit(sub string) error {
+	if it.cfg.MaxPerSubject <= 0 || sub == "" {
+		return nil
+	}
+	items := it.sessions(sub)
+	if len(items) < it.cfg.MaxPerSubject {
+		return nil
+	}
+	if it.cfg.RejectOverLimit {
+		return errors.New("too many sessions of subject " + sub)
+	}
+	for _, item := range items[:len(items)-it.cfg.MaxPerSubject+1] {
+		if err := it.revoke(item.Token.Jti); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expMax returns the latest expiration of the session jti, MaxLifetime
+// seconds after it has been created.
+func (it *sessionTokenManager) expMax(jti string) int64 {
+	created := time.Now().UnixMilli()
+	if prev, _ := it.store.Get(jti); prev != nil {
+		created = prev.Created
+	}
+	return created/1e3 + it.cfg.MaxLifetime
+}
+
+// idle returns true if the session has not been active for IdleTimeout, tn
+// is the unix time in milliseconds.
+func (it *sessionTokenManager) idle(item *SessionItem, tn int64) bool {
+	return it.cfg.IdleTimeout > 0 && tn-item.LastSeen >= it.cfg.IdleTimeout*1e3
+}
+
+func (it *sessionTokenManager) sessions(sub string) []*SessionItem {
+	var (
+		tn    = time.Now().UnixMilli()
+		items = []*SessionItem{}
+	)
+	for jti := range it.subs[sub] {
+		// the index may refer to sessions evicted or expired in the store
+		item, _ := it.store.Get(jti)
+		if item == nil || item.Expiry() <= tn/1e3 {
+			it.unindex(sub, jti)
+			continue
+		}
+		if it.idle(item, tn) {
+			it.revoke(jti)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created < items[j].Created
+	})
+	return items
+}
+
+func (it *sessionTokenManager) revoke(id string) error {
+	item, err := it.store.Get(id)
+	if err != nil || item == nil {
+		return err
+	}
+	if err = it.store.Delete(id); err != nil {
+		return err
+	}
+	it.unindex(item.Token.Sub, id)
+	return nil
+}
+
+func (it *sessionTokenManager) index(item *SessionItem) {
+	if item.Token.Sub == "" {
+		return
+	}
+	ids, ok := it.subs[item.Token.Sub]
+	if !ok {
+		ids = map[string]int64{}
+		it.subs[item.Token.Sub] = ids
+	}
+	ids[item.Token.Jti] = item.Expiry()
+}
+
+func (it *sessionTokenManager) unindex(sub, jti string) {
+	if ids, ok := it.subs[sub]; ok {
+		delete(ids, jti)
+		if len(ids) == 0 {
+			delete(it.subs, sub)
+		}
+	}
+}
+
+func (it *sessionTokenManager) sign(token IdentityToken) (string, error) {
 
 	header := TokenHeader{
-		Kid: ak.Id,
+		Kid: it.signKey.Id,
 	}
 
 	claims := AccessTokenClaims{
@@ -73,38 +443,62 @@ func (it *sessionTokenManager) ReSign(accessToken string, token IdentityToken) (
 		Iat: token.Iat,
 		Exp: token.Exp,
 	}
-
-	accessToken, err := Sign(header, claims, []byte(ak.Secret))
-	if err != nil {
-		return "", err
+	if token.Type != "User" {
+		claims.Type = token.Type
 	}
 
-	it.mu.Lock()
-	defer it.mu.Unlock()
-
-	it.items[token.Jti] = &token
+	return Sign(header, claims, []byte(it.signKey.Secret))
+}
 
-	return accessToken, nil
+// Close stops the background janitor and closes the SessionStore created
+// by the manager.
+func (it *sessionTokenManager) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.closed)
+	})
+	if it.storeOwned {
+		return it.store.Close()
+	}
+	return nil
 }
 
-func (it *sessionTokenManager) clear() {
-	t := time.Now().Unix()
-	if (it.cleared + 600) > t {
-		return
+func (it *sessionTokenManager) janitor(interval time.Duration) {
+	tr := time.NewTicker(interval)
+	defer tr.Stop()
+	for {
+		select {
+		case <-it.closed:
+			return
+		case t := <-tr.C:
+			it.sweep(t.Unix())
+		}
 	}
+}
 
+func (it *sessionTokenManager) sweep(tn int64) {
+	it.store.ExpireBefore(tn)
 	it.mu.Lock()
 	defer it.mu.Unlock()
-
-	it.cleared = t
-	dels := []string{}
-
-	for k, v := range it.items {
-		if v.Exp <= t {
-			dels = append(dels, k)
+	if it.cfg.IdleTimeout > 0 {
+		idles := []string{}
+		it.store.Scan(func(item *SessionItem) bool {
+			if it.idle(item, tn*1e3) {
+				idles = append(idles, item.Token.Jti)
+			}
+			return true
+		})
+		for _, jti := range idles {
+			it.revoke(jti)
 		}
 	}
-	for _, k := range dels {
-		delete(it.items, k)
+	for sub, ids := range it.subs {
+		for jti, exp := range ids {
+			if exp <= tn {
+				delete(ids, jti)
+			}
+		}
+		if len(ids) == 0 {
+			delete(it.subs, sub)
+		}
 	}
 }
@@ -0,0 +1,288 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	hauth1 "github.com/hooto/hauth/go/hauth/v1"
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func tSessionToken(sub string) hauth2.IdentityToken {
+	tn := time.Now().Unix()
+	return hauth2.IdentityToken{
+		Jti: uuid.NewString(),
+		Sub: sub,
+		Iat: tn,
+		Exp: tn + 3600,
+	}
+}
+
+func Test_SessionTokenManager_MaxPerSubject(t *testing.T) {
+
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+
+	var (
+		store = hauth2.NewMemorySessionStore(0)
+		tn    = time.Now().UnixMilli()
+		t1    = tSessionToken("guest")
+		t2    = tSessionToken("guest")
+	)
+
+	// the sessions created and last seen two minutes ago
+	store.Put(&hauth2.SessionItem{
+		Token:     &t1,
+		Created:   tn - 120e3,
+		LastSeen:  tn - 120e3,
+		ClientIp:  "127.0.0.1",
+		UserAgent: "test",
+	})
+	store.Put(&hauth2.SessionItem{
+		Token:    &t2,
+		Created:  tn - 60e3,
+		LastSeen: tn - 60e3,
+	})
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, store, &hauth2.SessionConfig{
+		MaxPerSubject: 2,
+	})
+	defer sessMgr.Close()
+
+	sessMgr.RefreshToken(tSessionToken("staff"))
+
+	// the reads are recorded in LastSeen
+	if sessMgr.Token(t2.Jti) == nil {
+		t.Fatal("Failed on Token")
+	}
+
+	// updates of a session keep its metadata
+	sessMgr.RefreshToken(t1)
+
+	items := sessMgr.Sessions("guest")
+	if len(items) != 2 || items[0].Token.Jti != t1.Jti ||
+		items[0].ClientIp != "127.0.0.1" || items[0].Created != tn-120e3 {
+		t.Fatalf("Failed on Sessions %d", len(items))
+	}
+	if items[1].LastSeen < tn {
+		t.Fatal("Failed on Token LastSeen")
+	}
+
+	// evicts the oldest one
+	if err := sessMgr.RefreshToken(tSessionToken("guest")); err != nil {
+		t.Fatal(err)
+	}
+	if items = sessMgr.Sessions("guest"); len(items) != 2 {
+		t.Fatalf("Failed on MaxPerSubject %d", len(items))
+	}
+	if sessMgr.Token(t1.Jti) != nil {
+		t.Fatal("Failed on MaxPerSubject, oldest session not evicted")
+	}
+
+	if err := sessMgr.Revoke(items[0].Token.Jti); err != nil {
+		t.Fatal(err)
+	}
+	if items = sessMgr.Sessions("guest"); len(items) != 1 {
+		t.Fatalf("Failed on Revoke %d", len(items))
+	}
+
+	// a session moved to another subject leaves the index of the previous one
+	t3 := *items[0].Token
+	t3.Sub = "staff"
+	if err := sessMgr.RefreshToken(t3); err != nil {
+		t.Fatal(err)
+	}
+	if items = sessMgr.Sessions("guest"); len(items) != 0 {
+		t.Fatalf("Failed on Sessions after subject change %d", len(items))
+	}
+	if items = sessMgr.Sessions("staff"); len(items) != 2 {
+		t.Fatalf("Failed on Sessions after subject change %d", len(items))
+	}
+}
+
+func Test_SessionTokenManager_RejectOverLimit(t *testing.T) {
+
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, &hauth2.SessionConfig{
+		MaxPerSubject:   1,
+		RejectOverLimit: true,
+	})
+	defer sessMgr.Close()
+
+	if _, err := sessMgr.ReSign("", tSessionToken("guest")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessMgr.ReSign("", tSessionToken("guest")); err == nil {
+		t.Fatal("Failed on RejectOverLimit")
+	}
+}
+
+func Test_SessionTokenManager_IdleTimeout(t *testing.T) {
+
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, &hauth2.SessionConfig{
+		IdleTimeout: 2,
+	})
+	defer sessMgr.Close()
+
+	// start at a second boundary, the token times are in seconds
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	token := tSessionToken("guest")
+	token.Exp = token.Iat + 2
+
+	accessToken, err := sessMgr.ReSign("", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(hauth2.NewHttpSessionHandler(keyMgr, sessMgr,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sess := hauth2.AuthContextSession(r.Context()); sess == nil {
+				t.Error("Failed on AuthContextSession")
+			}
+		})))
+	defer srv.Close()
+
+	time.Sleep(11e8)
+
+	// the activity extends the session and renews the access token
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("x-hauth2") == "" {
+		t.Fatalf("Failed on renew, status %d", resp.StatusCode)
+	}
+	if sess := sessMgr.Token(token.Jti); sess == nil || sess.Exp <= token.Exp {
+		t.Fatal("Failed on IdleTimeout, session not extended")
+	}
+
+	time.Sleep(21e8)
+
+	if sessMgr.Token(token.Jti) != nil {
+		t.Fatal("Failed on IdleTimeout, idle session not ended")
+	}
+}
+
+func Test_SessionTokenManager_MaxLifetime(t *testing.T) {
+
+	keyMgr := hauth1.NewAccessKeyManager()
+	keyMgr.KeySet(hauth1.NewAccessKey())
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, &hauth2.SessionConfig{
+		MaxLifetime: 60,
+	})
+	defer sessMgr.Close()
+
+	token := tSessionToken("guest")
+	accessToken, err := sessMgr.ReSign("", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Unix() + 60
+	if at, err := hauth2.NewAccessToken(accessToken); err != nil || at.Claims.Exp > exp {
+		t.Fatal("Failed on ReSign MaxLifetime")
+	}
+
+	sessMgr.RefreshToken(token)
+	if sess := sessMgr.Token(token.Jti); sess == nil || sess.Exp > exp {
+		t.Fatal("Failed on RefreshToken MaxLifetime")
+	}
+
+	// a forged access token of the session is never handed back
+	forged := accessToken[:len(accessToken)-4] + "AAAA"
+	if renewed, err := sessMgr.ReSign(forged, token); err != nil || renewed == forged {
+		t.Fatal("Failed on ReSign, access token not re-signed")
+	}
+}
+
+func Test_SessionTokenManager_Forgery(t *testing.T) {
+
+	var (
+		keyMgr  = hauth1.NewAccessKeyManager()
+		userKey = hauth2.NewUserAccessKey()
+		signKey = hauth2.NewUserAccessKey()
+	)
+	keyMgr.KeySet(userKey)
+
+	sessMgr := hauth2.NewSessionTokenManager(keyMgr, signKey)
+	defer sessMgr.Close()
+
+	token := tSessionToken("guest")
+	accessToken, err := sessMgr.ReSign("", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(hauth2.NewHttpSessionHandler(keyMgr, sessMgr,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer srv.Close()
+
+	tStatus := func(accessToken string) int {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := tStatus(accessToken); status != http.StatusOK {
+		t.Fatalf("Failed on session token, status %d", status)
+	}
+
+	for _, v := range []struct {
+		key    *hauth1.AccessKey
+		claims hauth2.AccessTokenClaims
+	}{
+		// a key of keyMgr which is not the sign key of sessMgr
+		{userKey, hauth2.AccessTokenClaims{
+			Jti: token.Jti, Sub: token.Sub, Iat: token.Iat, Exp: token.Exp,
+		}},
+		// the subject of another session
+		{signKey, hauth2.AccessTokenClaims{
+			Jti: token.Jti, Sub: "admin", Iat: token.Iat, Exp: token.Exp,
+		}},
+		// the type of another session
+		{signKey, hauth2.AccessTokenClaims{
+			Jti: token.Jti, Sub: token.Sub, Iat: token.Iat, Exp: token.Exp, Type: "App",
+		}},
+	} {
+		forged, err := hauth2.Sign(hauth2.TokenHeader{Kid: v.key.Id}, v.claims, []byte(v.key.Secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := tStatus(forged); status != http.StatusUnauthorized {
+			t.Fatalf("Failed on forged token %s, status %d", v.claims.Sub, status)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
+	"math/big"
 	"sync"
 )
 
@@ -30,6 +31,12 @@ type Signer interface {
 	// Verify(signingString string, key any) error
 }
 
+// SignVerifier is implemented by the Signers which can verify a signature,
+// key is the public key of the asymmetric algorithms.
+type SignVerifier interface {
+	Verify(signingString string, sign []byte, key any) error
+}
+
 type SignerManager struct {
 	mu    sync.RWMutex
 	items map[string]Signer
@@ -125,6 +132,17 @@ func (it hmacSigner) Sign(signingString string, key any) ([]byte, error) {
 	return signBytes, nil
 }
 
+func (it hmacSigner) Verify(signingString string, sign []byte, key any) error {
+	bs, err := it.Sign(signingString, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(bs, sign) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
 type rsaSigner struct {
 	name string
 	hash crypto.Hash
@@ -152,6 +170,19 @@ func (it rsaSigner) Sign(signingString string, key any) ([]byte, error) {
 	return signBytes, nil
 }
 
+func (it rsaSigner) Verify(signingString string, sign []byte, key any) error {
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("invalid key (type:rsa)")
+	}
+
+	hasher := it.hash.New()
+	hasher.Write([]byte(signingString))
+
+	return rsa.VerifyPKCS1v15(rsaKey, it.hash, hasher.Sum(nil), sign)
+}
+
 type ecdsaSigner struct {
 	name      string
 	hash      crypto.Hash
@@ -194,3 +225,28 @@ func (it ecdsaSigner) Sign(signingString string, key any) ([]byte, error) {
 
 	return signBytes, nil
 }
+
+func (it ecdsaSigner) Verify(signingString string, sign []byte, key any) error {
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || ecdsaKey.Curve.Params().BitSize != it.curveBits {
+		return errors.New("invalid key (type:ecdsa)")
+	}
+
+	if len(sign) != 2*it.keySize {
+		return errors.New("invalid signature")
+	}
+
+	hasher := it.hash.New()
+	hasher.Write([]byte(signingString))
+
+	var (
+		r = new(big.Int).SetBytes(sign[:it.keySize])
+		s = new(big.Int).SetBytes(sign[it.keySize:])
+	)
+	if !ecdsa.Verify(ecdsaKey, hasher.Sum(nil), r, s) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
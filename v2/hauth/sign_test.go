@@ -93,6 +93,9 @@ func Test_Signer_Sign_ES256(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 	t.Logf("Signer_Sign_ES256 len %d", len(bs))
+	if err = es256.(hauth2.SignVerifier).Verify(signingString, bs, &privateKey.PublicKey); err != nil {
+		t.Fatal("Failed on Verify " + err.Error())
+	}
 }
 
 func Test_Signer_Sign_ES512(t *testing.T) {
@@ -102,4 +105,22 @@ func Test_Signer_Sign_ES512(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 	t.Logf("Signer_Sign_ES512 len %d", len(bs))
+	if err = es512.(hauth2.SignVerifier).Verify(signingString, bs, &privateKey.PublicKey); err != nil {
+		t.Fatal("Failed on Verify " + err.Error())
+	}
+}
+
+func Test_Signer_Verify_RS256(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bs, err := rs256.Sign(signingString, privateKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifier := rs256.(hauth2.SignVerifier)
+	if err = verifier.Verify(signingString, bs, &privateKey.PublicKey); err != nil {
+		t.Fatal("Failed on Verify " + err.Error())
+	}
+	if err = verifier.Verify(signingString+"x", bs, &privateKey.PublicKey); err == nil {
+		t.Fatal("Failed on Verify")
+	}
 }
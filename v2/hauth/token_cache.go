@@ -0,0 +1,141 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The lock is held for a login and a refresh at most, two calls of
+// identityAuthServiceTimeout, and is considered stale after that. The wait
+// outlasts the stale lock, so that a waiting process never rotates a token
+// concurrently with the holder.
+const (
+	authTokenCacheLockWait  = 40 * time.Second
+	authTokenCacheLockStale = 30 * time.Second
+)
+
+// AuthTokenCache keeps the tokens of an AuthConnector across process
+// restarts, it can be given in the args of NewAuthConnectorWithAccessKey.
+type AuthTokenCache interface {
+	Load() (*AuthTokenCacheItem, error)
+	Store(item *AuthTokenCacheItem) error
+	// Lock coordinates the logins of concurrent processes, it returns the
+	// function which releases the lock. The AuthConnector does not log in
+	// nor refresh if the lock is not acquired.
+	Lock() (func(), error)
+}
+
+type AuthTokenCacheItem struct {
+	KeyId         string         `json:"key_id"`
+	AccessToken   string         `json:"access_token"`
+	RefreshToken  string         `json:"refresh_token,omitempty"`
+	Exp           int64          `json:"exp"` // unix time in seconds
+	IdentityToken *IdentityToken `json:"identity_token,omitempty"`
+}
+
+type fileAuthTokenCache struct {
+	path string
+}
+
+// NewFileAuthTokenCache creates an AuthTokenCache stored in the file
+// <dir>/<profile>.json (mode 0600), dir defaults to the "hauth" directory
+// of the user cache directory.
+func NewFileAuthTokenCache(dir, profile string) (AuthTokenCache, error) {
+
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheDir, "hauth")
+	}
+
+	if profile == "" {
+		profile = "default"
+	} else if filepath.Base(profile) != profile {
+		return nil, errors.New("invalid profile name")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileAuthTokenCache{
+		path: filepath.Join(dir, profile+".json"),
+	}, nil
+}
+
+func (it *fileAuthTokenCache) Load() (*AuthTokenCacheItem, error) {
+	bs, err := os.ReadFile(it.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var item AuthTokenCacheItem
+	if err = jsonDecode(bs, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Store writes the item to a temporary file which is then renamed, so that
+// readers never see a partial write.
+func (it *fileAuthTokenCache) Store(item *AuthTokenCacheItem) error {
+	return fileWriteAtomic(it.path, jsonEncode(item))
+}
+
+// Lock creates the lock file <profile>.lock exclusively, a lock file older
+// than 30 seconds is considered left over by a crashed process.
+func (it *fileAuthTokenCache) Lock() (func(), error) {
+
+	var (
+		lockPath = it.path[:len(it.path)-len(".json")] + ".lock"
+		deadline = time.Now().Add(authTokenCacheLockWait)
+	)
+
+	for {
+		fp, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(fp, "%d", os.Getpid())
+			fp.Close()
+			return func() {
+				os.Remove(lockPath)
+			}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if st, err := os.Stat(lockPath); err == nil &&
+			time.Since(st.ModTime()) > authTokenCacheLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("token cache locked")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+func Test_FileAuthTokenCache(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(3600)
+		ak  = hauth2.NewUserAccessKey()
+		dir = t.TempDir()
+	)
+	defer srv.sessMgr.Close()
+
+	srv.keyMgr.KeySet(ak)
+
+	newConnector := func() hauth2.AuthConnector {
+		cache, err := hauth2.NewFileAuthTokenCache(dir, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hauth2.NewAuthConnectorWithAccessKey(ak, srv, cache)
+	}
+
+	ac := newConnector()
+	accessToken := ac.AccessToken()
+	ac.Close()
+
+	if accessToken == "" || srv.logins.Load() != 1 {
+		t.Fatal("Failed on login")
+	}
+
+	st, err := os.Stat(filepath.Join(dir, "test.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Fatalf("Failed on cache file mode %v", st.Mode().Perm())
+	}
+
+	// restart
+	ac = newConnector()
+	defer ac.Close()
+
+	if ac.AccessToken() != accessToken || srv.logins.Load() != 1 {
+		t.Fatal("Failed on cached token")
+	}
+	if ac.IdentityToken() == nil {
+		t.Fatal("Failed on cached IdentityToken")
+	}
+
+	// a token rejected by the server is not reused
+	ac.ResetAccessToken()
+	if ac.AccessToken() == accessToken || srv.logins.Load() != 2 {
+		t.Fatal("Failed on rejected cached token")
+	}
+}
+
+func Test_FileAuthTokenCache_SharedRefresh(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(31)
+		ak  = hauth2.NewUserAccessKey()
+		dir = t.TempDir()
+	)
+	defer srv.sessMgr.Close()
+
+	srv.keyMgr.KeySet(ak)
+
+	var errs atomic.Int32
+	newConnector := func() hauth2.AuthConnector {
+		cache, err := hauth2.NewFileAuthTokenCache(dir, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hauth2.NewAuthConnectorWithAccessKey(ak, srv, cache,
+			hauth2.AuthRefreshErrorHandler(func(err error) {
+				errs.Add(1)
+			}))
+	}
+
+	// two processes share the tokens of one login
+	ac1, ac2 := newConnector(), newConnector()
+	defer ac1.Close()
+	defer ac2.Close()
+
+	if ac1.AccessToken() == "" || ac2.AccessToken() == "" || srv.logins.Load() != 1 {
+		t.Fatal("Failed on shared login")
+	}
+
+	// both refresh 30 seconds before the token expires, only one of them
+	// rotates the refresh token
+	time.Sleep(25e8)
+
+	if srv.refreshs.Load() != 1 || srv.logins.Load() != 1 || errs.Load() > 0 {
+		t.Fatalf("Failed on shared refresh, refreshs %d, logins %d",
+			srv.refreshs.Load(), srv.logins.Load())
+	}
+	if ac1.AccessToken() != ac2.AccessToken() {
+		t.Fatal("Failed on shared refresh, tokens differ")
+	}
+}
+
+func Test_AuthConnector_CacheStoreError(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(3600)
+		ak  = hauth2.NewUserAccessKey()
+		dir = t.TempDir()
+	)
+	defer srv.sessMgr.Close()
+
+	srv.keyMgr.KeySet(ak)
+
+	cache, err := hauth2.NewFileAuthTokenCache(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cache file can not be replaced by a directory
+	os.Mkdir(filepath.Join(dir, "test.json"), 0700)
+	os.WriteFile(filepath.Join(dir, "test.json", "x"), []byte("x"), 0600)
+
+	var errs atomic.Int32
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak, srv, cache,
+		hauth2.AuthRefreshErrorHandler(func(err error) {
+			errs.Add(1)
+		}))
+	defer ac.Close()
+
+	if ac.AccessToken() == "" || errs.Load() == 0 {
+		t.Fatal("Failed on login with a cache store error")
+	}
+}
+
+type tLockedTokenCache struct {
+	hauth2.AuthTokenCache
+}
+
+func (it *tLockedTokenCache) Lock() (func(), error) {
+	return nil, errors.New("token cache locked")
+}
+
+func Test_AuthConnector_CacheLockError(t *testing.T) {
+
+	var (
+		srv = newIdentityAuthService(3600)
+		ak  = hauth2.NewUserAccessKey()
+	)
+	defer srv.sessMgr.Close()
+
+	srv.keyMgr.KeySet(ak)
+
+	cache, err := hauth2.NewFileAuthTokenCache(t.TempDir(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tokens are not rotated without the lock of the shared cache
+	ac := hauth2.NewAuthConnectorWithAccessKey(ak, srv, &tLockedTokenCache{cache})
+	defer ac.Close()
+
+	if ac.AccessToken() != "" || srv.logins.Load() != 0 {
+		t.Fatal("Failed on login without the cache lock")
+	}
+}
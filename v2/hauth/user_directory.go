@@ -0,0 +1,342 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrUserInvalidAuth = errors.New("invalid user name or password")
+)
+
+// UserEntry is a user of the UserDirectory, Name is the IdentityToken.Sub
+// of the user.
+type UserEntry struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Roles       []uint32 `json:"roles,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	Disabled    bool     `json:"disabled,omitempty"`
+
+	// PasswordHash is the PHC string of the password, see PasswordHash.
+	PasswordHash    string `json:"password_hash,omitempty"`
+	PasswordUpdated int64  `json:"password_updated,omitempty"`
+
+	Created int64 `json:"created"`
+	Updated int64 `json:"updated"`
+}
+
+func (it *UserEntry) clone() *UserEntry {
+	cp := *it
+	cp.Roles = slices.Clone(it.Roles)
+	cp.Groups = slices.Clone(it.Groups)
+	return &cp
+}
+
+// IdentityToken returns a new session of the user which expires in ttl
+// seconds.
+func (it *UserEntry) IdentityToken(ttl int64) *IdentityToken {
+	tn := time.Now().Unix()
+	return &IdentityToken{
+		Jti:    uuid.NewString(),
+		Sub:    it.Name,
+		Iat:    tn,
+		Exp:    tn + ttl,
+		Roles:  slices.Clone(it.Roles),
+		Groups: slices.Clone(it.Groups),
+		Type:   "User",
+	}
+}
+
+// UserDirectory stores the UserEntry items, UserGet returns nil if the user
+// is not found.
+type UserDirectory interface {
+	UserGet(name string) (*UserEntry, error)
+	UserSet(user *UserEntry) error
+	UserDel(name string) error
+	UserList() ([]*UserEntry, error)
+}
+
+// memoryUserDirectory is the embedded UserDirectory, all users are kept in
+// memory and written to a JSON file on each change if path is set.
+type memoryUserDirectory struct {
+	mu    sync.RWMutex
+	path  string
+	items map[string]*UserEntry
+}
+
+func NewMemoryUserDirectory() UserDirectory {
+	return &memoryUserDirectory{
+		items: map[string]*UserEntry{},
+	}
+}
+
+func NewFileUserDirectory(path string) (UserDirectory, error) {
+
+	it := &memoryUserDirectory{
+		path:  filepath.Clean(path),
+		items: map[string]*UserEntry{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(it.path), 0700); err != nil {
+		return nil, err
+	}
+
+	bs, err := os.ReadFile(it.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		var users []*UserEntry
+		if err = jsonDecode(bs, &users); err != nil {
+			return nil, err
+		}
+		for _, v := range users {
+			it.items[v.Name] = v
+		}
+	}
+
+	return it, nil
+}
+
+func (it *memoryUserDirectory) UserGet(name string) (*UserEntry, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if v, ok := it.items[name]; ok {
+		return v.clone(), nil
+	}
+	return nil, nil
+}
+
+func (it *memoryUserDirectory) UserSet(user *UserEntry) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	prev, ok := it.items[user.Name]
+	it.items[user.Name] = user.clone()
+	if err := it.flush(); err != nil {
+		if ok {
+			it.items[user.Name] = prev
+		} else {
+			delete(it.items, user.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (it *memoryUserDirectory) UserDel(name string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	prev, ok := it.items[name]
+	if !ok {
+		return nil
+	}
+	delete(it.items, name)
+	if err := it.flush(); err != nil {
+		it.items[name] = prev
+		return err
+	}
+	return nil
+}
+
+func (it *memoryUserDirectory) UserList() ([]*UserEntry, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	ls := make([]*UserEntry, 0, len(it.items))
+	for _, v := range it.items {
+		ls = append(ls, v.clone())
+	}
+	slices.SortFunc(ls, func(a, b *UserEntry) int {
+		if a.Name < b.Name {
+			return -1
+		} else if a.Name > b.Name {
+			return 1
+		}
+		return 0
+	})
+	return ls, nil
+}
+
+func (it *memoryUserDirectory) flush() error {
+	if it.path == "" {
+		return nil
+	}
+	ls := make([]*UserEntry, 0, len(it.items))
+	for _, v := range it.items {
+		ls = append(ls, v)
+	}
+	return fileWriteAtomic(it.path, jsonEncode(ls))
+}
+
+// UserManager authenticates the users of a UserDirectory by password.
+//
+// An IdentityAuthService issues the sessions of the authenticated users:
+//
+//	user, err := userMgr.Authenticate(req.Name, req.Password)
+//	if err != nil {
+//		return nil, err
+//	}
+//	sess := user.IdentityToken(ttl)
+//	accessToken, err := sessMgr.ReSign("", *sess)
+type UserManager struct {
+	mu     sync.Mutex
+	dir    UserDirectory
+	hash   *PasswordHashConfig
+	policy *PasswordPolicy
+	dummy  string
+}
+
+// NewUserManager creates a UserManager, optional args are a UserDirectory
+// (the default is in-memory), a *PasswordHashConfig and a *PasswordPolicy.
+func NewUserManager(args ...any) *UserManager {
+	it := &UserManager{}
+	for _, arg := range args {
+		switch arg.(type) {
+		case UserDirectory:
+			it.dir = arg.(UserDirectory)
+		case *PasswordHashConfig:
+			it.hash = arg.(*PasswordHashConfig).fix()
+		case *PasswordPolicy:
+			it.policy = arg.(*PasswordPolicy)
+		}
+	}
+	if it.dir == nil {
+		it.dir = NewMemoryUserDirectory()
+	}
+	if it.hash == nil {
+		it.hash = (&PasswordHashConfig{}).fix()
+	}
+	// verified for unknown users, so that they take as long as known ones
+	it.dummy, _ = PasswordHash(uuid.NewString(), it.hash)
+	return it
+}
+
+func (it *UserManager) Directory() UserDirectory {
+	return it.dir
+}
+
+// UserCreate adds a new user with password.
+func (it *UserManager) UserCreate(user *UserEntry, password string) error {
+
+	if user == nil || user.Name == "" {
+		return errors.New("user name not set")
+	}
+
+	if err := it.policy.Check(user.Name, password); err != nil {
+		return err
+	}
+
+	hash, err := PasswordHash(password, it.hash)
+	if err != nil {
+		return err
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if prev, err := it.dir.UserGet(user.Name); err != nil {
+		return err
+	} else if prev != nil {
+		return errors.New("user already exists")
+	}
+
+	cp := *user
+	tn := time.Now().Unix()
+	cp.PasswordHash, cp.PasswordUpdated = hash, tn
+	cp.Created, cp.Updated = tn, tn
+
+	return it.dir.UserSet(&cp)
+}
+
+// PasswordSet changes the password of the user.
+func (it *UserManager) PasswordSet(name, password string) error {
+
+	if err := it.policy.Check(name, password); err != nil {
+		return err
+	}
+
+	hash, err := PasswordHash(password, it.hash)
+	if err != nil {
+		return err
+	}
+
+	return it.passwordUpdate(name, "", hash)
+}
+
+// Authenticate verifies the password of the user, the password is rehashed
+// if its hash does not match the current PasswordHashConfig.
+func (it *UserManager) Authenticate(name, password string) (*UserEntry, error) {
+
+	user, err := it.dir.UserGet(name)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.PasswordHash == "" {
+		PasswordVerify(password, it.dummy, it.hash)
+		return nil, ErrUserInvalidAuth
+	}
+
+	ok, rehash, err := PasswordVerify(password, user.PasswordHash, it.hash)
+	if err != nil || !ok {
+		return nil, ErrUserInvalidAuth
+	}
+	if user.Disabled {
+		return nil, errors.New("user disabled")
+	}
+
+	if rehash {
+		if hash, err := PasswordHash(password, it.hash); err == nil {
+			it.passwordUpdate(name, user.PasswordHash, hash)
+		}
+	}
+
+	return user, nil
+}
+
+// passwordUpdate sets the hash of the user, if prev is set only if the hash
+// has not been changed meanwhile.
+func (it *UserManager) passwordUpdate(name, prev, hash string) error {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	user, err := it.dir.UserGet(name)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if prev != "" && user.PasswordHash != prev {
+		return nil
+	}
+
+	tn := time.Now().Unix()
+	user.PasswordHash, user.Updated = hash, tn
+	if prev == "" {
+		user.PasswordUpdated = tn
+	}
+
+	return it.dir.UserSet(user)
+}
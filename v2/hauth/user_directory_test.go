@@ -0,0 +1,135 @@
+// Copyright 2020 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hauth_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hauth2 "github.com/hooto/hauth/v2/hauth"
+)
+
+var tPasswordHashConfigs = []*hauth2.PasswordHashConfig{
+	{Alg: "argon2id", Argon2Memory: 1024, Argon2Time: 1},
+	{Alg: "scrypt", ScryptLogN: 10},
+	{Alg: "pbkdf2-sha256", Pbkdf2Iter: 1000},
+}
+
+func Test_PasswordHash(t *testing.T) {
+
+	for i, cfg := range tPasswordHashConfigs {
+
+		hash, err := hauth2.PasswordHash("passw0rd", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, "$"+cfg.Alg+"$") {
+			t.Fatalf("Failed on PasswordHash %s", hash)
+		}
+
+		if ok, rehash, err := hauth2.PasswordVerify("passw0rd", hash, cfg); err != nil || !ok || rehash {
+			t.Fatalf("Failed on PasswordVerify %s", hash)
+		}
+		if ok, _, _ := hauth2.PasswordVerify("passw0rd1", hash, cfg); ok {
+			t.Fatalf("Failed on PasswordVerify %s", hash)
+		}
+
+		next := tPasswordHashConfigs[(i+1)%len(tPasswordHashConfigs)]
+		if ok, rehash, _ := hauth2.PasswordVerify("passw0rd", hash, next); !ok || !rehash {
+			t.Fatalf("Failed on PasswordVerify rehash %s", hash)
+		}
+	}
+}
+
+func Test_PasswordPolicy(t *testing.T) {
+	policy := &hauth2.PasswordPolicy{
+		RequireDigit: true,
+		Denied:       []string{"password1"},
+	}
+	for pass, ok := range map[string]bool{
+		"short1":     false,
+		"longenough": false,
+		"PASSWORD1":  false,
+		"guest12345": true,
+	} {
+		if err := policy.Check("guest", pass); (err == nil) != ok {
+			t.Fatalf("Failed on PasswordPolicy %s", pass)
+		}
+	}
+	if err := policy.Check("guest12345", "guest12345"); err == nil {
+		t.Fatal("Failed on PasswordPolicy user name")
+	}
+}
+
+func Test_UserManager(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	dir, err := hauth2.NewFileUserDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userMgr := hauth2.NewUserManager(dir, tPasswordHashConfigs[2])
+	if err = userMgr.UserCreate(&hauth2.UserEntry{
+		Name:   "guest",
+		Roles:  []uint32{100},
+		Groups: []string{"staff"},
+	}, "passw0rd"); err != nil {
+		t.Fatal(err)
+	}
+	if err = userMgr.UserCreate(&hauth2.UserEntry{Name: "guest"}, "passw0rd"); err == nil {
+		t.Fatal("Failed on UserCreate exists")
+	}
+
+	if _, err = userMgr.Authenticate("guest", "passw0rd1"); err != hauth2.ErrUserInvalidAuth {
+		t.Fatal("Failed on Authenticate invalid password")
+	}
+	if _, err = userMgr.Authenticate("guest2", "passw0rd"); err != hauth2.ErrUserInvalidAuth {
+		t.Fatal("Failed on Authenticate unknown user")
+	}
+
+	// the algorithm has changed, the password is rehashed on login
+	dir, _ = hauth2.NewFileUserDirectory(path)
+	userMgr = hauth2.NewUserManager(dir, tPasswordHashConfigs[0])
+
+	user, err := userMgr.Authenticate("guest", "passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess := user.IdentityToken(3600); sess.Sub != "guest" ||
+		!sess.Allow("staff") || len(sess.Roles) != 1 {
+		t.Fatal("Failed on UserEntry.IdentityToken")
+	}
+
+	if user, _ = dir.UserGet("guest"); !strings.HasPrefix(user.PasswordHash, "$argon2id$") {
+		t.Fatal("Failed on Authenticate rehash")
+	}
+	if _, err = userMgr.Authenticate("guest", "passw0rd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entries returned by the directory do not share the stored slices
+	user.Roles[0], user.Groups[0] = 200, "admin"
+	if ls, _ := dir.UserList(); len(ls) != 1 || ls[0].Roles[0] != 100 {
+		t.Fatal("Failed on UserGet copy")
+	}
+	ls, _ := dir.UserList()
+	ls[0].Groups[0] = "admin"
+	if user, _ = dir.UserGet("guest"); user.Roles[0] != 100 || user.Groups[0] != "staff" {
+		t.Fatal("Failed on UserList copy")
+	}
+}
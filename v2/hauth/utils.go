@@ -19,6 +19,9 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
 )
 
 func jsonEncode(o any) []byte {
@@ -33,6 +36,10 @@ func jsonDecode(b []byte, o any) error {
 	return json.Unmarshal(b, o)
 }
 
+func jsonDecodeReader(r io.Reader, o any) error {
+	return json.NewDecoder(r).Decode(o)
+}
+
 func bytesEncode(b []byte) string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
@@ -70,3 +77,30 @@ func absInt64(a int64) int64 {
 	}
 	return a
 }
+
+// fileWriteAtomic writes bs to a temporary file (mode 0600) which is then
+// renamed to path, so that readers never see a partial write.
+func fileWriteAtomic(path string, bs []byte) error {
+
+	fp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := fp.Name()
+
+	if err = fp.Chmod(0600); err == nil {
+		if _, err = fp.Write(bs); err == nil {
+			err = fp.Sync()
+		}
+	}
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}